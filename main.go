@@ -2,9 +2,15 @@ package main
 
 import (
 	"ngrok-client/ngrokc"
+	"os"
 )
 
 func main() {
-	ngrokc.Start()
+	// ngrok-client validate -config file 只验证配置
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(ngrokc.Validate(os.Args[2:]))
+	}
+
+	os.Exit(ngrokc.Start())
 
 }
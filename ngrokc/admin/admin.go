@@ -0,0 +1,558 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"ngrok-client/ngrokc/connection"
+	"ngrok-client/ngrokc/metrics"
+	"ngrok-client/ngrokc/usage"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// unix socket 地址的前缀
+const unixPrefix = "unix:"
+
+// 列出隧道时代替 http_auth 的用户名和密码
+const REDACTED = "***"
+
+// Server 本地管理API，用于在运行时查看和管理隧道，可以管理多个会话(控制连接)
+//
+//	GET    /api/sessions        列出所有会话
+//	GET    /api/tunnels         列出所有隧道和公网URL
+//	POST   /api/tunnels         新建隧道，有多个会话时需要指定 session
+//	DELETE /api/tunnels/{name}  停止隧道，隧道名字在多个会话中重复时需要 ?session=
+//	GET    /api/proxies         列出正在代理的连接
+//	GET    /api/usage           每条隧道和每个访问者的流量统计，设置了 Usage 时开启
+//	GET    /metrics             Prometheus 格式的指标，设置了 Metrics 时开启
+//
+// POST 新建的隧道转发到本地端口，不支持 root(本地目录)，客户端认证、webhook、请求头改写和流量配额等也只能在配置文件中设置；
+// 列出隧道时 http_auth 显示为 "***"
+//
+// POST 请求的 Content-Type 必须为 application/json；带有非本机 Origin 的请求，
+// 以及监听 tcp 地址时 Host 不是 localhost 或者回环地址的请求返回 403
+type Server struct {
+	// 监听地址，只能是本机回环地址(127.0.0.1:4040)或者unix socket(unix:/path/to/sock)
+	Addr string
+
+	// 所有会话共用的指标
+	Metrics *metrics.Registry
+
+	// 所有会话共用的流量统计
+	Usage *usage.Ledger
+
+	sessions []session
+
+	listener   net.Listener
+	httpServer *http.Server
+}
+
+// session 一个会话的名字和控制连接
+type session struct {
+	name        string
+	controlConn *connection.ControlConnection
+}
+
+// sessionJSON 会话在API中的表示
+type sessionJSON struct {
+	Name       string `json:"name"`
+	ServerAddr string `json:"server_addr"`
+	Connected  bool   `json:"connected"`
+	Tunnels    int    `json:"tunnels"`
+}
+
+// tunnelJSON 隧道在API中的表示
+type tunnelJSON struct {
+	Session    string `json:"session,omitempty"`
+	Name       string `json:"name"`
+	Proto      string `json:"proto"`
+	Hostname   string `json:"hostname,omitempty"`
+	Subdomain  string `json:"subdomain,omitempty"`
+	HttpAuth   string `json:"http_auth,omitempty"`
+	RemotePort uint16 `json:"remote_port,omitempty"`
+	LocalPort  uint   `json:"local_port"`
+	Root       string `json:"root,omitempty"`
+	PublicUrl  string `json:"public_url"`
+
+	BandwidthLimit uint64 `json:"bandwidth_limit,omitempty"`
+	BandwidthBurst uint64 `json:"bandwidth_burst,omitempty"`
+
+	AllowCIDRs []string `json:"allow_cidrs,omitempty"`
+	DenyCIDRs  []string `json:"deny_cidrs,omitempty"`
+
+	VisitorRate           uint64 `json:"visitor_rate,omitempty"`
+	VisitorBurst          uint64 `json:"visitor_burst,omitempty"`
+	VisitorMaxConnections int    `json:"visitor_max_connections,omitempty"`
+}
+
+// proxyJSON 代理连接在API中的表示
+type proxyJSON struct {
+	Session    string    `json:"session,omitempty"`
+	Tunnel     string    `json:"tunnel"`
+	PublicUrl  string    `json:"public_url"`
+	ClientAddr string    `json:"client_addr"`
+	StartTime  time.Time `json:"start_time"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+}
+
+// usageJSON 一条隧道的流量统计在API中的表示
+type usageJSON struct {
+	Session string `json:"session,omitempty"`
+	Tunnel  string `json:"tunnel"`
+	usage.TunnelUsage
+}
+
+// errorJSON 错误响应
+type errorJSON struct {
+	Error string `json:"error"`
+}
+
+// Init(addr string, controlConn *connection.ControlConnection) 初始化管理API的参数
+// controlConn 为nil时，通过 AddSession() 添加会话
+func (server *Server) Init(addr string, controlConn *connection.ControlConnection) {
+	server.Addr = addr
+
+	if controlConn != nil {
+		server.AddSession("", controlConn)
+	}
+}
+
+// AddSession(name string, controlConn *connection.ControlConnection) 添加一个会话，需要在Start()之前调用
+func (server *Server) AddSession(name string, controlConn *connection.ControlConnection) {
+	server.sessions = append(server.sessions, session{name: name, controlConn: controlConn})
+}
+
+// findSession(name string) 根据名字查找会话，名字为空并且只有一个会话时返回这个会话
+func (server *Server) findSession(name string) (*session, error) {
+	if name == "" && len(server.sessions) == 1 {
+		return &server.sessions[0], nil
+	}
+
+	if name == "" {
+		return nil, errors.New("session is required")
+	}
+
+	for i := range server.sessions {
+		if server.sessions[i].name == name {
+			return &server.sessions[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("session %s not found", name)
+}
+
+// Start() 开始监听，监听失败时返回error，不阻塞
+func (server *Server) Start() error {
+	listener, err := listen(server.Addr)
+
+	if err != nil {
+		return err
+	}
+
+	server.listener = listener
+	server.httpServer = &http.Server{Handler: server.handler(!strings.HasPrefix(server.Addr, unixPrefix)), ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		err := server.httpServer.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Println("admin Serve():" + err.Error())
+		}
+	}()
+
+	return nil
+}
+
+// handler(checkHost bool) 管理API的 http.Handler
+// checkHost 为true时拒绝 Host 不是本机的请求，防止 DNS rebinding；unix socket 不能被浏览器访问，不需要检查
+func (server *Server) handler(checkHost bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/sessions", server.listSessions)
+	mux.HandleFunc("/api/tunnels", server.tunnels)
+	mux.HandleFunc("/api/tunnels/", server.tunnel)
+	mux.HandleFunc("/api/proxies", server.listProxies)
+	if server.Usage != nil {
+		mux.HandleFunc("/api/usage", server.listUsage)
+	}
+	if server.Metrics != nil {
+		mux.HandleFunc("/metrics", server.writeMetrics)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 浏览器中的其他网页可以向本机地址发送请求，只接受本机页面的跨域请求
+		if origin := r.Header.Get("Origin"); origin != "" && !isLoopbackOrigin(origin) {
+			writeJSON(w, http.StatusForbidden, errorJSON{Error: "origin " + origin + " is not allowed"})
+			return
+		}
+
+		if checkHost && !isLoopbackHost(r.Host) {
+			writeJSON(w, http.StatusForbidden, errorJSON{Error: "host " + r.Host + " is not allowed"})
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Close() 关闭管理API
+func (server *Server) Close() {
+	if server.httpServer != nil {
+		server.httpServer.Close()
+	}
+}
+
+// listen() 监听本机地址，拒绝非回环地址，避免把管理API暴露到网络上
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		path := strings.TrimPrefix(addr, unixPrefix)
+
+		// 删除上次没有清理的socket文件
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+
+		return net.Listen("unix", path)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("admin address %s is not a loopback address", addr)
+		}
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// isLoopbackHost(host string) host(可以带端口)是否为 localhost 或者回环地址
+func isLoopbackHost(host string) bool {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isLoopbackOrigin(origin string) Origin 头是否为本机的页面，null 和无法解析的 Origin 都不是
+func isLoopbackOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+
+	return isLoopbackHost(u.Host)
+}
+
+// tunnels() /api/tunnels
+func (server *Server) tunnels(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		server.listTunnels(w, r)
+	case http.MethodPost:
+		server.startTunnel(w, r)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// tunnel() /api/tunnels/{name}
+func (server *Server) tunnel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodDelete:
+		server.stopTunnel(w, r)
+	default:
+		methodNotAllowed(w, http.MethodDelete)
+	}
+}
+
+// listSessions() GET /api/sessions
+func (server *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	resp := make([]sessionJSON, 0, len(server.sessions))
+	for _, session := range server.sessions {
+		serverAddr := session.controlConn.ServerAddress()
+
+		resp = append(resp, sessionJSON{
+			Name:       session.name,
+			ServerAddr: serverAddr,
+			Connected:  serverAddr != "" && !session.controlConn.IsClose(),
+			Tunnels:    len(session.controlConn.Tunnels()),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// listTunnels() GET /api/tunnels
+func (server *Server) listTunnels(w http.ResponseWriter, r *http.Request) {
+	resp := make([]tunnelJSON, 0)
+
+	for _, session := range server.sessions {
+		for _, tunnel := range session.controlConn.Tunnels() {
+			item := toTunnelJSON(tunnel)
+			item.Session = session.name
+			resp = append(resp, item)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// startTunnel() POST /api/tunnels
+func (server *Server) startTunnel(w http.ResponseWriter, r *http.Request) {
+	// 浏览器不经过预检就可以跨域发送 text/plain 等类型的 POST，只接受 JSON
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		writeJSON(w, http.StatusUnsupportedMediaType, errorJSON{Error: "Content-Type must be application/json"})
+		return
+	}
+
+	var req tunnelJSON
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorJSON{Error: "invalid request body: " + err.Error()})
+		return
+	}
+
+	// root 只用于列出隧道，目录的 http.Handler 和中间件由配置文件创建
+	if req.Root != "" {
+		writeJSON(w, http.StatusBadRequest, errorJSON{Error: "root is not supported by the admin API, configure file tunnels in the config file"})
+		return
+	}
+
+	session, err := server.findSession(req.Session)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorJSON{Error: err.Error()})
+		return
+	}
+
+	allowCIDRs, err := connection.ParseCIDRList(req.AllowCIDRs)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorJSON{Error: "allow_cidrs: " + err.Error()})
+		return
+	}
+
+	denyCIDRs, err := connection.ParseCIDRList(req.DenyCIDRs)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorJSON{Error: "deny_cidrs: " + err.Error()})
+		return
+	}
+
+	tunnel := connection.Tunnel{
+		Name:       req.Name,
+		Protocol:   req.Proto,
+		Hostname:   req.Hostname,
+		Subdomain:  req.Subdomain,
+		HttpAuth:   req.HttpAuth,
+		RemotePort: req.RemotePort,
+		LocalPort:  req.LocalPort,
+
+		BandwidthLimit: req.BandwidthLimit,
+		BandwidthBurst: req.BandwidthBurst,
+
+		AllowCIDRs: allowCIDRs,
+		DenyCIDRs:  denyCIDRs,
+
+		VisitorRate:           req.VisitorRate,
+		VisitorBurst:          req.VisitorBurst,
+		VisitorMaxConnections: req.VisitorMaxConnections,
+	}
+
+	if err := session.controlConn.AddTunnel(tunnel); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorJSON{Error: err.Error()})
+		return
+	}
+
+	resp := toTunnelJSON(tunnel)
+	resp.Session = session.name
+
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// stopTunnel() DELETE /api/tunnels/{name}
+func (server *Server) stopTunnel(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/tunnels/")
+
+	// 没有指定会话时，在所有会话中查找这条隧道
+	var found []*session
+	if sessionName := r.URL.Query().Get("session"); sessionName != "" {
+		session, err := server.findSession(sessionName)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, errorJSON{Error: err.Error()})
+			return
+		}
+		found = append(found, session)
+	} else {
+		for i := range server.sessions {
+			for _, tunnel := range server.sessions[i].controlConn.Tunnels() {
+				if tunnel.Name == name {
+					found = append(found, &server.sessions[i])
+				}
+			}
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		writeJSON(w, http.StatusNotFound, errorJSON{Error: fmt.Sprintf("tunnel %s not found", name)})
+		return
+	case 1:
+	default:
+		writeJSON(w, http.StatusBadRequest, errorJSON{Error: fmt.Sprintf("tunnel %s exists in several sessions, session is required", name)})
+		return
+	}
+
+	if err := found[0].controlConn.RemoveTunnel(name); err != nil {
+		writeJSON(w, http.StatusNotFound, errorJSON{Error: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listProxies() GET /api/proxies
+func (server *Server) listProxies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	resp := make([]proxyJSON, 0)
+
+	for _, session := range server.sessions {
+		for _, proxy := range session.controlConn.Proxies() {
+			resp = append(resp, proxyJSON{
+				Session:    session.name,
+				Tunnel:     proxy.Tunnel,
+				PublicUrl:  proxy.Url,
+				ClientAddr: proxy.ClientAddr,
+				StartTime:  proxy.StartTime,
+				BytesIn:    proxy.BytesIn,
+				BytesOut:   proxy.BytesOut,
+			})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// listUsage() GET /api/usage
+func (server *Server) listUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	resp := make([]usageJSON, 0)
+
+	for _, session := range server.sessions {
+		tunnels := server.Usage.Tunnels(session.name)
+
+		names := make([]string, 0, len(tunnels))
+		for name := range tunnels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			resp = append(resp, usageJSON{Session: session.name, Tunnel: name, TunnelUsage: tunnels[name]})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// writeMetrics() GET /metrics
+func (server *Server) writeMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	if err := server.Metrics.WriteText(w); err != nil {
+		fmt.Println("admin writeMetrics():" + err.Error())
+	}
+}
+
+// toTunnelJSON(tunnel connection.Tunnel) 转换为API中的表示，不返回 http_auth 的用户名和密码
+func toTunnelJSON(tunnel connection.Tunnel) tunnelJSON {
+	httpAuth := ""
+	if tunnel.HttpAuth != "" {
+		httpAuth = REDACTED
+	}
+
+	return tunnelJSON{
+		Name:       tunnel.Name,
+		Proto:      tunnel.Protocol,
+		Hostname:   tunnel.Hostname,
+		Subdomain:  tunnel.Subdomain,
+		HttpAuth:   httpAuth,
+		RemotePort: tunnel.RemotePort,
+		LocalPort:  tunnel.LocalPort,
+		Root:       tunnel.Root,
+		PublicUrl:  tunnel.Url,
+
+		BandwidthLimit: tunnel.BandwidthLimit,
+		BandwidthBurst: tunnel.BandwidthBurst,
+
+		AllowCIDRs: cidrStrings(tunnel.AllowCIDRs),
+		DenyCIDRs:  cidrStrings(tunnel.DenyCIDRs),
+
+		VisitorRate:           tunnel.VisitorRate,
+		VisitorBurst:          tunnel.VisitorBurst,
+		VisitorMaxConnections: tunnel.VisitorMaxConnections,
+	}
+}
+
+// cidrStrings(prefixes []netip.Prefix) 转换为API中的字符串
+func cidrStrings(prefixes []netip.Prefix) []string {
+	var cidrs []string
+	for _, prefix := range prefixes {
+		cidrs = append(cidrs, prefix.String())
+	}
+
+	return cidrs
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, errorJSON{Error: "method not allowed"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil && !errors.Is(err, net.ErrClosed) {
+		fmt.Println("admin writeJSON():" + err.Error())
+	}
+}
@@ -0,0 +1,190 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"ngrok-client/ngrokc/connection"
+)
+
+// newServer() 有一个没有连接服务端的会话的管理API，添加的隧道等待验证成功后再请求
+func newServer(t *testing.T) (*Server, *connection.ControlConnection) {
+	controlConn := &connection.ControlConnection{}
+	controlConn.Init("127.0.0.1", 4443, "", "")
+	t.Cleanup(controlConn.Close)
+
+	server := &Server{}
+	server.Init("127.0.0.1:4040", controlConn)
+
+	return server, controlConn
+}
+
+func request(handler http.Handler, method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Host = "127.0.0.1:4040"
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+var jsonHeader = map[string]string{"Content-Type": "application/json"}
+
+func TestTunnels(t *testing.T) {
+	server, controlConn := newServer(t)
+	handler := server.handler(true)
+
+	w := request(handler, http.MethodPost, "/api/tunnels", `{"name": "web", "proto": "http", "local_port": 8080, "allow_cidrs": ["10.0.0.0/8"]}`,
+		map[string]string{"Content-Type": "application/json; charset=utf-8"})
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"name":"web","proto":"http","local_port":8080`) {
+		t.Fatalf("POST /api/tunnels = %d %s", w.Code, w.Body.String())
+	}
+
+	if tunnels := controlConn.Tunnels(); len(tunnels) != 1 || tunnels[0].Name != "web" || tunnels[0].LocalPort != 8080 || len(tunnels[0].AllowCIDRs) != 1 {
+		t.Fatalf("tunnels = %+v", tunnels)
+	}
+
+	w = request(handler, http.MethodPost, "/api/tunnels", `{"name": "web", "proto": "http", "local_port": 8081}`, jsonHeader)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "already exists") {
+		t.Fatalf("POST duplicate = %d %s", w.Code, w.Body.String())
+	}
+
+	w = request(handler, http.MethodPost, "/api/tunnels", `{"name": "db", "proto": "tcp", "local_port": 5432, "unknown": 1}`, jsonHeader)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid request body") {
+		t.Fatalf("POST unknown field = %d %s", w.Code, w.Body.String())
+	}
+
+	// 只能在配置文件中设置的选项
+	for _, body := range []string{
+		`{"name": "files", "proto": "http", "root": "/srv/www"}`,
+		`{"name": "quota", "proto": "http", "local_port": 8080, "daily_quota": 1000}`,
+		`{"name": "auth", "proto": "http", "local_port": 8080, "client_auth": {"basic": ["user:pass"]}}`,
+		`{"name": "hook", "proto": "http", "local_port": 8080, "webhook": {"provider": "github", "secret": "s"}}`,
+		`{"name": "headers", "proto": "http", "local_port": 8080, "request_headers": {"add": {"X-A": "1"}}}`,
+	} {
+		if w := request(handler, http.MethodPost, "/api/tunnels", body, jsonHeader); w.Code != http.StatusBadRequest {
+			t.Fatalf("POST %s = %d %s, want 400", body, w.Code, w.Body.String())
+		}
+	}
+
+	// 列出隧道时不返回 http_auth 的密码
+	w = request(handler, http.MethodPost, "/api/tunnels", `{"name": "private", "proto": "http", "local_port": 8081, "http_auth": "user:secret"}`, jsonHeader)
+	if w.Code != http.StatusCreated || strings.Contains(w.Body.String(), "secret") || !strings.Contains(w.Body.String(), `"http_auth":"***"`) {
+		t.Fatalf("POST with http_auth = %d %s", w.Code, w.Body.String())
+	}
+	if tunnels := controlConn.Tunnels(); len(tunnels) != 2 || tunnels[0].Name != "private" || tunnels[0].HttpAuth != "user:secret" {
+		t.Fatalf("tunnels = %+v", tunnels)
+	}
+
+	w = request(handler, http.MethodGet, "/api/tunnels", "", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"name":"web"`) || !strings.Contains(w.Body.String(), `"allow_cidrs":["10.0.0.0/8"]`) ||
+		!strings.Contains(w.Body.String(), `"http_auth":"***"`) || strings.Contains(w.Body.String(), "secret") {
+		t.Fatalf("GET /api/tunnels = %d %s", w.Code, w.Body.String())
+	}
+
+	if w := request(handler, http.MethodDelete, "/api/tunnels/private", "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /api/tunnels/private = %d %s", w.Code, w.Body.String())
+	}
+
+	w = request(handler, http.MethodGet, "/api/sessions", "", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"connected":false,"tunnels":1`) {
+		t.Fatalf("GET /api/sessions = %d %s", w.Code, w.Body.String())
+	}
+
+	w = request(handler, http.MethodDelete, "/api/tunnels/web", "", nil)
+	if w.Code != http.StatusNoContent || len(controlConn.Tunnels()) != 0 {
+		t.Fatalf("DELETE /api/tunnels/web = %d %s", w.Code, w.Body.String())
+	}
+
+	w = request(handler, http.MethodDelete, "/api/tunnels/web", "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("DELETE missing tunnel = %d %s", w.Code, w.Body.String())
+	}
+
+	w = request(handler, http.MethodPut, "/api/tunnels", "", nil)
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, POST" {
+		t.Fatalf("PUT /api/tunnels = %d %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestRejectCrossSiteRequests(t *testing.T) {
+	server, controlConn := newServer(t)
+	handler := server.handler(true)
+
+	const body = `{"name": "web", "proto": "http", "local_port": 22}`
+
+	// 其他网页不经过预检可以发送的 POST
+	for _, contentType := range []string{"", "text/plain", "application/x-www-form-urlencoded", "multipart/form-data; boundary=x"} {
+		w := request(handler, http.MethodPost, "/api/tunnels", body, map[string]string{"Content-Type": contentType})
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Fatalf("POST with Content-Type %q = %d, want 415", contentType, w.Code)
+		}
+	}
+
+	for _, origin := range []string{"https://evil.example", "null", "http://127.0.0.1.evil.example", "file://"} {
+		w := request(handler, http.MethodPost, "/api/tunnels", body, map[string]string{"Content-Type": "application/json", "Origin": origin})
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("POST with Origin %q = %d, want 403", origin, w.Code)
+		}
+	}
+
+	if tunnels := controlConn.Tunnels(); len(tunnels) != 0 {
+		t.Fatalf("rejected requests added tunnels %+v", tunnels)
+	}
+
+	// DNS rebinding 后 Host 为攻击者的域名
+	for _, host := range []string{"evil.example:4040", "evil.example", "10.0.0.1:4040", ""} {
+		r := httptest.NewRequest(http.MethodGet, "/api/tunnels", nil)
+		r.Host = host
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("GET with Host %q = %d, want 403", host, w.Code)
+		}
+	}
+
+	// 本机的页面和客户端
+	for _, header := range []map[string]string{
+		{"Origin": "http://localhost:3000"},
+		{"Origin": "http://127.0.0.1:4040"},
+		{"Origin": "http://[::1]:8080"},
+		{},
+	} {
+		if w := request(handler, http.MethodGet, "/api/tunnels", "", header); w.Code != http.StatusOK {
+			t.Fatalf("GET with %v = %d, want 200", header, w.Code)
+		}
+	}
+
+	for _, host := range []string{"localhost:4040", "LOCALHOST", "[::1]:4040", "127.0.0.1"} {
+		r := httptest.NewRequest(http.MethodGet, "/api/sessions", nil)
+		r.Host = host
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET with Host %q = %d, want 200", host, w.Code)
+		}
+	}
+
+	// unix socket 不检查 Host，仍然检查 Origin
+	r := httptest.NewRequest(http.MethodGet, "/api/tunnels", nil)
+	r.Host = "admin"
+	w := httptest.NewRecorder()
+	server.handler(false).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unix socket GET with Host admin = %d, want 200", w.Code)
+	}
+
+	r.Header.Set("Origin", "https://evil.example")
+	w = httptest.NewRecorder()
+	server.handler(false).ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("unix socket GET with foreign Origin = %d, want 403", w.Code)
+	}
+}
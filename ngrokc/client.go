@@ -0,0 +1,553 @@
+package ngrokc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"ngrok-client/ngrokc/admin"
+	"ngrok-client/ngrokc/connection"
+	"ngrok-client/ngrokc/metrics"
+	"ngrok-client/ngrokc/middleware"
+	"ngrok-client/ngrokc/transport"
+	"ngrok-client/ngrokc/usage"
+	"ngrok-client/ngrokc/util"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TunnelOptions 一条隧道的配置
+type TunnelOptions struct {
+	// 隧道名字，同一个Client中唯一
+	Name string
+	// 协议 http/https/tcp
+	Proto string
+
+	// http/https only
+	Hostname  string
+	Subdomain string
+	HttpAuth  string
+
+	// tcp only
+	RemotePort uint16
+
+	// 本地服务的端口
+	LocalPort uint
+
+	// http/https only，本地目录，不为空时隧道直接提供目录中的文件(支持 index.html 和 Range 请求)，不使用 LocalPort
+	Root string
+	// 目录中没有 index.html 时是否列出目录中的文件，为false时返回 404
+	DirectoryListing bool
+
+	// http/https only，在客户端验证访问者，验证失败的请求不会转发给本地服务，为nil时不验证
+	Auth *middleware.Auth
+	// http/https only，验证 webhook 请求的签名，签名无效的请求返回 401，为nil时不验证
+	Webhook *middleware.Webhook
+	// http/https only，改写请求头和响应头，为nil时不改写
+	Headers *middleware.Headers
+	// http/https only，其他处理请求的中间件，在 Auth、Webhook 和 Headers 之后按顺序执行
+	// 设置了 Auth、Webhook、Headers 或者 Middlewares 时，请求在进程内解析后通过 middleware.ReverseProxy 转发给本地服务
+	Middlewares []middleware.Middleware
+
+	// 这条隧道的带宽限制，每个方向每秒的字节数，为0时不限制
+	BandwidthLimit uint64
+	// 可以突发的字节数，为0时等于 BandwidthLimit
+	BandwidthBurst uint64
+
+	// 访问者IP的访问控制，先检查 DenyCIDRs；AllowCIDRs 不为空时只允许其中的地址
+	// 可以用 connection.ParseCIDRList 解析
+	AllowCIDRs []netip.Prefix
+	DenyCIDRs  []netip.Prefix
+
+	// 每个访问者IP每秒可以新建的代理连接数和可以突发的连接数(为0时等于 VisitorRate)，为0时不限制
+	VisitorRate  uint64
+	VisitorBurst uint64
+	// 每个访问者IP同时进行的代理连接数，为0时不限制
+	VisitorMaxConnections int
+
+	// 每天和每月的流量配额(收到的和发送的字节数)，超过后拒绝新的代理连接并中止正在进行的代理连接，为0时不限制
+	// 需要设置 Options.Usage
+	DailyQuota   uint64
+	MonthlyQuota uint64
+}
+
+// tunnel() 转换为控制连接的隧道
+func (opts TunnelOptions) tunnel() connection.Tunnel {
+	return connection.Tunnel{
+		Name:       opts.Name,
+		Protocol:   opts.Proto,
+		Hostname:   opts.Hostname,
+		Subdomain:  opts.Subdomain,
+		HttpAuth:   opts.HttpAuth,
+		RemotePort: opts.RemotePort,
+		LocalPort:  opts.LocalPort,
+		Root:       opts.Root,
+		Handler:    opts.handler(),
+
+		BandwidthLimit: opts.BandwidthLimit,
+		BandwidthBurst: opts.BandwidthBurst,
+
+		AllowCIDRs: opts.AllowCIDRs,
+		DenyCIDRs:  opts.DenyCIDRs,
+
+		VisitorRate:           opts.VisitorRate,
+		VisitorBurst:          opts.VisitorBurst,
+		VisitorMaxConnections: opts.VisitorMaxConnections,
+	}
+}
+
+// handler() 根据 Root、Auth、Webhook、Headers 和 Middlewares 生成隧道的HTTP处理，tcp 隧道或者既没有本地目录也没有中间件时返回nil
+func (opts TunnelOptions) handler() http.Handler {
+	if opts.Proto == util.PROTOCOL_TCP || (opts.Root == "" && opts.Auth == nil && opts.Webhook == nil && opts.Headers == nil && len(opts.Middlewares) == 0) {
+		return nil
+	}
+
+	localAddr := middleware.LocalAddress(opts.LocalPort)
+
+	backend := middleware.ReverseProxy(localAddr, opts.Proto == util.PROTOCOL_HTTPS)
+	if opts.Root != "" {
+		backend = middleware.FileServer(opts.Root, opts.DirectoryListing)
+	}
+
+	var middlewares []middleware.Middleware
+
+	// 先验证访问者，验证失败的请求不经过其他中间件
+	if opts.Auth != nil {
+		middlewares = append(middlewares, opts.Auth.Middleware(opts.Proto))
+	}
+
+	if opts.Webhook != nil {
+		middlewares = append(middlewares, opts.Webhook.Middleware())
+	}
+
+	if opts.Headers != nil {
+		middlewares = append(middlewares, opts.Headers.Middleware(localAddr, opts.Proto))
+	}
+
+	middlewares = append(middlewares, opts.Middlewares...)
+
+	return middleware.Chain(backend, middlewares...)
+}
+
+// quota() 转换为流量统计的配额
+func (opts TunnelOptions) quota() usage.Quota {
+	return usage.Quota{Daily: opts.DailyQuota, Monthly: opts.MonthlyQuota}
+}
+
+// Options Client的配置，不依赖全局配置和命令行参数
+type Options struct {
+	// 会话的名字，多个Client在同一个进程中运行时用于区分日志、指标和管理API中的会话
+	Name string
+
+	ServerHostname string
+	ServerPort     uint
+	User           string
+	Password       string
+
+	// 多个服务器的地址 host:port，连接或者验证失败时尝试下一个；为空时只使用 ServerHostname:ServerPort
+	Servers []string
+	// 选择服务器的方式 connection.SERVER_SELECTION_ORDERED(默认，按顺序) 或者 connection.SERVER_SELECTION_LATENCY(按连接速度)
+	ServerSelection string
+
+	// 连接服务器使用的TLS配置，为nil时不验证服务器证书
+	TLSConfig *tls.Config
+
+	// 连接服务器使用的HTTP CONNECT/SOCKS5代理，为nil时直接连接
+	// 可以使用 transport.ProxyFromEnvironment 读取 HTTPS_PROXY/ALL_PROXY/NO_PROXY
+	Proxy transport.ProxyFunc
+
+	// 自定义连接服务器的方式，不为nil时 TLSConfig 和 Proxy 被忽略
+	Dialer transport.Dialer
+
+	Tunnels []TunnelOptions
+
+	// socket读缓存大小，为0时使用默认值
+	ReadBufSize uint
+	// 最大proxy连接数，为0时使用默认值
+	MaxProxyCount int64
+
+	// 所有隧道共用的带宽限制，多个Client可以共用同一个，为nil时不限制
+	Bandwidth *connection.BandwidthLimit
+
+	// 本地管理API的监听地址，为空时不开启；多个Client共用管理API时使用 Group
+	AdminAddr string
+
+	// 记录连接和代理的指标，多个Client可以共用，为nil时不记录
+	Metrics *metrics.Registry
+
+	// 按隧道和访问者统计流量，检查隧道的流量配额，多个Client可以共用，为nil时不统计
+	// 按会话的名字区分，共用时会话的名字需要不同；由调用者 Close()
+	Usage *usage.Ledger
+
+	// 连接事件的回调
+	Events connection.Events
+}
+
+// Client 可以嵌入到其他Go程序中的ngrok客户端
+type Client struct {
+	opts Options
+
+	ccon        *connection.ControlConnection
+	adminServer *admin.Server
+
+	// 是否已经验证成功
+	authed atomic.Bool
+
+	// 来自 Options.Tunnels 和 UpdateTunnels() 的隧道名字，重新加载时只删除这些隧道，管理API添加的隧道不受影响
+	configuredMutex sync.Mutex
+	configured      map[string]bool
+
+	// 验证成功并且所有隧道都建立成功后关闭
+	ready     chan bool
+	readyOnce sync.Once
+
+	// Service() 返回后关闭
+	done chan bool
+	// Service() 返回的错误
+	err error
+
+	startOnce sync.Once
+	closeOnce sync.Once
+}
+
+// NewClient(opts Options) 根据配置创建一个Client，并没有真正连接
+func NewClient(opts Options) *Client {
+	client := &Client{opts: opts, ready: make(chan bool), done: make(chan bool)}
+
+	client.ccon = &connection.ControlConnection{}
+	client.ccon.Init(opts.ServerHostname, opts.ServerPort, opts.User, opts.Password)
+	client.ccon.SetProxyConfig(opts.ReadBufSize, opts.MaxProxyCount)
+	client.ccon.Servers = opts.Servers
+	client.ccon.ServerSelection = opts.ServerSelection
+	client.ccon.TLSConfig = opts.TLSConfig
+	client.ccon.Proxy = opts.Proxy
+	client.ccon.Dialer = opts.Dialer
+	client.ccon.Bandwidth = opts.Bandwidth
+
+	if opts.Usage != nil {
+		client.ccon.Admission = func(tunnel connection.Tunnel, clientAddr string) error {
+			return opts.Usage.Check(opts.Name, tunnel.Name)
+		}
+
+		client.ccon.Accept = func(tunnel, clientAddr string) {
+			opts.Usage.Connect(opts.Name, tunnel, clientAddr)
+		}
+
+		// 传输时记录流量，超过配额后中止正在进行的代理连接
+		client.ccon.Transfer = func(tunnel, clientAddr, direction string, n int) error {
+			if direction == connection.DIRECTION_INBOUND {
+				return opts.Usage.Transfer(opts.Name, tunnel, clientAddr, int64(n), 0)
+			}
+			return opts.Usage.Transfer(opts.Name, tunnel, clientAddr, 0, int64(n))
+		}
+	}
+
+	return client
+}
+
+// Start(ctx context.Context) 连接服务器并建立所有隧道，所有隧道建立成功后返回隧道信息(包括公网URL)
+// ctx 只控制建立隧道的过程，ctx 被取消时会关闭Client; 隧道建立后需要调用 Close() 关闭
+func (client *Client) Start(ctx context.Context) ([]connection.Tunnel, error) {
+	started := false
+	client.startOnce.Do(func() { started = true })
+
+	if !started {
+		return nil, errors.New("client already started")
+	}
+
+	client.configuredMutex.Lock()
+	client.configured = make(map[string]bool)
+	for _, opts := range client.opts.Tunnels {
+		client.configured[opts.Name] = true
+	}
+	client.configuredMutex.Unlock()
+
+	for _, opts := range client.opts.Tunnels {
+		if err := client.ccon.AddTunnel(opts.tunnel()); err != nil {
+			return nil, client.fail(err)
+		}
+		client.opts.Usage.SetQuota(client.opts.Name, opts.Name, opts.quota())
+	}
+
+	// 在用户的回调之外，检查是否已经验证成功并且所有隧道已经建立
+	events := client.instrument(client.opts.Events)
+	onAuth := events.OnAuth
+	events.OnAuth = func(clientId string) {
+		if onAuth != nil {
+			onAuth(clientId)
+		}
+		client.authed.Store(true)
+		client.checkReady()
+	}
+	onTunnel := events.OnTunnel
+	events.OnTunnel = func(tunnel connection.Tunnel) {
+		if onTunnel != nil {
+			onTunnel(tunnel)
+		}
+		client.checkReady()
+	}
+	client.ccon.Events = events
+
+	if client.opts.AdminAddr != "" {
+		client.adminServer = &admin.Server{}
+		client.adminServer.Init(client.opts.AdminAddr, nil)
+		client.adminServer.AddSession(client.opts.Name, client.ccon)
+		client.adminServer.Metrics = client.opts.Metrics
+		client.adminServer.Usage = client.opts.Usage
+
+		if err := client.adminServer.Start(); err != nil {
+			return nil, client.fail(err)
+		}
+	}
+
+	go func() {
+		client.err = client.ccon.Service(context.Background())
+		close(client.done)
+	}()
+
+	select {
+	case <-client.ready:
+		return client.ccon.Tunnels(), nil
+	case <-client.done:
+		client.Close()
+		if client.err != nil {
+			return nil, client.err
+		}
+		return nil, errors.New("session closed before tunnels were established")
+	case <-ctx.Done():
+		client.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// instrument(events connection.Events) 在用户的回调之外记录会话的指标
+func (client *Client) instrument(events connection.Events) connection.Events {
+	registry := client.opts.Metrics
+	session := client.opts.Name
+
+	up := registry.Gauge("ngrokc_session_up", "Whether the session is authenticated with a server.", "session", session)
+	failovers := registry.Counter("ngrokc_server_failovers_total", "Servers that failed before the session connected.", "session", session)
+	tunnels := registry.Counter("ngrokc_tunnels_established_total", "Tunnels established by the server.", "session", session)
+	proxies := registry.Counter("ngrokc_proxy_connections_total", "Proxy connections started.", "session", session)
+	active := registry.Gauge("ngrokc_proxy_connections_active", "Proxy connections in progress.", "session", session)
+	rejected := registry.Counter("ngrokc_proxy_connections_rejected_total", "Proxy connections rejected before connecting the local service.", "session", session)
+	throttledHelp := "Time proxy connections waited for bandwidth limits."
+
+	wrapped := events
+
+	wrapped.OnAuth = func(clientId string) {
+		up.Set(1)
+		if events.OnAuth != nil {
+			events.OnAuth(clientId)
+		}
+	}
+	wrapped.OnServerError = func(addr string, err error) {
+		failovers.Inc()
+		if events.OnServerError != nil {
+			events.OnServerError(addr, err)
+		}
+	}
+	wrapped.OnTunnel = func(tunnel connection.Tunnel) {
+		tunnels.Inc()
+		if events.OnTunnel != nil {
+			events.OnTunnel(tunnel)
+		}
+	}
+	wrapped.OnProxyStart = func(proxy connection.ProxyInfo) {
+		proxies.Inc()
+		active.Inc()
+		if events.OnProxyStart != nil {
+			events.OnProxyStart(proxy)
+		}
+	}
+	wrapped.OnProxyClose = func(proxy connection.ProxyInfo) {
+		active.Dec()
+		if events.OnProxyClose != nil {
+			events.OnProxyClose(proxy)
+		}
+	}
+	wrapped.OnProxyReject = func(proxy connection.ProxyInfo, err error) {
+		rejected.Inc()
+		if events.OnProxyReject != nil {
+			events.OnProxyReject(proxy, err)
+		}
+	}
+	wrapped.OnThrottle = func(tunnel, direction string, delay time.Duration) {
+		registry.Counter("ngrokc_throttled_seconds_total", throttledHelp, "session", session, "tunnel", tunnel, "direction", direction).Add(delay.Seconds())
+		if events.OnThrottle != nil {
+			events.OnThrottle(tunnel, direction, delay)
+		}
+	}
+	wrapped.OnClose = func(err error) {
+		up.Set(0)
+		if events.OnClose != nil {
+			events.OnClose(err)
+		}
+	}
+
+	return wrapped
+}
+
+// Name() 会话的名字
+func (client *Client) Name() string {
+	return client.opts.Name
+}
+
+// fail(err error) 在 Service() 开始之前出错时，结束Client并返回错误
+func (client *Client) fail(err error) error {
+	client.err = err
+	close(client.done)
+
+	return err
+}
+
+// checkReady() 验证成功并且所有隧道都有URL时，通知 Start() 返回
+func (client *Client) checkReady() {
+	if !client.authed.Load() {
+		return
+	}
+
+	for _, tunnel := range client.ccon.Tunnels() {
+		if tunnel.Url == "" {
+			return
+		}
+	}
+
+	client.readyOnce.Do(func() { close(client.ready) })
+}
+
+// Listen(ctx context.Context, opts TunnelOptions) 在已经 Start() 的Client上新建一条隧道，
+// 隧道建立成功后返回 net.Listener，每条代理连接都会作为 net.Conn 从 Accept() 返回，不需要本地端口
+// opts.LocalPort 会被忽略，Listener 的 Addr() 是隧道的公网URL
+func (client *Client) Listen(ctx context.Context, opts TunnelOptions) (net.Listener, error) {
+	listener, err := client.ccon.Listen(opts.tunnel())
+
+	if err != nil {
+		return nil, err
+	}
+
+	client.opts.Usage.SetQuota(client.opts.Name, opts.Name, opts.quota())
+
+	select {
+	case <-listener.Ready():
+		return listener, nil
+	case <-listener.Closed():
+		return nil, listener.Err()
+	case <-client.done:
+		listener.Close()
+		return nil, errors.New("session closed before tunnel was established")
+	case <-ctx.Done():
+		listener.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// UpdateTunnels(tunnels []TunnelOptions) 把隧道更新为tunnels，用于重新加载配置
+// 新的隧道会被请求，之前配置的隧道不在tunnels中时会被删除，只有本地端口、HTTP中间件、带宽限制、IP访问控制或者访问者限制改变的隧道直接修改，
+// 其他配置改变的隧道会重新请求，请求成功后才替换旧的隧道，失败时保留旧的隧道；没有变化的隧道、Listen()和管理API创建的隧道以及正在进行的代理连接不受影响
+// 新隧道请求失败时通过 Events.OnTunnelError 通知，返回的错误包含所有不能马上处理的隧道
+func (client *Client) UpdateTunnels(tunnels []TunnelOptions) error {
+	client.configuredMutex.Lock()
+	defer client.configuredMutex.Unlock()
+
+	current := make(map[string]connection.Tunnel)
+	for _, tunnel := range client.ccon.Tunnels() {
+		current[tunnel.Name] = tunnel
+	}
+
+	var errs []error
+	wanted := make(map[string]bool)
+
+	for _, opts := range tunnels {
+		wanted[opts.Name] = true
+		tunnel := opts.tunnel()
+
+		// 配额在接受代理连接和传输数据时检查，直接修改
+		client.opts.Usage.SetQuota(client.opts.Name, opts.Name, opts.quota())
+
+		old, ok := current[opts.Name]
+
+		var err error
+		switch {
+		case !ok:
+			err = client.ccon.AddTunnel(tunnel)
+		case old.Listener != nil:
+			err = fmt.Errorf("tunnel %s is used by a listener", opts.Name)
+		case old.Protocol != tunnel.Protocol || old.Hostname != tunnel.Hostname || old.Subdomain != tunnel.Subdomain ||
+			old.HttpAuth != tunnel.HttpAuth || old.RemotePort != tunnel.RemotePort || old.LocalPort != tunnel.LocalPort || old.Root != tunnel.Root ||
+			old.BandwidthLimit != tunnel.BandwidthLimit || old.BandwidthBurst != tunnel.BandwidthBurst ||
+			!slices.Equal(old.AllowCIDRs, tunnel.AllowCIDRs) || !slices.Equal(old.DenyCIDRs, tunnel.DenyCIDRs) ||
+			old.VisitorRate != tunnel.VisitorRate || old.VisitorBurst != tunnel.VisitorBurst || old.VisitorMaxConnections != tunnel.VisitorMaxConnections ||
+			// 中间件不能比较，总是替换
+			old.Handler != nil || tunnel.Handler != nil:
+			err = client.ccon.UpdateTunnel(tunnel)
+		}
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for name, tunnel := range current {
+		if client.configured[name] && !wanted[name] && tunnel.Listener == nil {
+			if err := client.ccon.RemoveTunnel(name); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	client.configured = wanted
+
+	return errors.Join(errs...)
+}
+
+// Tunnels() 获取所有隧道的信息
+func (client *Client) Tunnels() []connection.Tunnel {
+	return client.ccon.Tunnels()
+}
+
+// ControlConnection() 获取底层的控制连接
+func (client *Client) ControlConnection() *connection.ControlConnection {
+	return client.ccon
+}
+
+// Wait() 阻塞直到控制连接断开，返回 Service() 的错误
+func (client *Client) Wait() error {
+	<-client.done
+	return client.err
+}
+
+// Shutdown(ctx context.Context) 优雅关闭Client：关闭管理API和控制连接，服务器不再转发新的访问，
+// 已经开始代理的连接继续传输直到结束，ctx 结束时强制关闭剩下的代理连接
+// 所有代理连接都正常结束时返回nil，被强制关闭时返回 ctx.Err()；已经关闭时返回nil
+func (client *Client) Shutdown(ctx context.Context) error {
+	var err error
+
+	client.closeOnce.Do(func() {
+		if client.adminServer != nil {
+			client.adminServer.Close()
+		}
+
+		err = client.ccon.Drain(ctx)
+	})
+
+	return err
+}
+
+// Close() 关闭控制连接和管理API，可以重复调用
+func (client *Client) Close() error {
+	client.closeOnce.Do(func() {
+		if client.adminServer != nil {
+			client.adminServer.Close()
+		}
+
+		client.ccon.Close()
+	})
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// 环境变量的前缀，环境变量名为前缀加上配置项名字的大写，例如 NGROKC_SERVER_HOSTNAME
+const EnvPrefix = "NGROKC_"
+
+// 配置文件路径的环境变量，-config 为空时使用
+const EnvConfigFile = EnvPrefix + "CONFIG"
+
+// 环境变量名加上这个后缀时，值为保存配置的文件路径，用于 Kubernetes 等挂载的密钥
+const envFileSuffix = "_FILE"
+
+// EnvError 环境变量的值无效
+type EnvError struct {
+	Name string
+	Err  error
+}
+
+func (e *EnvError) Error() string {
+	return "environment variable " + e.Name + ": " + e.Err.Error()
+}
+
+func (e *EnvError) Unwrap() error {
+	return e.Err
+}
+
+// lookupEnv(name string) 读取环境变量 name 或者 name_FILE 指向的文件，返回值和是否设置
+// 空值当作没有设置
+func lookupEnv(name string) (string, bool, error) {
+	value, hasValue := os.LookupEnv(name)
+	file, hasFile := os.LookupEnv(name + envFileSuffix)
+
+	if hasValue && value != "" && hasFile && file != "" {
+		return "", false, &EnvError{Name: name, Err: fmt.Errorf("both %s and %s%s are set", name, name, envFileSuffix)}
+	}
+
+	if hasFile && file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", false, &EnvError{Name: name + envFileSuffix, Err: err}
+		}
+
+		// 挂载的文件通常以换行结尾
+		return strings.TrimRight(string(content), "\r\n"), true, nil
+	}
+
+	return value, value != "", nil
+}
+
+// configFileFromEnv() -config 为空时，从环境变量中读取配置文件路径
+func configFileFromEnv() (string, error) {
+	file, _, err := lookupEnv(EnvConfigFile)
+	return file, err
+}
+
+// applyEnv(conf *Configuration) 用设置了的环境变量覆盖配置
+// 每个配置项对应的环境变量为 NGROKC_ 加上json名字的大写，tunnels 为JSON数组
+func applyEnv(conf *Configuration) error {
+	value := reflect.ValueOf(conf).Elem()
+	confType := value.Type()
+
+	for i := 0; i < confType.NumField(); i++ {
+		tag := confType.Field(i).Tag.Get("json")
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		name := EnvPrefix + strings.ToUpper(tag)
+
+		envValue, ok, err := lookupEnv(name)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		if err := setField(value.Field(i), envValue); err != nil {
+			return &EnvError{Name: name, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// setField(field reflect.Value, value string) 把环境变量的值转换为配置项的类型
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	default:
+		// tunnels 等复杂的配置使用JSON
+		decoder := json.NewDecoder(bytes.NewReader([]byte(value)))
+		decoder.DisallowUnknownFields()
+
+		target := reflect.New(field.Type())
+		if err := decoder.Decode(target.Interface()); err != nil {
+			return err
+		}
+		field.Set(target.Elem())
+	}
+
+	return nil
+}
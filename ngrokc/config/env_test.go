@@ -0,0 +1,130 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "config.conf")
+	os.WriteFile(file, []byte(`{"server_hostname": "file.example.com", "server_port": 4443, "user": "file-user", "password": "file-password", "read_buf_size": 4096, "http_local_port": 80}`), 0600)
+
+	secret := filepath.Join(dir, "password")
+	os.WriteFile(secret, []byte("secret-password\n"), 0600)
+
+	t.Setenv("NGROKC_CONFIG", file)
+	t.Setenv("NGROKC_SERVER_HOSTNAME", "env.example.com")
+	t.Setenv("NGROKC_SERVER_PORT", "5443")
+	t.Setenv("NGROKC_PASSWORD_FILE", secret)
+	t.Setenv("NGROKC_TRUST_HOST_ROOT_CERTS", "true")
+	t.Setenv("NGROKC_TUNNELS", `[{"name": "ssh", "proto": "tcp", "remote_port": 2222, "local_port": 22}]`)
+
+	if err := ParseFlags([]string{"-server_port", "6443"}); err != nil {
+		t.Fatal(err)
+	}
+	defer ParseFlags(nil)
+
+	conf, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.ServerHostname != "env.example.com" {
+		t.Errorf("ServerHostname = %q, want env over file", conf.ServerHostname)
+	}
+
+	if conf.ServerPort != 6443 {
+		t.Errorf("ServerPort = %d, want flag over env", conf.ServerPort)
+	}
+
+	if conf.User != "file-user" || conf.ReadBufSize != 4096 || conf.MaxProxyCount != 10 {
+		t.Errorf("conf = %+v, want file and default values", conf)
+	}
+
+	if conf.Password != "secret-password" {
+		t.Errorf("Password = %q, want value from NGROKC_PASSWORD_FILE", conf.Password)
+	}
+
+	if !conf.TrustHostRootCerts {
+		t.Error("TrustHostRootCerts = false")
+	}
+
+	if len(conf.Tunnels) != 1 || conf.Tunnels[0].Name != "ssh" || conf.Tunnels[0].RemotePort != 2222 {
+		t.Errorf("Tunnels = %+v", conf.Tunnels)
+	}
+}
+
+func TestLoadZeroFlags(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.conf")
+	os.WriteFile(file, []byte(`{"server_hostname": "file.example.com", "server_port": 4443, "http_local_port": 80, "grace_period": 60, "bandwidth_limit": 1024}`), 0600)
+
+	t.Setenv("NGROKC_CONFIG", file)
+	t.Setenv("NGROKC_MAX_PROXY_COUNT", "20")
+
+	// 设置为零值的参数也覆盖配置文件和环境变量
+	if err := ParseFlags([]string{"-grace_period", "0", "-bandwidth_limit=0"}); err != nil {
+		t.Fatal(err)
+	}
+	defer ParseFlags(nil)
+
+	conf, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.GracePeriod != 0 || conf.BandwidthLimit != 0 || conf.MaxProxyCount != 20 {
+		t.Fatalf("conf = %+v, want grace_period and bandwidth_limit 0 from flags", conf)
+	}
+
+	if err := ParseFlags([]string{"-max_proxy_count", "0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var validationErr *ValidationError
+	if _, err := Load(); !errors.As(err, &validationErr) || !strings.Contains(err.Error(), "max_proxy_count") {
+		t.Fatalf("Load with -max_proxy_count 0 = %v, want *ValidationError", err)
+	}
+
+	// 之前设置的参数不再覆盖配置
+	if err := ParseFlags(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if conf, err := Load(); err != nil || conf.GracePeriod != 60 || conf.MaxProxyCount != 20 {
+		t.Fatalf("Load after ParseFlags(nil) = %+v, %v", conf, err)
+	}
+}
+
+func TestLoadEnvErrors(t *testing.T) {
+	t.Setenv("NGROKC_SERVER_HOSTNAME", "env.example.com")
+	t.Setenv("NGROKC_HTTP_LOCAL_PORT", "80")
+
+	for _, env := range [][2]string{
+		{"NGROKC_SERVER_PORT", "abc"},
+		{"NGROKC_TRUST_HOST_ROOT_CERTS", "maybe"},
+		{"NGROKC_TUNNELS", `[{"name": "web", "prot": "http"}]`},
+		{"NGROKC_PASSWORD_FILE", "/nonexistent/password"},
+	} {
+		t.Run(env[0], func(t *testing.T) {
+			t.Setenv(env[0], env[1])
+
+			var envErr *EnvError
+			if _, err := Load(); !errors.As(err, &envErr) {
+				t.Fatalf("Load = %v, want *EnvError", err)
+			}
+		})
+	}
+
+	t.Setenv("NGROKC_PASSWORD", "a")
+	t.Setenv("NGROKC_PASSWORD_FILE", "/etc/hostname")
+
+	var envErr *EnvError
+	if _, err := Load(); !errors.As(err, &envErr) {
+		t.Fatalf("Load with both NGROKC_PASSWORD and NGROKC_PASSWORD_FILE = %v, want *EnvError", err)
+	}
+}
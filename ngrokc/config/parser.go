@@ -1,13 +1,19 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
-	"fmt"
 	"os"
+	"strings"
+
+	"ngrok-client/ngrokc/connection"
 )
 
-var configFile = flag.String("config", "", "config file path")
+// 默认的优雅关闭等待秒数
+const DefaultGracePeriod = 30
+
+var configFile = flag.String("config", "", "config file path, default $NGROKC_CONFIG")
 
 // Server config
 var serverHostname = flag.String("server_hostname", "", "Server hostname, IP or domain name")
@@ -25,90 +31,233 @@ var httpsHostname = flag.String("https_hostname", "", "Https hostname, IP or dom
 var httpsSubdomain = flag.String("https_subdomain", "", "Https subdomian name, some server maybe not accept, can be null")
 var httpsLocalPort = flag.Int("https_local_port", 0, "Local https port")
 
-var readBufSize = flag.Int("read_buf_size", 0, "Socket read buffer size")
+var readBufSize = flag.Int("read_buf_size", 0, "Socket read buffer size, default 2048")
 
 // 最大Proxy连接数限制
-var maxProxyCount = flag.Int64("max_proxy_count", 10, "Proxy connection max count")
+var maxProxyCount = flag.Int64("max_proxy_count", 0, "Proxy connection max count, default 10")
+
+// 所有隧道共用的带宽限制
+var bandwidthLimit = flag.Uint64("bandwidth_limit", 0, "Bandwidth limit of all tunnels in bytes per second for each direction, default unlimited")
+var bandwidthBurst = flag.Uint64("bandwidth_burst", 0, "Bytes that can be sent in a burst over bandwidth_limit, default bandwidth_limit")
+
+// 流量统计
+var usageFile = flag.String("usage_file", "", "File to persist traffic accounting across restarts, can be null")
+
+// 连接服务器的代理
+var proxyURL = flag.String("proxy_url", "", "Proxy to connect server, http://[user:password@]host:port or socks5://host:port, none to ignore HTTPS_PROXY/ALL_PROXY, can be null")
+
+// 多个服务器
+var servers = flag.String("servers", "", "Comma separated server addresses host:port, tried in server_selection order on connection or auth failure, can be null")
+var serverSelection = flag.String("server_selection", "", "How to choose from servers: ordered or latency, default ordered")
+
+// 通过WebSocket网关连接服务器
+var transportURL = flag.String("transport_url", "", "WebSocket gateway to connect server through, ws://host/path or wss://host/path, can be null")
 
-// parseConfigFile() 从指定的配置文件中读取配置.
-func ParseConfigFile(filepath string, conf *Configuration) {
-	file, err := os.Open(filepath)
+// 优雅关闭
+var gracePeriod = flag.Int("grace_period", 0, "Seconds to wait for active proxy connections on SIGTERM/SIGINT before force closing, default 30")
+
+// 本地管理API
+var adminAddr = flag.String("admin_addr", "", "Local admin API address, loopback host:port or unix:/path/to/sock, can be null")
+
+// ParseConfigFile() 从指定的配置文件中读取配置.
+// 扩展名为 .yml/.yaml 时按 ngrok 1.x 的 ngrok.yml 格式解析，否则按JSON解析
+// 配置文件中有未知的配置项时返回错误
+func ParseConfigFile(filepath string, conf *Configuration) error {
+	content, err := os.ReadFile(filepath)
 
 	if err != nil {
-		fmt.Println("config file error:" + err.Error())
-		return
+		return err
 	}
 
-	defer file.Close()
+	if IsYamlFile(filepath) {
+		err = parseYamlConfig(content, conf)
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
 
-	decoder := json.NewDecoder(file)
-
-	err = decoder.Decode(&conf)
+		err = decoder.Decode(conf)
+	}
 
 	if err != nil {
-		fmt.Println("config file parse error:" + err.Error())
-		return
+		return &FileError{Path: filepath, Err: err}
+	}
+
+	return nil
+}
+
+// 最近一次 ParseFlags() 时命令行中设置了的参数，设置为零值(例如 -grace_period 0)的参数也会覆盖环境变量和配置文件
+var setFlags = map[string]bool{}
+
+// ParseFlags(args []string) 解析命令行参数，不包括程序名
+// 只有这次设置了的参数会覆盖配置，之前调用时设置的参数不再生效
+func ParseFlags(args []string) error {
+	// flag.CommandLine 记录的设置过的参数不能清除，每次用新的 FlagSet 解析，参数的值仍然写入上面的变量
+	flags := flag.NewFlagSet(flag.CommandLine.Name(), flag.CommandLine.ErrorHandling())
+	flags.SetOutput(flag.CommandLine.Output())
+	flags.Usage = func() { flag.Usage() }
+
+	flag.VisitAll(func(f *flag.Flag) {
+		flags.Var(f.Value, f.Name, f.Usage)
+	})
+
+	if err := flags.Parse(args); err != nil {
+		return err
 	}
+
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	setFlags = set
+
+	return nil
 }
 
-// parseConfig() 从配置文件和命令行中解析配置，优先选择命令行中的配置
-func ParseConfig() {
+// Load() 从默认值、配置文件、环境变量和命令行中读取配置并验证
+// 优先级为 命令行 > 环境变量 > 配置文件 > 默认值
+// 需要先调用 ParseFlags()，每次调用都会重新读取配置文件和环境变量
+func Load() (*Configuration, error) {
+	conf := &Configuration{
+		ReadBufSize:   connection.DefaultReadBufSize,
+		MaxProxyCount: connection.DefaultMaxProxyCount,
+		GracePeriod:   DefaultGracePeriod,
+	}
+
+	path := ""
+	if setFlags["config"] {
+		path = *configFile
+	}
 
-	flag.Parse()
+	if path == "" {
+		var err error
+		if path, err = configFileFromEnv(); err != nil {
+			return nil, err
+		}
+	}
 
 	// 配置文件
-	if *configFile != "" {
+	if path != "" {
+		if err := ParseConfigFile(path, conf); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyEnv(conf); err != nil {
+		return nil, err
+	}
 
-		ParseConfigFile(*configFile, CONFIG)
+	applyFlags(conf)
 
+	if err := Validate(conf); err != nil {
+		return nil, err
 	}
 
-	if *serverHostname != "" {
-		CONFIG.ServerHostname = *serverHostname
+	return conf, nil
+}
+
+// ParseConfig() 解析命令行参数并读取配置到 CONFIG 中
+func ParseConfig() error {
+	if err := ParseFlags(os.Args[1:]); err != nil {
+		return err
+	}
+
+	conf, err := Load()
+	if err != nil {
+		return err
+	}
+
+	CONFIG = conf
+
+	return nil
+}
+
+// applyFlags(conf *Configuration) 用命令行中设置了的参数覆盖配置，包括设置为零值的参数
+func applyFlags(conf *Configuration) {
+	if setFlags["server_hostname"] {
+		conf.ServerHostname = *serverHostname
+	}
+
+	if setFlags["server_port"] {
+		conf.ServerPort = uint(*serverPort)
+	}
+
+	if setFlags["servers"] {
+		conf.Servers = nil
+		if *servers != "" {
+			conf.Servers = strings.Split(*servers, ",")
+		}
 	}
 
-	if *serverPort > 0 {
-		CONFIG.ServerPort = uint(*serverPort)
+	if setFlags["server_selection"] {
+		conf.ServerSelection = *serverSelection
 	}
 
-	if *username != "" {
-		CONFIG.User = *username
+	if setFlags["user"] {
+		conf.User = *username
 	}
 
-	if *password != "" {
-		CONFIG.Password = *password
+	if setFlags["password"] {
+		conf.Password = *password
 	}
 
-	if *httpHostname != "" {
-		CONFIG.HttpHostname = *httpHostname
+	if setFlags["http_hostname"] {
+		conf.HttpHostname = *httpHostname
 	}
 
-	if *httpSubdomain != "" {
-		CONFIG.HttpSubdomain = *httpSubdomain
+	if setFlags["http_subdomain"] {
+		conf.HttpSubdomain = *httpSubdomain
 	}
 
-	if *httpLocalPort > 0 {
-		CONFIG.HttpLocalPort = uint(*httpLocalPort)
+	if setFlags["http_local_port"] {
+		conf.HttpLocalPort = uint(*httpLocalPort)
 	}
 
-	if *httpsHostname != "" {
-		CONFIG.HttpsHostname = *httpsHostname
+	if setFlags["https_hostname"] {
+		conf.HttpsHostname = *httpsHostname
 	}
 
-	if *httpsSubdomain != "" {
-		CONFIG.HttpsSubdomain = *httpsSubdomain
+	if setFlags["https_subdomain"] {
+		conf.HttpsSubdomain = *httpsSubdomain
 	}
 
-	if *httpsLocalPort > 0 {
-		CONFIG.HttpsLocalPort = uint(*httpsLocalPort)
+	if setFlags["https_local_port"] {
+		conf.HttpsLocalPort = uint(*httpsLocalPort)
 	}
 
-	if *readBufSize > 0 {
-		CONFIG.ReadBufSize = uint(*readBufSize)
+	if setFlags["read_buf_size"] {
+		conf.ReadBufSize = uint(*readBufSize)
 	}
 
-	if CONFIG.MaxProxyCount <= 0 {
-		CONFIG.MaxProxyCount = *maxProxyCount
+	if setFlags["max_proxy_count"] {
+		conf.MaxProxyCount = *maxProxyCount
 	}
 
+	if setFlags["bandwidth_limit"] {
+		conf.BandwidthLimit = *bandwidthLimit
+	}
+
+	if setFlags["bandwidth_burst"] {
+		conf.BandwidthBurst = *bandwidthBurst
+	}
+
+	if setFlags["usage_file"] {
+		conf.UsageFile = *usageFile
+	}
+
+	if setFlags["proxy_url"] {
+		conf.ProxyURL = *proxyURL
+	}
+
+	if setFlags["transport_url"] {
+		conf.TransportURL = *transportURL
+	}
+
+	if setFlags["grace_period"] {
+		conf.GracePeriod = uint(*gracePeriod)
+	}
+
+	if setFlags["admin_addr"] {
+		conf.AdminAddr = *adminAddr
+	}
 }
@@ -0,0 +1,493 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"ngrok-client/ngrokc/connection"
+	"ngrok-client/ngrokc/middleware"
+	"ngrok-client/ngrokc/transport"
+	"ngrok-client/ngrokc/util"
+)
+
+// 最大的socket读缓存大小
+const MaxReadBufSize = 16 * 1024 * 1024
+
+// proxy_url 为这个值时不使用代理，也不读取环境变量
+const NoProxy = "none"
+
+// 顶层配置的会话的名字
+const DefaultSessionName = "default"
+
+// 最大的优雅关闭等待秒数
+const MaxGracePeriod = 24 * 60 * 60
+
+// FileError 配置文件读取或者解析失败
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return "config file " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError 配置验证失败，包含所有发现的问题
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// ServerAddresses() 返回所有服务器的地址，没有配置 servers 时为 server_hostname:server_port
+func (session *SessionConfiguration) ServerAddresses() []string {
+	if len(session.Servers) > 0 {
+		return session.Servers
+	}
+
+	return []string{net.JoinHostPort(session.ServerHostname, strconv.FormatUint(uint64(session.ServerPort), 10))}
+}
+
+// hasServer() 顶层是否配置了服务器
+func (conf *Configuration) hasServer() bool {
+	return conf.ServerHostname != "" || len(conf.Servers) > 0
+}
+
+// AllSessions() 返回所有会话的配置，顶层配置了服务器或者没有配置 sessions 时，第一个是名为 default 的会话
+func (conf *Configuration) AllSessions() []SessionConfiguration {
+	var sessions []SessionConfiguration
+
+	if len(conf.Sessions) == 0 || conf.hasServer() {
+		sessions = append(sessions, SessionConfiguration{
+			Name:               DefaultSessionName,
+			ServerHostname:     conf.ServerHostname,
+			ServerPort:         conf.ServerPort,
+			Servers:            conf.Servers,
+			ServerSelection:    conf.ServerSelection,
+			User:               conf.User,
+			Password:           conf.Password,
+			TrustHostRootCerts: conf.TrustHostRootCerts,
+			ProxyURL:           conf.ProxyURL,
+			TransportURL:       conf.TransportURL,
+			Tunnels:            conf.AllTunnels(),
+		})
+	}
+
+	return append(sessions, conf.Sessions...)
+}
+
+// AllTunnels() 返回所有隧道的配置，包括 http_xxx/https_xxx 配置的名为 http/https 的隧道
+func (conf *Configuration) AllTunnels() []TunnelConfiguration {
+	var tunnels []TunnelConfiguration
+
+	if conf.HttpLocalPort > 0 {
+		tunnels = append(tunnels, TunnelConfiguration{Name: util.PROTOCOL_HTTP, Protocol: util.PROTOCOL_HTTP, Hostname: conf.HttpHostname, Subdomain: conf.HttpSubdomain, HttpAuth: conf.HttpAuth, LocalPort: conf.HttpLocalPort})
+	}
+
+	if conf.HttpsLocalPort > 0 {
+		tunnels = append(tunnels, TunnelConfiguration{Name: util.PROTOCOL_HTTPS, Protocol: util.PROTOCOL_HTTPS, Hostname: conf.HttpsHostname, Subdomain: conf.HttpsSubdomain, HttpAuth: conf.HttpsAuth, LocalPort: conf.HttpsLocalPort})
+	}
+
+	return append(tunnels, conf.Tunnels...)
+}
+
+// Validate(conf *Configuration) 验证配置，有问题时返回 *ValidationError
+func Validate(conf *Configuration) error {
+	var problems []string
+
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if conf.HttpLocalPort > 65535 {
+		addProblem("http_local_port %d is not a valid port", conf.HttpLocalPort)
+	}
+
+	if conf.HttpsLocalPort > 65535 {
+		addProblem("https_local_port %d is not a valid port", conf.HttpsLocalPort)
+	}
+
+	if conf.ReadBufSize == 0 || conf.ReadBufSize > MaxReadBufSize {
+		addProblem("read_buf_size must be between 1 and %d, got %d", MaxReadBufSize, conf.ReadBufSize)
+	}
+
+	if conf.MaxProxyCount <= 0 {
+		addProblem("max_proxy_count must be greater than 0, got %d", conf.MaxProxyCount)
+	}
+
+	if conf.BandwidthBurst != 0 && conf.BandwidthLimit == 0 {
+		addProblem("bandwidth_burst requires bandwidth_limit")
+	}
+
+	if conf.GracePeriod > MaxGracePeriod {
+		addProblem("grace_period must be at most %d seconds, got %d", MaxGracePeriod, conf.GracePeriod)
+	}
+
+	if conf.AdminAddr != "" && !strings.HasPrefix(conf.AdminAddr, "unix:") {
+		if _, _, err := net.SplitHostPort(conf.AdminAddr); err != nil {
+			addProblem("admin_addr %q: %v", conf.AdminAddr, err)
+		}
+	}
+
+	sessions := conf.AllSessions()
+
+	if len(conf.Sessions) > 0 && !conf.hasServer() && len(conf.AllTunnels()) > 0 {
+		addProblem("tunnels configured without server_hostname or servers, move them into a session")
+	}
+
+	tunnelCount := 0
+	sessionNames := make(map[string]bool)
+
+	for i, session := range sessions {
+		// 只有一个会话时，错误信息不需要会话的名字
+		sessionProblem := addProblem
+		if len(conf.Sessions) > 0 {
+			name := session.Name
+			if name == "" {
+				name = "#" + strconv.Itoa(i+1)
+			}
+			sessionProblem = func(format string, args ...interface{}) {
+				addProblem("session "+name+": "+format, args...)
+			}
+		}
+
+		if session.Name == "" {
+			sessionProblem("name is required")
+		} else if sessionNames[session.Name] {
+			sessionProblem("duplicate session name")
+		}
+		sessionNames[session.Name] = true
+
+		validateSession(&session, sessionProblem)
+
+		tunnelCount += len(session.Tunnels)
+	}
+
+	// 开启管理API时可以之后再添加隧道
+	if tunnelCount == 0 && conf.AdminAddr == "" {
+		addProblem("no tunnel configured")
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+
+	return nil
+}
+
+// FileTargetRoot(target string) 从 file:///path 形式的 target 中取出本地目录的绝对路径
+func FileTargetRoot(target string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme != "file" || (u.Host != "" && u.Host != "localhost") || u.Path == "" {
+		return "", fmt.Errorf("%q is not a file:///path URL", target)
+	}
+
+	root := u.Path
+	// file:///C:/dir
+	if runtime.GOOS == "windows" && len(root) > 2 && root[0] == '/' && root[2] == ':' {
+		root = root[1:]
+	}
+
+	root = filepath.FromSlash(root)
+	if !filepath.IsAbs(root) {
+		return "", fmt.Errorf("%q is not an absolute path", target)
+	}
+
+	return filepath.Clean(root), nil
+}
+
+// validateClientAuth(auth *ClientAuthConfiguration, addProblem func(format string, args ...interface{})) 验证客户端验证访问者的配置
+func validateClientAuth(auth *ClientAuthConfiguration, addProblem func(format string, args ...interface{})) {
+	if auth.Htpasswd == "" && len(auth.BearerTokens) == 0 && auth.OAuth == nil {
+		addProblem("one of htpasswd, bearer_tokens or oauth is required")
+	}
+
+	if auth.Htpasswd != "" {
+		if _, err := middleware.LoadHtpasswd(auth.Htpasswd); err != nil {
+			addProblem("htpasswd: %v", err)
+		}
+	}
+
+	for _, token := range auth.BearerTokens {
+		if token == "" || strings.ContainsAny(token, " \t\r\n") {
+			addProblem("bearer_tokens: tokens must not be empty or contain whitespace")
+			break
+		}
+	}
+
+	oauth := auth.OAuth
+	if oauth == nil {
+		return
+	}
+
+	if oauth.ClientID == "" {
+		addProblem("oauth: client_id is required")
+	}
+
+	if oauth.Issuer == "" && (oauth.AuthURL == "" || oauth.TokenURL == "" || oauth.UserInfoURL == "") {
+		addProblem("oauth: issuer or auth_url, token_url and userinfo_url are required")
+	}
+
+	urls := []struct{ field, value string }{
+		{"issuer", oauth.Issuer}, {"auth_url", oauth.AuthURL}, {"token_url", oauth.TokenURL}, {"userinfo_url", oauth.UserInfoURL},
+	}
+	for _, u := range urls {
+		if u.value == "" {
+			continue
+		}
+
+		if parsed, err := url.Parse(u.value); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			addProblem("oauth: %s %q is not an http(s) URL", u.field, u.value)
+		}
+	}
+}
+
+// validateWebhook(webhook *WebhookConfiguration, addProblem func(format string, args ...interface{})) 验证 webhook 签名的配置
+func validateWebhook(webhook *WebhookConfiguration, addProblem func(format string, args ...interface{})) {
+	switch webhook.Provider {
+	case middleware.WEBHOOK_HMAC_SHA256:
+		if webhook.Header != "" && !validHeaderName(webhook.Header) {
+			addProblem("header %q is not a valid header name", webhook.Header)
+		}
+	case middleware.WEBHOOK_GITHUB, middleware.WEBHOOK_STRIPE, middleware.WEBHOOK_SLACK:
+		if webhook.Header != "" {
+			addProblem("header is only supported by provider %s", middleware.WEBHOOK_HMAC_SHA256)
+		}
+	default:
+		addProblem("unknown provider %q, must be %s, %s, %s or %s", webhook.Provider,
+			middleware.WEBHOOK_HMAC_SHA256, middleware.WEBHOOK_GITHUB, middleware.WEBHOOK_STRIPE, middleware.WEBHOOK_SLACK)
+	}
+
+	if webhook.Secret == "" {
+		addProblem("secret is required")
+	}
+}
+
+// validateHeaders(headers *HeadersConfiguration, addProblem func(format string, args ...interface{})) 验证请求头和响应头的改写
+func validateHeaders(headers *HeadersConfiguration, addProblem func(format string, args ...interface{})) {
+	if strings.ContainsAny(headers.Host, " \t\r\n/") {
+		addProblem("host %q is not a valid host", headers.Host)
+	}
+
+	checkNames := func(field string, names []string) {
+		for _, name := range names {
+			if !validHeaderName(name) {
+				addProblem("%s: %q is not a valid header name", field, name)
+			}
+		}
+	}
+
+	checkValues := func(field string, values map[string]string) {
+		var names []string
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		checkNames(field, names)
+
+		for _, name := range names {
+			if strings.ContainsAny(values[name], "\r\n") {
+				addProblem("%s: value of %s contains a line break", field, name)
+			}
+		}
+	}
+
+	checkValues("request_add", headers.RequestAdd)
+	checkNames("request_remove", headers.RequestRemove)
+	checkValues("response_add", headers.ResponseAdd)
+	checkNames("response_remove", headers.ResponseRemove)
+}
+
+// validHeaderName(name string) 是否是合法的HTTP头名字(RFC 7230 token)
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		if c > '~' || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validateSession(session *SessionConfiguration, addProblem func(format string, args ...interface{})) 验证一个会话的服务器和隧道配置
+func validateSession(session *SessionConfiguration, addProblem func(format string, args ...interface{})) {
+	if len(session.Servers) == 0 {
+		if session.ServerHostname == "" {
+			addProblem("server_hostname is required")
+		}
+
+		if session.ServerPort == 0 || session.ServerPort > 65535 {
+			addProblem("server_port %d is not a valid port", session.ServerPort)
+		}
+	}
+
+	seenServers := make(map[string]bool)
+	for _, server := range session.Servers {
+		host, port, err := net.SplitHostPort(server)
+		if err != nil || host == "" {
+			addProblem("servers: %q is not a host:port address", server)
+		} else if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+			addProblem("servers: %q has an invalid port", server)
+		} else if seenServers[server] {
+			addProblem("servers: duplicate server %q", server)
+		}
+		seenServers[server] = true
+	}
+
+	switch session.ServerSelection {
+	case "", connection.SERVER_SELECTION_ORDERED, connection.SERVER_SELECTION_LATENCY:
+	default:
+		addProblem("server_selection must be %s or %s, got %q", connection.SERVER_SELECTION_ORDERED, connection.SERVER_SELECTION_LATENCY, session.ServerSelection)
+	}
+
+	if session.ProxyURL != "" && session.ProxyURL != NoProxy {
+		if _, err := transport.ParseProxyURL(session.ProxyURL); err != nil {
+			addProblem("proxy_url: %v", err)
+		}
+	}
+
+	if session.TransportURL != "" {
+		if _, err := transport.ParseWebSocketURL(session.TransportURL); err != nil {
+			addProblem("transport_url: %v", err)
+		}
+	}
+
+	names := make(map[string]bool)
+	// 已经使用的 协议+域名，协议+子域名 和 TCP远程端口
+	hosts := make(map[string]string)
+
+	for _, tunnel := range session.Tunnels {
+		prefix := "tunnel " + tunnel.Name
+
+		if tunnel.Name == "" {
+			addProblem("tunnel name is required")
+			prefix = "tunnel"
+		} else if names[tunnel.Name] {
+			addProblem("%s: duplicate tunnel name", prefix)
+		}
+		names[tunnel.Name] = true
+
+		switch {
+		case tunnel.Target != "":
+			if tunnel.LocalPort != 0 {
+				addProblem("%s: local_port and target can not be used together", prefix)
+			}
+
+			if root, err := FileTargetRoot(tunnel.Target); err != nil {
+				addProblem("%s: target: %v", prefix, err)
+			} else if info, err := os.Stat(root); err != nil {
+				addProblem("%s: target: %v", prefix, err)
+			} else if !info.IsDir() {
+				addProblem("%s: target: %s is not a directory", prefix, root)
+			}
+		case tunnel.LocalPort == 0 || tunnel.LocalPort > 65535:
+			addProblem("%s: local_port %d is not a valid port", prefix, tunnel.LocalPort)
+		}
+
+		if tunnel.DirectoryListing && tunnel.Target == "" {
+			addProblem("%s: directory_listing requires target", prefix)
+		}
+
+		if tunnel.BandwidthBurst != 0 && tunnel.BandwidthLimit == 0 {
+			addProblem("%s: bandwidth_burst requires bandwidth_limit", prefix)
+		}
+
+		if _, err := connection.ParseCIDRList(tunnel.AllowCIDRs); err != nil {
+			addProblem("%s: allow_cidrs: %v", prefix, err)
+		}
+
+		if _, err := connection.ParseCIDRList(tunnel.DenyCIDRs); err != nil {
+			addProblem("%s: deny_cidrs: %v", prefix, err)
+		}
+
+		if tunnel.VisitorBurst != 0 && tunnel.VisitorRate == 0 {
+			addProblem("%s: visitor_burst requires visitor_rate", prefix)
+		}
+
+		if tunnel.DailyQuota != 0 && tunnel.MonthlyQuota != 0 && tunnel.DailyQuota > tunnel.MonthlyQuota {
+			addProblem("%s: daily_quota is greater than monthly_quota", prefix)
+		}
+
+		var keys []string
+
+		switch tunnel.Protocol {
+		case util.PROTOCOL_HTTP, util.PROTOCOL_HTTPS:
+			if tunnel.RemotePort != 0 {
+				addProblem("%s: remote_port is only supported by tcp tunnels", prefix)
+			}
+
+			if tunnel.HttpAuth != "" && !strings.Contains(tunnel.HttpAuth, ":") {
+				addProblem("%s: auth must be in the form user:password", prefix)
+			}
+
+			if tunnel.Hostname != "" {
+				keys = append(keys, tunnel.Protocol+" hostname "+tunnel.Hostname)
+			}
+
+			if tunnel.Subdomain != "" {
+				keys = append(keys, tunnel.Protocol+" subdomain "+tunnel.Subdomain)
+			}
+
+			if tunnel.ClientAuth != nil {
+				validateClientAuth(tunnel.ClientAuth, func(format string, args ...interface{}) {
+					addProblem("%s: client_auth: "+format, append([]interface{}{prefix}, args...)...)
+				})
+			}
+
+			if tunnel.Webhook != nil {
+				validateWebhook(tunnel.Webhook, func(format string, args ...interface{}) {
+					addProblem("%s: webhook: "+format, append([]interface{}{prefix}, args...)...)
+				})
+			}
+
+			if tunnel.Headers != nil {
+				validateHeaders(tunnel.Headers, func(format string, args ...interface{}) {
+					addProblem("%s: headers: "+format, append([]interface{}{prefix}, args...)...)
+				})
+			}
+		case util.PROTOCOL_TCP:
+			if tunnel.Hostname != "" || tunnel.Subdomain != "" || tunnel.HttpAuth != "" || tunnel.ClientAuth != nil || tunnel.Webhook != nil || tunnel.Headers != nil {
+				addProblem("%s: hostname, subdomain, auth, client_auth, webhook and headers are only supported by http/https tunnels", prefix)
+			}
+
+			if tunnel.Target != "" {
+				addProblem("%s: target is only supported by http/https tunnels", prefix)
+			}
+
+			if tunnel.RemotePort != 0 {
+				keys = append(keys, "tcp remote_port "+strconv.Itoa(int(tunnel.RemotePort)))
+			}
+		default:
+			addProblem("%s: unknown proto %q, must be http, https or tcp", prefix, tunnel.Protocol)
+		}
+
+		for _, key := range keys {
+			if other, ok := hosts[key]; ok {
+				addProblem("%s: %s conflicts with tunnel %s", prefix, key, other)
+			}
+			hosts[key] = tunnel.Name
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// yamlConfiguration 原版 ngrok 1.x 客户端的 ngrok.yml 配置
+type yamlConfiguration struct {
+	// 服务器地址 host:port
+	ServerAddr         string `yaml:"server_addr"`
+	TrustHostRootCerts bool   `yaml:"trust_host_root_certs"`
+	AuthToken          string `yaml:"auth_token"`
+
+	// 连接服务器使用的代理
+	HttpProxy string `yaml:"http_proxy"`
+
+	// 以下配置不支持，只做提示
+	InspectAddr string `yaml:"inspect_addr"`
+
+	Tunnels map[string]*yamlTunnelConfiguration `yaml:"tunnels"`
+}
+
+// yamlTunnelConfiguration ngrok.yml 中的一条隧道
+type yamlTunnelConfiguration struct {
+	Subdomain string `yaml:"subdomain"`
+	Hostname  string `yaml:"hostname"`
+	// 协议到本地地址的映射，例如 http: 8080，地址可以是端口或者 host:port
+	Protocols  map[string]string `yaml:"proto"`
+	HttpAuth   string            `yaml:"auth"`
+	RemotePort uint16            `yaml:"remote_port"`
+}
+
+// IsYamlFile(filepath string) 根据扩展名判断是否是YAML配置文件
+func IsYamlFile(filepath string) bool {
+	return strings.HasSuffix(filepath, ".yml") || strings.HasSuffix(filepath, ".yaml")
+}
+
+// parseYamlConfig(content []byte, conf *Configuration) 解析 ngrok 1.x 格式的YAML配置
+// auth_token 和原版客户端一样作为 user 发送给服务器
+// 一条隧道配置了多个协议时，会拆分成多条隧道，名字为 "名字-协议"
+func parseYamlConfig(content []byte, conf *Configuration) error {
+	var yamlConf yamlConfiguration
+
+	// 未知的配置项和重复的key都会返回错误
+	if err := yaml.UnmarshalStrict(content, &yamlConf); err != nil {
+		return err
+	}
+
+	if yamlConf.ServerAddr != "" {
+		host, port, err := splitHostPort(yamlConf.ServerAddr)
+		if err != nil {
+			return fmt.Errorf("server_addr %q: %v", yamlConf.ServerAddr, err)
+		}
+
+		conf.ServerHostname = host
+		conf.ServerPort = port
+	}
+
+	conf.TrustHostRootCerts = yamlConf.TrustHostRootCerts
+
+	if yamlConf.AuthToken != "" {
+		conf.User = yamlConf.AuthToken
+	}
+
+	if yamlConf.HttpProxy != "" {
+		conf.ProxyURL = yamlConf.HttpProxy
+	}
+
+	if yamlConf.InspectAddr != "" {
+		fmt.Println("config file: inspect_addr is not supported, ignored")
+	}
+
+	// map没有顺序，按名字排序保证每次的隧道顺序一致
+	names := make([]string, 0, len(yamlConf.Tunnels))
+	for name := range yamlConf.Tunnels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		yamlTunnel := yamlConf.Tunnels[name]
+
+		if yamlTunnel == nil || len(yamlTunnel.Protocols) == 0 {
+			return fmt.Errorf("tunnel %s: no proto", name)
+		}
+
+		protocols := make([]string, 0, len(yamlTunnel.Protocols))
+		for protocol := range yamlTunnel.Protocols {
+			protocols = append(protocols, protocol)
+		}
+		sort.Strings(protocols)
+
+		for _, protocol := range protocols {
+			tunnel := TunnelConfiguration{
+				Name:       name,
+				Protocol:   protocol,
+				Hostname:   yamlTunnel.Hostname,
+				Subdomain:  yamlTunnel.Subdomain,
+				HttpAuth:   yamlTunnel.HttpAuth,
+				RemotePort: yamlTunnel.RemotePort,
+			}
+
+			// http: file:///path 提供本地目录中的文件
+			if addr := yamlTunnel.Protocols[protocol]; strings.HasPrefix(addr, "file://") {
+				tunnel.Target = addr
+			} else {
+				port, err := localPort(addr)
+				if err != nil {
+					return fmt.Errorf("tunnel %s: proto %s: %v", name, protocol, err)
+				}
+				tunnel.LocalPort = port
+			}
+
+			if len(protocols) > 1 {
+				tunnel.Name = name + "-" + protocol
+			}
+
+			conf.Tunnels = append(conf.Tunnels, tunnel)
+		}
+	}
+
+	return nil
+}
+
+// splitHostPort(addr string) 拆分 host:port
+func splitHostPort(addr string) (string, uint, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, errors.New("invalid port " + portStr)
+	}
+
+	return host, uint(port), nil
+}
+
+// localPort(addr string) 从本地地址中取出端口，地址可以是 "8080" 或者 "127.0.0.1:8080"
+// 只支持代理本机的服务
+func localPort(addr string) (uint, error) {
+	if !strings.Contains(addr, ":") {
+		port, err := strconv.ParseUint(addr, 10, 16)
+		if err != nil || port == 0 {
+			return 0, errors.New("invalid local port " + addr)
+		}
+
+		return uint(port), nil
+	}
+
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return 0, errors.New("only local address is supported, got " + addr)
+	}
+
+	if port == 0 {
+		return 0, errors.New("invalid local port in " + addr)
+	}
+
+	return port, nil
+}
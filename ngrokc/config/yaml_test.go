@@ -0,0 +1,99 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const ngrokYml = `
+server_addr: ngrok.example.com:4443
+trust_host_root_certs: true
+auth_token: secret-token
+http_proxy: http://proxy.example.com:3128
+inspect_addr: 127.0.0.1:4040
+tunnels:
+  webapp:
+    subdomain: demo
+    auth: "user:pass"
+    proto:
+      http: 8080
+      https: "127.0.0.1:8443"
+  ssh:
+    remote_port: 2222
+    proto:
+      tcp: localhost:22
+  site:
+    subdomain: docs
+    proto:
+      http: file:///srv/site
+`
+
+func TestParseYamlConfig(t *testing.T) {
+	conf := &Configuration{}
+
+	if err := parseYamlConfig([]byte(ngrokYml), conf); err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.ServerHostname != "ngrok.example.com" || conf.ServerPort != 4443 || !conf.TrustHostRootCerts || conf.User != "secret-token" || conf.ProxyURL != "http://proxy.example.com:3128" {
+		t.Fatalf("unexpected server config: %+v", conf)
+	}
+
+	want := []TunnelConfiguration{
+		{Name: "site", Protocol: "http", Subdomain: "docs", Target: "file:///srv/site"},
+		{Name: "ssh", Protocol: "tcp", RemotePort: 2222, LocalPort: 22},
+		{Name: "webapp-http", Protocol: "http", Subdomain: "demo", HttpAuth: "user:pass", LocalPort: 8080},
+		{Name: "webapp-https", Protocol: "https", Subdomain: "demo", HttpAuth: "user:pass", LocalPort: 8443},
+	}
+
+	if !reflect.DeepEqual(conf.Tunnels, want) {
+		t.Fatalf("tunnels = %+v, want %+v", conf.Tunnels, want)
+	}
+}
+
+func TestParseYamlConfigErrors(t *testing.T) {
+	for _, content := range []string{
+		"server_addr: ngrok.example.com",
+		"server_addr: ngrok.example.com:99999",
+		"tunnels:\n  web:\n    subdomain: demo",
+		"tunnels:\n  web:\n    proto:\n      http: 10.0.0.2:80",
+		"tunnels:\n  web:\n    proto:\n      http: abc",
+		"tunnels: [",
+		"server_adr: ngrok.example.com:4443",
+		"tunnels:\n  web:\n    subdomian: demo\n    proto:\n      http: 80",
+	} {
+		if err := parseYamlConfig([]byte(content), &Configuration{}); err == nil {
+			t.Errorf("parseYamlConfig(%q) succeeded", content)
+		}
+	}
+}
+
+func TestParseConfigFileByExtension(t *testing.T) {
+	dir := t.TempDir()
+
+	yamlFile := filepath.Join(dir, "ngrok.yml")
+	os.WriteFile(yamlFile, []byte(ngrokYml), 0600)
+
+	jsonFile := filepath.Join(dir, "config.conf")
+	os.WriteFile(jsonFile, []byte(`{"server_hostname": "json.example.com", "tunnels": [{"name": "web", "proto": "http", "local_port": 80}]}`), 0600)
+
+	conf := &Configuration{}
+	if err := ParseConfigFile(yamlFile, conf); err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.ServerHostname != "ngrok.example.com" || len(conf.Tunnels) != 4 {
+		t.Fatalf("yaml config = %+v", conf)
+	}
+
+	conf = &Configuration{}
+	if err := ParseConfigFile(jsonFile, conf); err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.ServerHostname != "json.example.com" || len(conf.Tunnels) != 1 || conf.Tunnels[0].LocalPort != 80 {
+		t.Fatalf("json config = %+v", conf)
+	}
+}
@@ -0,0 +1,68 @@
+package connection
+
+import (
+	"fmt"
+	"net/netip"
+	errcode "ngrok-client/ngrokc/err"
+	"strings"
+)
+
+// ParseCIDRList(cidrs []string) 解析IP访问控制列表，每一项是 CIDR(10.0.0.0/8) 或者单个IP
+func ParseCIDRList(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not an IP or CIDR", cidr)
+			}
+
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP or CIDR", cidr)
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// containsAddr(prefixes []netip.Prefix, addr netip.Addr) addr是否在列表中
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkClientAddr(clientAddr string) 按隧道的 DenyCIDRs 和 AllowCIDRs 检查访问者的地址(ip:端口)
+// 在 DenyCIDRs 中的地址被拒绝；AllowCIDRs 不为空时，只允许其中的地址；没有配置时都允许
+func (tunnel *Tunnel) checkClientAddr(clientAddr string) error {
+	if len(tunnel.AllowCIDRs) == 0 && len(tunnel.DenyCIDRs) == 0 {
+		return nil
+	}
+
+	addrPort, err := netip.ParseAddrPort(clientAddr)
+	if err != nil {
+		// 配置了访问控制时，不能识别的地址都拒绝
+		return &errcode.Error{Kind: errcode.ErrClientNotAllowed, Msg: clientAddr, Err: err}
+	}
+
+	addr := addrPort.Addr().Unmap()
+
+	if containsAddr(tunnel.DenyCIDRs, addr) || (len(tunnel.AllowCIDRs) > 0 && !containsAddr(tunnel.AllowCIDRs, addr)) {
+		return &errcode.Error{Kind: errcode.ErrClientNotAllowed, Msg: addr.String()}
+	}
+
+	return nil
+}
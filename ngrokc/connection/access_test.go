@@ -0,0 +1,76 @@
+package connection
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+
+	errcode "ngrok-client/ngrokc/err"
+)
+
+func mustParseCIDRList(t *testing.T, list ...string) []netip.Prefix {
+	t.Helper()
+
+	prefixes, err := ParseCIDRList(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return prefixes
+}
+
+func TestParseCIDRList(t *testing.T) {
+	var got []string
+	for _, prefix := range mustParseCIDRList(t, "10.1.2.3/8", "127.0.0.1", "::ffff:192.168.1.1", "2001:db8::/32") {
+		got = append(got, prefix.String())
+	}
+
+	// 单个IP为 /32 或者 /128，IPv4-mapped 地址按 IPv4 处理
+	if want := "10.0.0.0/8,127.0.0.1/32,192.168.1.1/32,2001:db8::/32"; strings.Join(got, ",") != want {
+		t.Fatalf("ParseCIDRList = %v, want %s", got, want)
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "example.com", "10.0.0"} {
+		if _, err := ParseCIDRList([]string{invalid}); err == nil {
+			t.Fatalf("ParseCIDRList(%q) accepted an invalid entry", invalid)
+		}
+	}
+}
+
+func TestCheckClientAddr(t *testing.T) {
+	office := &Tunnel{AllowCIDRs: mustParseCIDRList(t, "10.0.0.0/8", "192.168.1.1")}
+	blocked := &Tunnel{DenyCIDRs: mustParseCIDRList(t, "127.0.0.0/8")}
+	both := &Tunnel{AllowCIDRs: mustParseCIDRList(t, "10.0.0.0/8"), DenyCIDRs: mustParseCIDRList(t, "10.6.6.0/24")}
+
+	tests := []struct {
+		tunnel     *Tunnel
+		clientAddr string
+		allowed    bool
+	}{
+		{&Tunnel{}, "203.0.113.1:1", true},
+		{&Tunnel{}, "not an address", true},
+		{office, "10.1.2.3:50000", true},
+		{office, "192.168.1.1:443", true},
+		{office, "192.168.1.2:443", false},
+		{office, "[::ffff:10.0.0.1]:80", true},
+		{office, "not an address", false},
+		{blocked, "127.0.0.1:1", false},
+		{blocked, "203.0.113.1:1", true},
+		// 先检查 DenyCIDRs
+		{both, "10.6.6.6:1", false},
+		{both, "10.7.7.7:1", true},
+	}
+
+	for _, test := range tests {
+		err := test.tunnel.checkClientAddr(test.clientAddr)
+
+		if test.allowed && err != nil {
+			t.Fatalf("checkClientAddr(%q) = %v, want allowed", test.clientAddr, err)
+		}
+
+		if !test.allowed && !errors.Is(err, errcode.ErrClientNotAllowed) {
+			t.Fatalf("checkClientAddr(%q) = %v, want ErrClientNotAllowed", test.clientAddr, err)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package connection
+
+import (
+	"ngrok-client/ngrokc/util"
+	"time"
+)
+
+// 代理数据传输的方向
+const (
+	// 访问者发送给本地服务的数据
+	DIRECTION_INBOUND = "inbound"
+	// 本地服务发送给访问者的数据
+	DIRECTION_OUTBOUND = "outbound"
+)
+
+// BandwidthLimit 带宽限制，两个方向各有一个令牌桶，可以被多条代理连接(一条隧道的或者所有隧道的)共用
+// nil 的 BandwidthLimit 不限制
+type BandwidthLimit struct {
+	inbound  *util.TokenBucket
+	outbound *util.TokenBucket
+}
+
+// NewBandwidthLimit(rate, burst uint64) 每个方向每秒最多 rate 字节，最多可以突发 burst 字节(为0时等于rate)
+// rate 为0时返回nil，不限制
+func NewBandwidthLimit(rate, burst uint64) *BandwidthLimit {
+	return newBandwidthLimit(rate, burst, time.Now)
+}
+
+// newBandwidthLimit(rate, burst uint64, now func() time.Time) 使用 now 获取当前时间的带宽限制
+func newBandwidthLimit(rate, burst uint64, now func() time.Time) *BandwidthLimit {
+	if rate == 0 {
+		return nil
+	}
+
+	return &BandwidthLimit{inbound: util.NewTokenBucketClock(rate, burst, now), outbound: util.NewTokenBucketClock(rate, burst, now)}
+}
+
+// reserve(direction string, n int) 在direction方向上传输n字节，返回需要等待的时间
+func (limit *BandwidthLimit) reserve(direction string, n int) time.Duration {
+	if limit == nil {
+		return 0
+	}
+
+	if direction == DIRECTION_INBOUND {
+		return limit.inbound.Reserve(n)
+	}
+
+	return limit.outbound.Reserve(n)
+}
@@ -0,0 +1,119 @@
+package connection
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// throttleConn() 使用假时钟的代理连接，等待时只让时钟前进，记录每次等待的时间
+func throttleConn(tunnel, global *BandwidthLimit, now *time.Time) (*ProxyConnection, *[]time.Duration) {
+	var sleeps []time.Duration
+
+	conn := &ProxyConnection{tunnelName: "web", bandwidth: tunnel, controlConn: &ControlConnection{Bandwidth: global}}
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+	conn.sleep = func(ctx context.Context, d time.Duration) bool {
+		sleeps = append(sleeps, d)
+		*now = now.Add(d)
+		return ctx.Err() == nil
+	}
+
+	return conn, &sleeps
+}
+
+func TestThrottle(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+
+	// 隧道每秒64KB，可以突发16KB；全局每秒1MB
+	conn, sleeps := throttleConn(newBandwidthLimit(64*1024, 16*1024, clock), newBandwidthLimit(1<<20, 0, clock), &now)
+
+	type throttled struct {
+		direction string
+		delay     time.Duration
+	}
+	var events []throttled
+	conn.controlConn.Events.OnThrottle = func(tunnel, direction string, delay time.Duration) {
+		if tunnel != "web" {
+			t.Fatalf("OnThrottle tunnel = %s", tunnel)
+		}
+		events = append(events, throttled{direction, delay})
+	}
+
+	// 两个方向各传输64KB，每次16KB：突发之后的48KB需要0.75秒
+	start := now
+	for _, direction := range []string{DIRECTION_INBOUND, DIRECTION_OUTBOUND} {
+		for i := 0; i < 4; i++ {
+			if !conn.throttle(direction, 16*1024) {
+				t.Fatalf("throttle %s returned false", direction)
+			}
+		}
+	}
+
+	if len(*sleeps) != 6 || now.Sub(start) != 1500*time.Millisecond {
+		t.Fatalf("sleeps = %v, total %s, want 6 sleeps and 1.5s", *sleeps, now.Sub(start))
+	}
+
+	// 两个方向的令牌桶互不影响
+	inbound, outbound := 0, 0
+	for _, event := range events {
+		switch event.direction {
+		case DIRECTION_INBOUND:
+			inbound++
+		case DIRECTION_OUTBOUND:
+			outbound++
+		}
+		if event.delay != 250*time.Millisecond {
+			t.Fatalf("OnThrottle delay = %s, want 250ms", event.delay)
+		}
+	}
+	if inbound != 3 || outbound != 3 {
+		t.Fatalf("throttled %d inbound and %d outbound, want 3 and 3", inbound, outbound)
+	}
+}
+
+func TestThrottleGlobalLimit(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+
+	// 没有隧道的限制，只受全局每秒1000字节的限制
+	conn, sleeps := throttleConn(nil, newBandwidthLimit(1000, 0, clock), &now)
+
+	if !conn.throttle(DIRECTION_OUTBOUND, 1000) || len(*sleeps) != 0 {
+		t.Fatalf("within global burst: sleeps = %v", *sleeps)
+	}
+
+	if !conn.throttle(DIRECTION_OUTBOUND, 500) || len(*sleeps) != 1 || (*sleeps)[0] != 500*time.Millisecond {
+		t.Fatalf("over global burst: sleeps = %v, want [500ms]", *sleeps)
+	}
+
+	// 两个限制都有时等待较长的一个
+	tunnel := newBandwidthLimit(100, 0, clock)
+	conn, sleeps = throttleConn(tunnel, newBandwidthLimit(1000, 0, clock), &now)
+	conn.throttle(DIRECTION_INBOUND, 100)
+	conn.throttle(DIRECTION_INBOUND, 100)
+	if len(*sleeps) != 1 || (*sleeps)[0] != time.Second {
+		t.Fatalf("tunnel and global limit: sleeps = %v, want [1s]", *sleeps)
+	}
+
+	// 没有任何限制
+	conn, sleeps = throttleConn(nil, nil, &now)
+	if !conn.throttle(DIRECTION_INBOUND, 1<<30) || len(*sleeps) != 0 {
+		t.Fatalf("unlimited: sleeps = %v", *sleeps)
+	}
+}
+
+func TestThrottleClosed(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	conn, _ := throttleConn(newBandwidthLimit(100, 0, func() time.Time { return now }), nil, &now)
+	conn.Close()
+
+	// 不需要等待时直接传输，需要等待时连接已经关闭
+	if !conn.throttle(DIRECTION_INBOUND, 100) {
+		t.Fatal("throttle within burst on a closed connection = false")
+	}
+
+	if conn.throttle(DIRECTION_INBOUND, 100) {
+		t.Fatal("throttle on a closed connection = true")
+	}
+}
@@ -1,59 +1,109 @@
 package connection
 
 import (
-	"bytes"
+	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
-	"ngrok-client/ngrokc/config"
 	errcode "ngrok-client/ngrokc/err"
+	"ngrok-client/ngrokc/transport"
 	"ngrok-client/ngrokc/util"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
+)
+
+const (
+	// 默认的socket读缓存大小
+	DefaultReadBufSize = 2048
+	// 默认的最大proxy连接数
+	DefaultMaxProxyCount = 10
 )
 
 type ControlConnection struct {
 	ServerDomain string // 域名或者IP
 	ServerPort   uint
-	User         string
-	Password     string
-	Arch         string
-	ClientId     string
-
-	// 分配的HTTP信息
-	HTTPHostname  string
-	HTTPSubdomain string
-	HTTPAuth      string
-	HTTPLocalPort uint
-	// 服务器返回的HTTP URL
-	HTTPUrl string
-
-	// 分配的HTTPS信息
-	HTTPSHostname  string
-	HTTPSSubdomain string
-	HTTPSAuth      string
-	HTTPSLocalPort uint
-	// 服务器返回的HTTPS URL
-	HTTPSUrl string
-
-	// 是否在断开控制连接后，退出
+	// 多个服务器的地址 host:port，连接或者验证失败时尝试下一个；为空时只使用 ServerDomain:ServerPort
+	Servers []string
+	// 选择服务器的方式 SERVER_SELECTION_ORDERED(默认)/SERVER_SELECTION_LATENCY
+	ServerSelection string
+	User            string
+	Password        string
+	Arch            string
+	ClientId        string
+
+	// 隧道，以隧道名字为key
+	tunnels map[string]*Tunnel
+	// 修改配置后正在重新请求的隧道，以隧道名字为key，请求成功后替换 tunnels 中的旧隧道，失败时保留旧隧道
+	updating map[string]*Tunnel
+	// 读写隧道、ClientId和serverAddr的读写锁
+	tunnelsRWMutex sync.RWMutex
+
+	// 当前控制连接所在的服务器地址，代理连接也连接这个服务器
+	serverAddr string
+
+	// 正在代理中的连接
+	proxies map[*ProxyConnection]bool
+	// 读写proxies的锁
+	proxiesMutex sync.Mutex
+
+	// 连接服务器(控制连接和代理连接)的方式，为nil时使用TLS连接
+	Dialer transport.Dialer
+	// 没有设置Dialer时，TLS连接使用的配置，为nil时不验证服务器证书
+	TLSConfig *tls.Config
+	// 没有设置Dialer时，TLS连接经过的HTTP CONNECT/SOCKS5代理，为nil时直接连接
+	Proxy transport.ProxyFunc
+
+	// 是否在断开控制连接后，退出；为false时，有多个服务器时切换到其他服务器
 	ExitWithDisconnect bool
 
+	// socket读缓存大小
+	ReadBufSize uint
+	// 最大proxy连接数
+	MaxProxyCount int64
+
+	// 所有隧道共用的带宽限制，可以被多个控制连接共用，为nil时不限制
+	Bandwidth *BandwidthLimit
+
+	// 检查是否接受代理连接，为nil时都接受
+	Admission ProxyAdmission
+
+	// 代理连接开始代理时调用，用于统计连接数，为nil时不调用
+	Accept ProxyAccept
+
+	// 代理连接传输数据时调用，用于统计正在进行的连接的流量，为nil时不调用
+	Transfer ProxyTransfer
+
+	// 事件回调
+	Events Events
+
 	// 信号量，控制最大proxy连接数
 	semaphore util.Semaphore
 
 	// 是否已经初始化
 	initialized bool
 
-	// 标记是否关闭链接, true:关闭， false:不关闭
-	isClose bool
-	// 连接中其他goroutine的关闭信号
-	closed chan bool
-	// 设置读取IsClose标识的读写锁
-	closeRWMutex sync.RWMutex
-
-	// 控制的tcp连接
-	conn net.Conn
+	// 连接的生命周期，关闭连接时取消，所有goroutine通过它得知要退出
+	ctx    context.Context
+	cancel context.CancelFunc
+	// 代理连接的生命周期，不优雅关闭时和ctx一起取消，优雅关闭时等代理连接结束或者超时后取消
+	proxyCtx    context.Context
+	proxyCancel context.CancelFunc
+	// 是否正在优雅关闭
+	draining atomic.Bool
+
+	// 保证只关闭一次
+	closeOnce sync.Once
+	// 等待连接创建的所有goroutine(包括代理连接)退出
+	wg sync.WaitGroup
+
+	// 导致连接关闭的错误，主动调用Close()时为nil
+	closeErr error
+	// 读写closeErr的锁
+	closeMutex sync.Mutex
 
 	// 写缓冲通道
 	writeChan chan []byte
@@ -68,334 +118,727 @@ func (conn *ControlConnection) Init(domain string, port uint, user, password str
 
 	conn.ExitWithDisconnect = false
 
+	conn.tunnels = make(map[string]*Tunnel)
+	conn.updating = make(map[string]*Tunnel)
+	conn.proxies = make(map[*ProxyConnection]bool)
+
+	conn.ReadBufSize = DefaultReadBufSize
+	conn.MaxProxyCount = DefaultMaxProxyCount
+
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+	conn.proxyCtx, conn.proxyCancel = context.WithCancel(context.Background())
+
+	// 初始化写数据的缓冲通道，通道不会被关闭，发送时需要同时等待ctx
+	conn.writeChan = make(chan []byte, 10)
+
 	conn.initialized = true
 
-	// 初始化信号量的大小
-	conn.semaphore.Init(config.CONFIG.MaxProxyCount)
+}
+
+// SetProxyConfig() 设置socket读缓存大小和最大proxy连接数，为0时使用默认值，需要在Service()之前调用
+func (conn *ControlConnection) SetProxyConfig(readBufSize uint, maxProxyCount int64) {
+	if readBufSize > 0 {
+		conn.ReadBufSize = readBufSize
+	}
 
+	if maxProxyCount > 0 {
+		conn.MaxProxyCount = maxProxyCount
+	}
 }
 
-// SetHTTPConfig() 设置HTTP代理的配置
+// SetHTTPConfig() 设置HTTP代理的配置，port为0时表示不需要代理HTTP
 func (conn *ControlConnection) SetHTTPConfig(hostname, subdomain, auth string, port uint) {
-	conn.HTTPHostname = hostname
-	conn.HTTPSubdomain = subdomain
-	conn.HTTPAuth = auth
-	conn.HTTPLocalPort = port
+	if port == 0 {
+		return
+	}
+
+	tunnel := Tunnel{Name: util.PROTOCOL_HTTP, Protocol: util.PROTOCOL_HTTP, Hostname: hostname, Subdomain: subdomain, HttpAuth: auth, LocalPort: port}
+
+	if err := conn.AddTunnel(tunnel); err != nil {
+		fmt.Println("SetHTTPConfig():" + err.Error())
+	}
 }
 
-// SetHTTPSConfig() 设置HTTPS代理的配置
+// SetHTTPSConfig() 设置HTTPS代理的配置，port为0时表示不需要代理HTTPS
 func (conn *ControlConnection) SetHTTPSConfig(hostname, subdomain, auth string, port uint) {
-	conn.HTTPSHostname = hostname
-	conn.HTTPSSubdomain = subdomain
-	conn.HTTPSAuth = auth
-	conn.HTTPSLocalPort = port
+	if port == 0 {
+		return
+	}
+
+	tunnel := Tunnel{Name: util.PROTOCOL_HTTPS, Protocol: util.PROTOCOL_HTTPS, Hostname: hostname, Subdomain: subdomain, HttpAuth: auth, LocalPort: port}
+
+	if err := conn.AddTunnel(tunnel); err != nil {
+		fmt.Println("SetHTTPSConfig():" + err.Error())
+	}
 }
 
-// Service() 开始连接，如果失败返回error，该函数阻塞
-func (conn *ControlConnection) Service() error {
-	if !conn.initialized {
-		panic("Should Init first!")
+// AddTunnel() 添加一条隧道
+// 如果控制连接已经验证成功，会马上发送 ReqTunnel 请求，否则在验证成功后再请求
+func (conn *ControlConnection) AddTunnel(tunnel Tunnel) error {
+	if err := prepareTunnel(&tunnel); err != nil {
+		return err
 	}
 
-	err := conn.connect()
+	conn.tunnelsRWMutex.Lock()
 
-	if err != nil {
+	if _, ok := conn.tunnels[tunnel.Name]; ok {
+		conn.tunnelsRWMutex.Unlock()
+		return fmt.Errorf("tunnel %s already exists", tunnel.Name)
+	}
+
+	authed := conn.ClientId != ""
+	tunnel.dynamic = authed
+	conn.tunnels[tunnel.Name] = &tunnel
+
+	conn.tunnelsRWMutex.Unlock()
+
+	if authed {
+		return conn.reqTunnel(tunnel)
+	}
+
+	return nil
+}
+
+// prepareTunnel(tunnel *Tunnel) 检查隧道的配置，生成新的ReqId和限制
+func prepareTunnel(tunnel *Tunnel) error {
+	if tunnel.Name == "" {
+		return errors.New("tunnel name is empty")
+	}
+
+	switch tunnel.Protocol {
+	case util.PROTOCOL_HTTP, util.PROTOCOL_HTTPS, util.PROTOCOL_TCP:
+	default:
+		return fmt.Errorf("tunnel %s: unsupported protocol %q", tunnel.Name, tunnel.Protocol)
+	}
+
+	if err := tunnel.checkLocal(); err != nil {
 		return err
 	}
 
-	// 初始化写数据的缓冲通道
-	conn.writeChan = make(chan []byte, 10)
+	tunnel.Url = ""
+	tunnel.ReqId = util.RandomId()
+	tunnel.bandwidth = NewBandwidthLimit(tunnel.BandwidthLimit, tunnel.BandwidthBurst)
+	tunnel.visitors = newVisitorLimiter(tunnel.VisitorRate, tunnel.VisitorBurst, tunnel.VisitorMaxConnections)
 
-	// 为发送数据建立单独的goroutine， 通过writeChan缓冲通道交给write函数发送数据
-	go conn.write()
+	return nil
+}
+
+// RemoveTunnel() 删除一条隧道
+// 协议中没有关闭隧道的请求，服务端仍然保留这个URL直到控制连接断开，
+// 之后到达这条隧道的代理连接会因为找不到URL而被关闭
+func (conn *ControlConnection) RemoveTunnel(name string) error {
+	conn.tunnelsRWMutex.Lock()
+	defer conn.tunnelsRWMutex.Unlock()
 
-	auth := util.Auth{Version: "1.0.0", MmVersion: "1", User: conn.User, Password: conn.Password, OS: "!", Arch: "1", ClientId: ""}
+	tunnel, ok := conn.tunnels[name]
 
-	content, err := util.PayloadStructToBytes(auth, util.AUTH_TYPE)
+	if !ok {
+		return fmt.Errorf("tunnel %s not found", name)
+	}
 
-	conn.writeChan <- content
+	delete(conn.tunnels, name)
+	delete(conn.updating, name)
 
-	conn.readHandler()
+	if tunnel.Listener != nil {
+		tunnel.Listener.close()
+	}
 
-	return err
+	return nil
 }
 
-// connect() 创建链接，并将net.Conn 赋值给对象的conn
-func (connection *ControlConnection) connect() error {
+// UpdateTunnel(tunnel Tunnel) 修改一条已有隧道的配置
+// 只有本地端口、本地目录、HTTP处理、带宽限制、IP访问控制或者访问者限制改变时直接修改，正在进行的代理连接不受影响，之后的代理连接使用新的配置；
+// 其他配置改变时重新请求：服务端在控制连接断开之前不会释放旧隧道的URL，所以旧隧道已经建立时先请求新的隧道，
+// 成功后再替换旧的隧道，请求失败(例如同一个URL已经被注册)时保留旧的隧道并通过 Events.OnTunnelError 通知
+func (conn *ControlConnection) UpdateTunnel(tunnel Tunnel) error {
+	conn.tunnelsRWMutex.Lock()
 
-	address := connection.ServerDomain + ":" + strconv.FormatUint(uint64(connection.ServerPort), 10)
+	current, ok := conn.tunnels[tunnel.Name]
 
-	// 无视ssl证书，仅用于测试
-	config := &tls.Config{InsecureSkipVerify: true}
+	if !ok {
+		conn.tunnelsRWMutex.Unlock()
+		return fmt.Errorf("tunnel %s not found", tunnel.Name)
+	}
 
-	conn, err := tls.Dial("tcp", address, config)
+	if current.Listener != nil || tunnel.Listener != nil {
+		conn.tunnelsRWMutex.Unlock()
+		return fmt.Errorf("tunnel %s: can not update a listener tunnel", tunnel.Name)
+	}
 
-	if err == nil {
-		connection.conn = conn
+	if current.sameRequest(tunnel) {
+		if err := tunnel.checkLocal(); err != nil {
+			conn.tunnelsRWMutex.Unlock()
+			return err
+		}
+
+		current.LocalPort = tunnel.LocalPort
+		current.Root = tunnel.Root
+		current.Handler = tunnel.Handler
+
+		if current.BandwidthLimit != tunnel.BandwidthLimit || current.BandwidthBurst != tunnel.BandwidthBurst {
+			current.BandwidthLimit = tunnel.BandwidthLimit
+			current.BandwidthBurst = tunnel.BandwidthBurst
+			current.bandwidth = NewBandwidthLimit(tunnel.BandwidthLimit, tunnel.BandwidthBurst)
+		}
+
+		current.AllowCIDRs = tunnel.AllowCIDRs
+		current.DenyCIDRs = tunnel.DenyCIDRs
+
+		if current.VisitorRate != tunnel.VisitorRate || current.VisitorBurst != tunnel.VisitorBurst || current.VisitorMaxConnections != tunnel.VisitorMaxConnections {
+			current.VisitorRate = tunnel.VisitorRate
+			current.VisitorBurst = tunnel.VisitorBurst
+			current.VisitorMaxConnections = tunnel.VisitorMaxConnections
+			current.visitors = newVisitorLimiter(tunnel.VisitorRate, tunnel.VisitorBurst, tunnel.VisitorMaxConnections)
+		}
+
+		conn.tunnelsRWMutex.Unlock()
+		return nil
 	}
 
-	return err
+	// 旧隧道还没有建立时没有要保留的URL，直接替换
+	if current.Url == "" || conn.ClientId == "" {
+		conn.tunnelsRWMutex.Unlock()
+
+		if err := conn.RemoveTunnel(tunnel.Name); err != nil {
+			return err
+		}
+
+		return conn.AddTunnel(tunnel)
+	}
+
+	if err := prepareTunnel(&tunnel); err != nil {
+		conn.tunnelsRWMutex.Unlock()
+		return err
+	}
+
+	// 之前还在请求中的修改被覆盖，它的响应不会再匹配到隧道
+	tunnel.dynamic = true
+	conn.updating[tunnel.Name] = &tunnel
+
+	conn.tunnelsRWMutex.Unlock()
+
+	return conn.reqTunnel(tunnel)
 }
 
-// write() 链接写函数，通过 writeChan 缓冲通道接收要发送给服务器的数据，再逐一发送
-// 目前设计为执行在一个单独的goroutine中
-func (conn *ControlConnection) write() {
+// Tunnels() 获取所有隧道的副本，按名字排序
+func (conn *ControlConnection) Tunnels() []Tunnel {
+	conn.tunnelsRWMutex.RLock()
+	defer conn.tunnelsRWMutex.RUnlock()
 
-	for conn.IsClose() == false {
+	tunnels := make([]Tunnel, 0, len(conn.tunnels))
+	for _, tunnel := range conn.tunnels {
+		tunnels = append(tunnels, *tunnel)
+	}
 
-		select {
-		case _, ok := <-conn.closed:
-			if !ok {
-				return
-			}
-		case buf, ok := <-conn.writeChan:
-			if ok {
-				var n = 0
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Name < tunnels[j].Name })
 
-				for n < len(buf) {
+	return tunnels
+}
 
-					n, err := conn.conn.Write(buf)
+// Proxies() 获取正在代理中的连接信息，按开始时间排序
+func (conn *ControlConnection) Proxies() []ProxyInfo {
+	conn.proxiesMutex.Lock()
+	defer conn.proxiesMutex.Unlock()
 
-					if err != nil {
-						// TODO: 错误处理
-						fmt.Println("write():" + err.Error())
+	proxies := make([]ProxyInfo, 0, len(conn.proxies))
+	for proxyConn := range conn.proxies {
+		proxies = append(proxies, proxyConn.info())
+	}
 
-						conn.Close()
-					}
+	sort.Slice(proxies, func(i, j int) bool { return proxies[i].StartTime.Before(proxies[j].StartTime) })
 
-					buf = buf[n:]
-				}
-			} else {
-				return
-			}
+	return proxies
+}
+
+// tunnelNameByReqId() 根据ReqId查找隧道名字，找不到时返回空字符串
+func (conn *ControlConnection) tunnelNameByReqId(reqId string) string {
+	conn.tunnelsRWMutex.RLock()
+	defer conn.tunnelsRWMutex.RUnlock()
+
+	for _, tunnel := range conn.tunnels {
+		if reqId != "" && tunnel.ReqId == reqId {
+			return tunnel.Name
 		}
 	}
 
+	for _, tunnel := range conn.updating {
+		if reqId != "" && tunnel.ReqId == reqId {
+			return tunnel.Name
+		}
+	}
+
+	return ""
 }
 
-// readHandler() 从socket中读取数据，并解析，处理各个事件
-func (conn *ControlConnection) readHandler() {
+// tunnelByUrl() 根据服务器返回的URL查找隧道，找不到时返回nil
+func (conn *ControlConnection) tunnelByUrl(url string) *Tunnel {
+	conn.tunnelsRWMutex.RLock()
+	defer conn.tunnelsRWMutex.RUnlock()
 
-	var cmdBuffer *bytes.Buffer = nil
-	var tempBuffer *bytes.Buffer = nil
-	var cmdLen uint16 = 0
+	for _, tunnel := range conn.tunnels {
+		if tunnel.Url != "" && tunnel.Url == url {
+			copied := *tunnel
+			return &copied
+		}
+	}
 
-	for conn.IsClose() == false {
+	return nil
+}
 
-		buf := make([]byte, config.CONFIG.ReadBufSize)
+// addProxy() 记录一条开始代理的连接
+func (conn *ControlConnection) addProxy(proxyConn *ProxyConnection) {
+	conn.proxiesMutex.Lock()
+	conn.proxies[proxyConn] = true
+	conn.proxiesMutex.Unlock()
 
-		n, err := conn.conn.Read(buf)
+	if conn.Accept != nil {
+		conn.Accept(proxyConn.tunnelName, proxyConn.ClientAddr)
+	}
 
-		if err != nil {
-			// TODO: 错误处理
-			fmt.Println("readHandler():" + err.Error())
+	if conn.Events.OnProxyStart != nil {
+		conn.Events.OnProxyStart(proxyConn.info())
+	}
+}
+
+// removeProxy() 删除一条代理连接的记录
+func (conn *ControlConnection) removeProxy(proxyConn *ProxyConnection) {
+	conn.proxiesMutex.Lock()
+	_, ok := conn.proxies[proxyConn]
+	delete(conn.proxies, proxyConn)
+	conn.proxiesMutex.Unlock()
+
+	if ok && conn.Events.OnProxyClose != nil {
+		conn.Events.OnProxyClose(proxyConn.info())
+	}
+}
+
+// Service(ctx context.Context) 开始连接，该函数阻塞，直到连接关闭并且所有goroutine退出
+// 建立之后的控制连接断开时，按 ServerSelection 连接其他服务器，重新请求所有隧道，没有其他服务器或者设置了 ExitWithDisconnect 时关闭连接
+// ctx 被取消或者调用 Close() 时关闭连接，返回导致连接关闭的错误，主动关闭时返回nil
+func (conn *ControlConnection) Service(ctx context.Context) error {
+	if !conn.initialized {
+		panic("Should Init first!")
+	}
+
+	// ctx 被取消时关闭连接
+	stop := context.AfterFunc(ctx, conn.Close)
+	defer stop()
 
-			conn.Close()
+	// 初始化信号量的大小
+	conn.semaphore.Init(conn.MaxProxyCount)
+
+	authed, err := conn.connectServers(conn.serverAddresses())
+
+	for err == nil {
+		dropped := conn.serveSession(authed)
+
+		// 主动关闭，或者因为验证、隧道请求失败等错误已经关闭
+		if dropped == nil {
+			break
 		}
 
-		if n <= 0 {
-			// TODO: 错误处理
-			conn.Close()
+		addrs := conn.failoverServers(authed.addr)
+
+		if conn.ExitWithDisconnect || len(addrs) == 0 {
+			err = dropped
+			break
 		}
 
-		if n > 8 && tempBuffer == nil {
-			// 新的命令
+		conn.serverFailed(authed.addr, dropped, true)
 
-			cmdLenBytes := buf[:8]
-			// 获取到命令的长度
-			cmdLen = util.ToLen(cmdLenBytes)
+		authed, err = conn.connectServers(addrs)
+	}
 
-			if uint16(n-8) == cmdLen {
-				// 接收到的数据长度刚好等于命令长度
-				cmdBuffer = &bytes.Buffer{}
-				cmdBuffer.Write(buf[8:n])
+	if err != nil {
+		conn.closeWithError(err)
+	}
 
-			} else if uint16(n-8) > cmdLen {
-				// 接收到的数据长度大于命令长度，说明完整的命令后接着有其他命令
-				cmdBuffer = &bytes.Buffer{}
-				cmdBuffer.Write(buf[8 : cmdLen+8])
+	// 保证连接已经关闭
+	conn.Close()
 
-				tempBuffer = &bytes.Buffer{}
-				tempBuffer.Write(buf[cmdLen+8 : n])
+	conn.wg.Wait()
 
-			} else {
-				// 接收到的数据长度少于命令长度，说明该命令不完整，还需要继续获取
-				tempBuffer = &bytes.Buffer{}
-				tempBuffer.Write(buf[:n])
-			}
+	return conn.Err()
+}
 
-			// 重置命令长度
-			cmdLen = 0
+// serveSession(authed *authedConn) 在验证成功的控制连接上处理命令，该函数阻塞，直到控制连接断开或者连接关闭
+// 控制连接断开时返回断开的原因，连接关闭时返回nil
+func (conn *ControlConnection) serveSession(authed *authedConn) error {
+	// 这个控制连接的生命周期，连接关闭时一起取消
+	ctx, drop := context.WithCancelCause(conn.ctx)
 
-		} else if tempBuffer != nil {
-			// 未接收完的命令
+	conn.tunnelsRWMutex.Lock()
+	conn.serverAddr = authed.addr
+	conn.tunnelsRWMutex.Unlock()
 
-			// 先将所有数据写入临时缓存
-			tempBuffer.Write(buf[:n])
+	var wg sync.WaitGroup
+	wg.Add(2)
 
-			tempBytes := tempBuffer.Bytes()
+	// 控制连接断开或者连接关闭时关闭socket，使阻塞中的读写返回
+	go func() {
+		defer wg.Done()
 
-			cmdLenBytes := tempBytes[:8]
-			// 获取到命令的长度
-			cmdLen = util.ToLen(cmdLenBytes)
+		<-ctx.Done()
 
-			// 缓存中数据的长度
-			bufLen := tempBuffer.Len()
+		if err := authed.conn.Close(); err != nil {
+			fmt.Println("Close():" + err.Error())
+		}
+	}()
 
-			if uint16(bufLen-8) == cmdLen {
-				// 接收到的数据长度刚好等于命令长度
-				cmdBuffer = &bytes.Buffer{}
-				cmdBuffer.Write(tempBytes[8:bufLen])
+	// 为发送数据建立单独的goroutine， 通过writeChan缓冲通道交给write函数发送数据
+	go func() {
+		defer wg.Done()
+		conn.write(ctx, authed.conn, drop)
+	}()
+
+	// 验证已经在 connectServers() 中完成，处理验证结果后开始读取其他命令
+	if err := conn.authRespHandler(authed.resp); err != nil {
+		conn.closeWithError(err)
+	} else {
+		conn.readHandler(ctx, authed.reader, drop)
+	}
 
-				tempBuffer = nil
+	// readHandler() 只有在控制连接断开或者连接关闭后才会返回，这里保证socket已经关闭
+	drop(nil)
 
-			} else if uint16(n-8) > cmdLen {
-				// 接收到的数据长度大于命令长度，说明完整的命令后接着有其他命令
-				cmdBuffer = &bytes.Buffer{}
-				cmdBuffer.Write(tempBytes[8 : cmdLen+8])
+	if conn.IsClose() {
+		wg.Wait()
+		return nil
+	}
 
-				tempBuffer.Reset()
-				tempBuffer.Write(tempBytes[cmdLen+8 : bufLen])
+	conn.resetSession()
 
-			}
+	wg.Wait()
+
+	// 没有发送的数据属于断开的控制连接，隧道在下一个控制连接验证成功后重新请求
+	for len(conn.writeChan) > 0 {
+		<-conn.writeChan
+	}
+
+	return context.Cause(ctx)
+}
+
+// resetSession() 控制连接断开后，服务器上的隧道都已经失效：清除ClientId、服务器地址和隧道的URL，
+// 修改配置后还在请求中的隧道直接替换旧的隧道
+func (conn *ControlConnection) resetSession() {
+	conn.tunnelsRWMutex.Lock()
+	defer conn.tunnelsRWMutex.Unlock()
+
+	conn.ClientId = ""
+	conn.serverAddr = ""
+
+	for name, updated := range conn.updating {
+		conn.tunnels[name] = updated
+		delete(conn.updating, name)
+	}
+
+	for _, tunnel := range conn.tunnels {
+		tunnel.Url = ""
+	}
+}
+
+// spawn(f func()) 在新的goroutine中执行f，Service()会等待它退出
+func (conn *ControlConnection) spawn(f func()) {
+	conn.wg.Add(1)
+
+	go func() {
+		defer conn.wg.Done()
+		f()
+	}()
+}
+
+// send(buf []byte) 将数据放入发送缓存队列，连接关闭时返回错误
+func (conn *ControlConnection) send(buf []byte) error {
+	select {
+	case conn.writeChan <- buf:
+		return nil
+	case <-conn.ctx.Done():
+		return errcode.New(errcode.ErrSessionClosed, "control connection is closed")
+	}
+}
+
+// defaultServerAddress() ServerDomain:ServerPort
+func (conn *ControlConnection) defaultServerAddress() string {
+	return net.JoinHostPort(conn.ServerDomain, strconv.FormatUint(uint64(conn.ServerPort), 10))
+}
+
+// ServerAddress() 控制连接所在的服务器地址 host:port，还没有验证成功时为空
+func (conn *ControlConnection) ServerAddress() string {
+	conn.tunnelsRWMutex.RLock()
+	defer conn.tunnelsRWMutex.RUnlock()
+
+	return conn.serverAddr
+}
+
+// dialServer(ctx context.Context, address string) 通过Dialer连接服务器，控制连接和代理连接共用
+func (conn *ControlConnection) dialServer(ctx context.Context, address string) (net.Conn, error) {
+	return conn.dialer().DialContext(ctx, "tcp", address)
+}
+
+// dialer() 连接服务器使用的Dialer，没有设置时使用 TLSConfig 和 Proxy 组成默认的TLS连接
+func (conn *ControlConnection) dialer() transport.Dialer {
+	if conn.Dialer != nil {
+		return conn.Dialer
+	}
+
+	return &transport.TLSDialer{Base: &transport.TCPDialer{Proxy: conn.Proxy}, Config: conn.TLSConfig}
+}
 
-			cmdLen = 0
+// write(ctx context.Context, netConn net.Conn, drop context.CancelCauseFunc) 链接写函数，通过 writeChan 缓冲通道接收要发送给服务器的数据，再逐一发送
+// 目前设计为执行在一个单独的goroutine中，ctx 是控制连接的生命周期，写失败时通过drop断开控制连接
+func (conn *ControlConnection) write(ctx context.Context, netConn net.Conn, drop context.CancelCauseFunc) {
 
-		} else {
-			// 长度少于8byte,且不是未接收完的数据，需要错误处理
+	for {
 
-			fmt.Println("readHandler(): buf less than 8 byte and not uncompleted data!")
-			// 命令出错，关闭连接
-			conn.Close()
+		select {
+		case <-ctx.Done():
+			return
+		case buf := <-conn.writeChan:
+			for len(buf) > 0 {
+
+				n, err := netConn.Write(buf)
+
+				if err != nil {
+					fmt.Println("write():" + err.Error())
+
+					drop(errcode.Wrap(errcode.ErrSessionClosed, err))
+					return
+				}
+
+				buf = buf[n:]
+			}
 		}
+	}
+
+}
+
+// readHandler(ctx context.Context, reader *bufio.Reader, drop context.CancelCauseFunc) 从socket中读取数据，并解析，处理各个事件
+// ctx 是控制连接的生命周期，读失败时通过drop断开控制连接
+func (conn *ControlConnection) readHandler(ctx context.Context, reader *bufio.Reader, drop context.CancelCauseFunc) {
 
-		if cmdBuffer != nil {
-			// 接收到一条完整的命令
+	for ctx.Err() == nil {
+
+		cmdBytes, err := util.ReadFrame(reader)
+
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Println("readHandler():" + err.Error())
+			}
 
-			// fmt.Println(cmdBuffer.String())
-			conn.dispatch(cmdBuffer.Bytes())
-			cmdBuffer = nil
+			drop(errcode.Wrap(errcode.ErrSessionClosed, err))
+			return
 		}
 
+		// 接收到一条完整的命令
+		conn.dispatch(cmdBytes)
 	}
 
 }
 
 // dispatch() 解析命令，并将命令分配给各个函数处理
 func (conn *ControlConnection) dispatch(cmdBytes []byte) {
-	resp, respType, errno := util.ParsePayloadStruct(cmdBytes)
+	resp, respType, err := util.ParsePayloadStruct(cmdBytes)
 
-	if errno != errcode.ERR_SUCCESS {
+	if err != nil {
 		// 命令解析错误
-		fmt.Printf("dispatch() ParsePayloadStruct errno: %d, err msg: %s", errno, errcode.GetErrMsg(errno))
+		fmt.Println("dispatch() ParsePayloadStruct:" + err.Error())
 
 		// TODO: 命令出错，是否该断开连接？
 		// 目前先断开 control 连接处理
-		conn.Close()
+		conn.closeWithError(err)
 		return
 	}
 
-	var handlerErr int
-
 	switch respType {
 	case util.AUTH_RESP_TYPE:
-		handlerErr = conn.authRespHandler(resp.(util.AuthResp))
+		err = conn.authRespHandler(resp.(util.AuthResp))
 	case util.NEW_TUNNEL_TYPE:
-		handlerErr = conn.newTunnelHandler(resp.(util.NewTunnel))
+		err = conn.newTunnelHandler(resp.(util.NewTunnel))
 	case util.REQ_PROXY_TYPE:
-		handlerErr = conn.reqProxyHandler(resp.(util.ReqProxy))
+		err = conn.reqProxyHandler(resp.(util.ReqProxy))
 	// case util.START_PROXY_TYPE:
-	// 	handlerErr = conn.startProxyHandler(resp.(util.StartProxy))
+	// 	err = conn.startProxyHandler(resp.(util.StartProxy))
 	case util.PONG_TYPE:
-		handlerErr = conn.pongHandler(resp.(util.Pong))
+		err = conn.pongHandler(resp.(util.Pong))
 	default:
 		// 未知命令，可能版本问题
-		handlerErr = errcode.ERR_UNKNOW_RESP
+		err = errcode.New(errcode.ErrUnknowResp, "type "+respType)
 	}
 
-	if handlerErr != errcode.ERR_SUCCESS {
+	if err != nil {
 		// 错误处理
+		fmt.Println("dispatch():" + err.Error())
 
-		conn.Close()
+		conn.closeWithError(err)
 	}
 }
 
 // authRespHandler()处理AuthResp的响应函数
-func (conn *ControlConnection) authRespHandler(resp util.AuthResp) int {
+func (conn *ControlConnection) authRespHandler(resp util.AuthResp) error {
 
 	// TODO: 以后更新时，可能要判断服务器版本，现在先忽略Version和MmVersion
 
 	if resp.Error != "" || resp.ClientId == "" {
 		// 返回的错误信息(Error)不为 "" 或者 服务端没有返回ClientId
-		return errcode.ERR_AUTH_FAILED
+		if resp.Error == "" {
+			return errcode.New(errcode.ErrAuthFailed, "server returned no ClientId")
+		}
+		return errcode.New(errcode.ErrAuthFailed, resp.Error)
 	}
 
+	conn.tunnelsRWMutex.Lock()
+
 	conn.ClientId = resp.ClientId
 
-	// HTTP 的 ReqTunnel 请求
-	if conn.HTTPLocalPort > 0 {
-		// 需要代理的http连接本地端口，当大于0时表示需要代理连接
-		reqTunnel := util.ReqTunnel{ReqId: "", Protocol: util.PROTOCOL_HTTP, Hostname: conn.HTTPHostname, Subdomain: conn.HTTPSubdomain, HttpAuth: "", RemotePort: 0}
+	tunnels := make([]Tunnel, 0, len(conn.tunnels))
+	for _, tunnel := range conn.tunnels {
+		tunnels = append(tunnels, *tunnel)
+	}
+
+	conn.tunnelsRWMutex.Unlock()
 
-		byteData, err := util.PayloadStructToBytes(reqTunnel, util.REQ_TUNNEL_TYPE)
+	if conn.Events.OnAuth != nil {
+		conn.Events.OnAuth(resp.ClientId)
+	}
 
-		if err != nil {
-			// TODO: 错误处理
-			fmt.Println("authRespHandler():" + err.Error())
-			return errcode.ERR_PAYLOAD_TO_BYTES
+	// 为每条隧道发送 ReqTunnel 请求
+	for _, tunnel := range tunnels {
+		if err := conn.reqTunnel(tunnel); err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
+
+// reqTunnel() 发送一条隧道的 ReqTunnel 请求
+func (conn *ControlConnection) reqTunnel(tunnel Tunnel) error {
+	byteData, err := util.PayloadStructToBytes(tunnel.reqTunnel(), util.REQ_TUNNEL_TYPE)
 
-		// 将请求放入发送缓存队列
-		conn.writeChan <- byteData
+	if err != nil {
+		return &errcode.Error{Kind: errcode.ErrPayloadToBytes, Tunnel: tunnel.Name, Err: err}
 	}
 
-	// HTTPS 的 ReqTunnel 请求
-	if conn.HTTPSLocalPort > 0 {
-		// 需要代理的https连接本地端口，当大于0时表示需要代理连接
+	// 将请求放入发送缓存队列
+	return conn.send(byteData)
+}
 
-		reqTunnel := util.ReqTunnel{ReqId: "", Protocol: util.PROTOCOL_HTTPS, Hostname: conn.HTTPSHostname, Subdomain: conn.HTTPSSubdomain, HttpAuth: "", RemotePort: 0}
+// newTunnelHandler()处理NewTunnel的响应函数
+func (conn *ControlConnection) newTunnelHandler(resp util.NewTunnel) error {
 
-		byteData, err := util.PayloadStructToBytes(reqTunnel, util.REQ_TUNNEL_TYPE)
+	if resp.Error != "" {
+		// 返回信息中Error不为"""
+		err := &errcode.Error{Kind: errcode.ErrNewTunnel, Tunnel: conn.tunnelNameByReqId(resp.ReqId), Msg: resp.Error}
 
-		if err != nil {
-			// TODO: 错误处理
-			fmt.Println("authRespHandler():" + err.Error())
-			return errcode.ERR_PAYLOAD_TO_BYTES
+		if conn.removeFailedTunnel(resp.ReqId, err) {
+			fmt.Println("newTunnelHandler():" + err.Error())
+			return nil
 		}
 
-		// 将请求放入发送缓存队列
-		conn.writeChan <- byteData
+		return err
+	}
+
+	conn.tunnelsRWMutex.Lock()
+
+	// 优先通过ReqId匹配隧道，服务端没有返回ReqId时，按协议匹配第一条未建立的隧道
+	var matched *Tunnel
+	for _, tunnel := range conn.tunnels {
+		if resp.ReqId != "" && tunnel.ReqId == resp.ReqId {
+			matched = tunnel
+			break
+		}
+		if resp.ReqId == "" && matched == nil && tunnel.Url == "" && tunnel.Protocol == resp.Protocol {
+			matched = tunnel
+		}
+	}
+
+	// 修改配置后重新请求的隧道替换旧的隧道
+	for name, updated := range conn.updating {
+		if matched == nil && resp.ReqId != "" && updated.ReqId == resp.ReqId {
+			delete(conn.updating, name)
+			conn.tunnels[name] = updated
+			matched = updated
+		}
 	}
 
-	return errcode.ERR_SUCCESS
+	if matched == nil {
+		conn.tunnelsRWMutex.Unlock()
+
+		// 隧道已经被删除，或者不是本客户端请求的隧道
+		fmt.Println("newTunnelHandler(): no tunnel for " + resp.Url)
+		return nil
+	}
+
+	matched.Url = resp.Url
+	tunnel := *matched
+
+	if matched.Listener != nil {
+		matched.Listener.setReady()
+	}
+
+	conn.tunnelsRWMutex.Unlock()
+
+	if conn.Events.OnTunnel != nil {
+		conn.Events.OnTunnel(tunnel)
+	}
+
+	return nil
 }
 
-// newTunnelHandler()处理NewTunnel的响应函数
-func (conn *ControlConnection) newTunnelHandler(resp util.NewTunnel) int {
+// removeFailedTunnel() 请求失败的隧道是验证成功之后添加的时候，删除这条隧道并返回true；
+// 是修改配置后重新请求的隧道时，只放弃这次修改，保留旧的隧道
+func (conn *ControlConnection) removeFailedTunnel(reqId string, err error) bool {
+	conn.tunnelsRWMutex.Lock()
 
-	if resp.Error != "" {
-		// 返回信息中Error不为"""
-		fmt.Println("resp.Error:" + resp.Error)
-		return errcode.ERR_NEW_TUNNEL_ERROR
+	var failed *Tunnel
+	for _, tunnel := range conn.tunnels {
+		if reqId != "" && tunnel.ReqId == reqId && tunnel.dynamic {
+			failed = tunnel
+		}
 	}
 
-	switch resp.Protocol {
-	case util.PROTOCOL_HTTP:
-		conn.HTTPUrl = resp.Url
-	case util.PROTOCOL_HTTPS:
-		conn.HTTPSUrl = resp.Url
-	default:
-		// 不支持的协议
+	for _, tunnel := range conn.updating {
+		if reqId != "" && tunnel.ReqId == reqId {
+			failed = tunnel
+		}
+	}
+
+	if failed == nil {
+		conn.tunnelsRWMutex.Unlock()
+		return false
+	}
+
+	if conn.updating[failed.Name] == failed {
+		delete(conn.updating, failed.Name)
+	} else {
+		delete(conn.tunnels, failed.Name)
+	}
+
+	if failed.Listener != nil {
+		failed.Listener.closeWithError(err)
 	}
-	return errcode.ERR_SUCCESS
+
+	conn.tunnelsRWMutex.Unlock()
+
+	if conn.Events.OnTunnelError != nil {
+		conn.Events.OnTunnelError(failed.Name, err)
+	}
+
+	return true
 }
 
 // reqProxyHandller()处理ReqProxy的响应函数
-func (conn *ControlConnection) reqProxyHandler(resp util.ReqProxy) int {
+func (conn *ControlConnection) reqProxyHandler(resp util.ReqProxy) error {
 
-	address := conn.ServerDomain + ":" + strconv.FormatUint(uint64(conn.ServerPort), 10)
+	// 关闭后不再接受新的代理连接
+	if conn.IsClose() {
+		return nil
+	}
+
+	// 代理连接和控制连接使用同一个服务器
+	address := conn.ServerAddress()
 
-	proxyConn := ProxyConnection{}
+	proxyConn := &ProxyConnection{}
 	proxyConn.Init(conn.ClientId, address, conn)
 
 	// 给Proxy Connection设置一个释放信号量的方法
@@ -405,50 +848,93 @@ func (conn *ControlConnection) reqProxyHandler(resp util.ReqProxy) int {
 	proxyConn.SetReleaseSem(&releaseSem)
 
 	// 通过信号量，限制proxy的最大连接数
-	conn.semaphore.Acquire()
+	if !conn.semaphore.AcquireContext(conn.ctx) {
+		return nil
+	}
 
-	go proxyConn.Start()
+	conn.spawn(proxyConn.Start)
 
-	return errcode.ERR_SUCCESS
+	return nil
 }
 
 // pongHandler()处理Pong的响应函数
-func (conn *ControlConnection) pongHandler(resp util.Pong) int {
+func (conn *ControlConnection) pongHandler(resp util.Pong) error {
 
-	return errcode.ERR_SUCCESS
+	return nil
 }
 
 // Close() 关闭连接
 func (conn *ControlConnection) Close() {
+	conn.closeWithError(nil)
+}
 
-	if !conn.IsClose() {
+// Drain(ctx context.Context) 优雅关闭连接：马上关闭控制连接，服务器不再转发新的访问，
+// 已经开始代理的连接继续传输直到结束，ctx 结束时强制关闭剩下的代理连接
+// 所有代理连接都正常结束时返回nil，被强制关闭时返回 ctx.Err()
+func (conn *ControlConnection) Drain(ctx context.Context) error {
+	conn.draining.Store(true)
+	conn.closeWithError(nil)
+
+	drained := make(chan bool)
+	go func() {
+		conn.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		conn.proxyCancel()
+		return nil
+	case <-ctx.Done():
+		conn.proxyCancel()
+		<-drained
+		return ctx.Err()
+	}
+}
 
-		// 关闭closed通道，使得其他goroutine能够知道要关闭连接
-		close(conn.closed)
+// Err() 获取导致连接关闭的错误，连接未关闭或者主动调用Close()关闭时为nil
+func (conn *ControlConnection) Err() error {
+	conn.closeMutex.Lock()
+	defer conn.closeMutex.Unlock()
 
-		conn.closeRWMutex.Lock()
-		conn.isClose = true
-		conn.closeRWMutex.Unlock()
+	return conn.closeErr
+}
 
-		err := conn.conn.Close()
+// closeWithError(err error) 因为err关闭连接，只有第一次调用的err会被记录，可以在任意goroutine中重复调用
+// 只负责记录错误和取消ctx，socket等资源由各自的goroutine在ctx取消后清理
+func (conn *ControlConnection) closeWithError(err error) {
 
-		fmt.Println("Close():" + err.Error())
+	conn.closeOnce.Do(func() {
 
-		close(conn.writeChan)
+		conn.closeMutex.Lock()
+		conn.closeErr = err
+		conn.closeMutex.Unlock()
 
-		// 清理信号量
-		conn.semaphore.Close()
-	}
+		// 取消ctx，使得其他goroutine能够知道要关闭连接
+		conn.cancel()
+
+		// 不是优雅关闭时，代理连接也马上关闭
+		if !conn.draining.Load() {
+			conn.proxyCancel()
+		}
+
+		// 关闭所有的Listener
+		conn.tunnelsRWMutex.RLock()
+		for _, tunnel := range conn.tunnels {
+			if tunnel.Listener != nil {
+				tunnel.Listener.close()
+			}
+		}
+		conn.tunnelsRWMutex.RUnlock()
+
+		if conn.Events.OnClose != nil {
+			conn.Events.OnClose(err)
+		}
+	})
 
 }
 
 // 获取是否已经连接关闭
 func (conn *ControlConnection) IsClose() bool {
-	tempVal := false
-
-	conn.closeRWMutex.RLock()
-	tempVal = conn.isClose
-	conn.closeRWMutex.RUnlock()
-
-	return tempVal
+	return conn.ctx.Err() != nil
 }
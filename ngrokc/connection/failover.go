@@ -0,0 +1,233 @@
+package connection
+
+import (
+	"bufio"
+	"context"
+	"net"
+	errcode "ngrok-client/ngrokc/err"
+	"ngrok-client/ngrokc/util"
+	"time"
+)
+
+// 选择服务器的方式
+const (
+	// 按列表的顺序，连接第一个可用的服务器
+	SERVER_SELECTION_ORDERED = "ordered"
+	// 同时连接所有服务器，按建立连接的快慢选择
+	SERVER_SELECTION_LATENCY = "latency"
+)
+
+// 连接并验证一个服务器的超时，超时后尝试下一个服务器
+const ServerTimeout = 10 * time.Second
+
+// 设置为连接的deadline，使阻塞中的读写马上返回
+var aLongTimeAgo = time.Unix(1, 0)
+
+// serverConn 已经连接到服务器的连接
+type serverConn struct {
+	addr string
+	conn net.Conn
+	err  error
+}
+
+// authedConn 验证成功的控制连接
+type authedConn struct {
+	addr   string
+	conn   net.Conn
+	reader *bufio.Reader
+	resp   util.AuthResp
+}
+
+// serverAddresses() 所有服务器的地址，没有设置 Servers 时只有 ServerDomain:ServerPort
+func (conn *ControlConnection) serverAddresses() []string {
+	if len(conn.Servers) > 0 {
+		return conn.Servers
+	}
+
+	return []string{conn.defaultServerAddress()}
+}
+
+// failoverServers(addr string) 控制连接断开后尝试的服务器：列表中 addr 之后的服务器，再从列表开头开始，不包括 addr
+func (conn *ControlConnection) failoverServers(addr string) []string {
+	addrs := conn.serverAddresses()
+
+	for i := range addrs {
+		if addrs[i] == addr {
+			others := make([]string, 0, len(addrs)-1)
+			others = append(others, addrs[i+1:]...)
+			return append(others, addrs[:i]...)
+		}
+	}
+
+	return addrs
+}
+
+// connectServers(addrs []string) 按 ServerSelection 连接并验证服务器，连接或者验证失败时尝试下一个服务器
+// 所有服务器都失败时返回最后一个错误
+func (conn *ControlConnection) connectServers(addrs []string) (*authedConn, error) {
+	if conn.ServerSelection == SERVER_SELECTION_LATENCY && len(addrs) > 1 {
+		return conn.connectFastest(addrs)
+	}
+
+	var lastErr error
+
+	for i, addr := range addrs {
+		ctx, cancel := context.WithTimeout(conn.ctx, ServerTimeout)
+
+		netConn, err := conn.dialServer(ctx, addr)
+
+		var authed *authedConn
+		if err != nil {
+			err = errcode.Wrap(errcode.ErrConnectServer, err)
+		} else {
+			authed, err = conn.authenticate(ctx, addr, netConn)
+		}
+
+		cancel()
+
+		if err == nil {
+			return authed, nil
+		}
+
+		lastErr = err
+		if conn.IsClose() {
+			break
+		}
+
+		conn.serverFailed(addr, err, i < len(addrs)-1)
+	}
+
+	return nil, lastErr
+}
+
+// connectFastest(addrs []string) 同时连接所有服务器，按连接建立的先后顺序验证，使用第一个验证成功的服务器
+func (conn *ControlConnection) connectFastest(addrs []string) (*authedConn, error) {
+	dialCtx, cancelDials := context.WithTimeout(conn.ctx, ServerTimeout)
+
+	results := make(chan serverConn, len(addrs))
+
+	for _, addr := range addrs {
+		addr := addr
+		conn.spawn(func() {
+			netConn, err := conn.dialServer(dialCtx, addr)
+			results <- serverConn{addr: addr, conn: netConn, err: err}
+		})
+	}
+
+	var lastErr error
+
+	for remaining := len(addrs); remaining > 0; remaining-- {
+		result := <-results
+
+		err := result.err
+		if err != nil {
+			err = errcode.Wrap(errcode.ErrConnectServer, err)
+		} else {
+			ctx, cancel := context.WithTimeout(conn.ctx, ServerTimeout)
+
+			var authed *authedConn
+			authed, err = conn.authenticate(ctx, result.addr, result.conn)
+
+			cancel()
+
+			if err == nil {
+				// 不再需要其他服务器的连接
+				cancelDials()
+				others := remaining - 1
+				conn.spawn(func() {
+					for ; others > 0; others-- {
+						if other := <-results; other.conn != nil {
+							other.conn.Close()
+						}
+					}
+				})
+
+				return authed, nil
+			}
+		}
+
+		lastErr = err
+		if conn.IsClose() {
+			break
+		}
+
+		conn.serverFailed(result.addr, err, remaining > 1)
+	}
+
+	cancelDials()
+
+	return nil, lastErr
+}
+
+// serverFailed(addr string, err error, hasNext bool) 一个服务器失败，还有其他服务器时通过 OnServerError 通知
+func (conn *ControlConnection) serverFailed(addr string, err error, hasNext bool) {
+	if hasNext && conn.Events.OnServerError != nil {
+		conn.Events.OnServerError(addr, err)
+	}
+}
+
+// authenticate(ctx context.Context, addr string, netConn net.Conn) 发送Auth并等待AuthResp，失败时关闭netConn
+// 返回的reader中可能已经缓存了AuthResp之后的数据，需要继续使用
+func (conn *ControlConnection) authenticate(ctx context.Context, addr string, netConn net.Conn) (*authedConn, error) {
+	// ctx 结束时使阻塞的读写返回
+	stop := context.AfterFunc(ctx, func() { netConn.SetDeadline(aLongTimeAgo) })
+
+	authed, err := conn.exchangeAuth(addr, netConn)
+
+	if !stop() && err == nil {
+		// ctx 已经结束，deadline已经被设置
+		err = errcode.Wrap(errcode.ErrConnectServer, ctx.Err())
+	}
+
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	return authed, nil
+}
+
+// exchangeAuth(addr string, netConn net.Conn) 验证的请求和响应
+func (conn *ControlConnection) exchangeAuth(addr string, netConn net.Conn) (*authedConn, error) {
+	auth := util.Auth{Version: "1.0.0", MmVersion: "1", User: conn.User, Password: conn.Password, OS: "!", Arch: "1", ClientId: ""}
+
+	content, err := util.PayloadStructToBytes(auth, util.AUTH_TYPE)
+
+	if err != nil {
+		return nil, errcode.Wrap(errcode.ErrPayloadToBytes, err)
+	}
+
+	if _, err := netConn.Write(content); err != nil {
+		return nil, errcode.Wrap(errcode.ErrSessionClosed, err)
+	}
+
+	reader := bufio.NewReaderSize(netConn, int(conn.ReadBufSize))
+
+	cmdBytes, err := util.ReadFrame(reader)
+
+	if err != nil {
+		return nil, errcode.Wrap(errcode.ErrSessionClosed, err)
+	}
+
+	resp, respType, err := util.ParsePayloadStruct(cmdBytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if respType != util.AUTH_RESP_TYPE {
+		return nil, errcode.New(errcode.ErrUnknowResp, "expected "+util.AUTH_RESP_TYPE+", got "+respType)
+	}
+
+	authResp := resp.(util.AuthResp)
+
+	if authResp.Error != "" {
+		return nil, errcode.New(errcode.ErrAuthFailed, authResp.Error)
+	}
+
+	if authResp.ClientId == "" {
+		return nil, errcode.New(errcode.ErrAuthFailed, "server returned no ClientId")
+	}
+
+	return &authedConn{addr: addr, conn: netConn, reader: reader, resp: authResp}, nil
+}
@@ -0,0 +1,32 @@
+package connection
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFailoverServers(t *testing.T) {
+	conn := &ControlConnection{Servers: []string{"a:4443", "b:4443", "c:4443"}}
+
+	// 从断开的服务器的下一个开始，不包括断开的服务器
+	tests := map[string]string{
+		"a:4443": "b:4443,c:4443",
+		"b:4443": "c:4443,a:4443",
+		"c:4443": "a:4443,b:4443",
+	}
+
+	for addr, want := range tests {
+		if got := strings.Join(conn.failoverServers(addr), ","); got != want {
+			t.Fatalf("failoverServers(%s) = %s, want %s", addr, got, want)
+		}
+	}
+
+	if servers := conn.Servers; strings.Join(servers, ",") != "a:4443,b:4443,c:4443" {
+		t.Fatalf("Servers changed to %v", servers)
+	}
+
+	single := &ControlConnection{ServerDomain: "ngrok.example.com", ServerPort: 4443}
+	if others := single.failoverServers("ngrok.example.com:4443"); len(others) != 0 {
+		t.Fatalf("failoverServers with a single server = %v", others)
+	}
+}
@@ -0,0 +1,230 @@
+package connection
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// 每个Listener中等待Accept()的代理连接数
+const listenerBacklog = 16
+
+// Listener 把隧道上的代理连接作为 net.Conn 交给Go代码处理，不需要打开本地端口
+// 可以直接传给 http.Serve() 等函数
+type Listener struct {
+	// 隧道名字
+	name string
+
+	controlConn *ControlConnection
+
+	// 等待Accept()的连接
+	conns chan net.Conn
+
+	// 隧道建立成功(拿到URL)后关闭
+	ready     chan bool
+	readyOnce sync.Once
+
+	// Close()后关闭
+	closed    chan bool
+	closeOnce sync.Once
+	// 关闭的原因，Close()时为 net.ErrClosed，隧道请求失败时为服务器返回的错误
+	err error
+}
+
+// Listen(tunnel Tunnel) 添加一条隧道，代理连接不再连接本地端口，而是通过返回的Listener交给调用者
+// tunnel.LocalPort 会被忽略
+func (conn *ControlConnection) Listen(tunnel Tunnel) (*Listener, error) {
+	listener := &Listener{
+		name:        tunnel.Name,
+		controlConn: conn,
+		conns:       make(chan net.Conn, listenerBacklog),
+		ready:       make(chan bool),
+		closed:      make(chan bool),
+	}
+
+	tunnel.LocalPort = 0
+	tunnel.Listener = listener
+
+	if err := conn.AddTunnel(tunnel); err != nil {
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// Ready() 隧道建立成功后关闭的通道
+func (listener *Listener) Ready() <-chan bool {
+	return listener.ready
+}
+
+// Closed() Listener关闭后关闭的通道
+func (listener *Listener) Closed() <-chan bool {
+	return listener.closed
+}
+
+// Err() 返回Listener关闭的原因，还没有关闭时返回nil
+func (listener *Listener) Err() error {
+	select {
+	case <-listener.closed:
+		return listener.err
+	default:
+		return nil
+	}
+}
+
+// Accept() 等待并返回下一条代理连接，连接的 RemoteAddr() 是访问者的地址
+// Listener关闭后返回关闭的原因
+func (listener *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.closed:
+		return nil, listener.err
+	}
+}
+
+// Close() 关闭Listener并删除对应的隧道，已经Accept()的连接不受影响
+func (listener *Listener) Close() error {
+	listener.close()
+
+	listener.controlConn.RemoveTunnel(listener.name)
+
+	return nil
+}
+
+// Addr() 返回隧道的公网URL，隧道建立之前为空
+func (listener *Listener) Addr() net.Addr {
+	url := ""
+
+	for _, tunnel := range listener.controlConn.Tunnels() {
+		if tunnel.Name == listener.name {
+			url = tunnel.Url
+		}
+	}
+
+	return proxyAddr{network: "ngrok", address: url}
+}
+
+// close() 关闭Listener，不删除隧道
+func (listener *Listener) close() {
+	listener.closeWithError(net.ErrClosed)
+}
+
+// closeWithError(err error) 关闭Listener，之后的 Accept() 返回err
+func (listener *Listener) closeWithError(err error) {
+	listener.closeOnce.Do(func() {
+		listener.err = err
+		close(listener.closed)
+
+		// 关闭还没有被Accept()的连接
+		for {
+			select {
+			case conn := <-listener.conns:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+}
+
+// setReady() 隧道建立成功时调用
+func (listener *Listener) setReady() {
+	listener.readyOnce.Do(func() { close(listener.ready) })
+}
+
+// deliver(conn net.Conn, proxyClosed <-chan struct{}) 把代理连接交给Accept()
+func (listener *Listener) deliver(conn net.Conn, proxyClosed <-chan struct{}) error {
+	select {
+	case <-listener.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	select {
+	case listener.conns <- conn:
+		return nil
+	case <-listener.closed:
+		return net.ErrClosed
+	case <-proxyClosed:
+		return errors.New("proxy connection closed before accepted")
+	}
+}
+
+// proxyAddr 代理连接的地址
+type proxyAddr struct {
+	network string
+	address string
+}
+
+func (addr proxyAddr) Network() string {
+	return addr.network
+}
+
+func (addr proxyAddr) String() string {
+	return addr.address
+}
+
+// listenerConn 交给Listener的连接，地址替换为隧道URL和访问者地址
+type listenerConn struct {
+	net.Conn
+
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (conn *listenerConn) LocalAddr() net.Addr {
+	return conn.localAddr
+}
+
+func (conn *listenerConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+// connListener 只返回一个连接的 net.Listener，用于在一个连接上运行 http.Server
+// 连接关闭或者被接管(Hijack)后 Accept() 返回 net.ErrClosed，http.Server.Serve() 随之返回
+type connListener struct {
+	conn     net.Conn
+	accepted bool
+
+	mutex     sync.Mutex
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+// newConnListener(conn net.Conn) 创建只返回conn的Listener
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, closed: make(chan bool)}
+}
+
+func (listener *connListener) Accept() (net.Conn, error) {
+	listener.mutex.Lock()
+	if !listener.accepted {
+		listener.accepted = true
+		listener.mutex.Unlock()
+		return listener.conn, nil
+	}
+	listener.mutex.Unlock()
+
+	<-listener.closed
+
+	return nil, net.ErrClosed
+}
+
+func (listener *connListener) Close() error {
+	listener.closeOnce.Do(func() { close(listener.closed) })
+
+	return nil
+}
+
+func (listener *connListener) Addr() net.Addr {
+	return listener.conn.LocalAddr()
+}
+
+// connState(conn net.Conn, state http.ConnState) 作为 http.Server.ConnState，连接结束后关闭Listener
+func (listener *connListener) connState(conn net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		listener.Close()
+	}
+}
@@ -1,17 +1,25 @@
 package connection
 
 import (
-	"bytes"
+	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
-	"ngrok-client/ngrokc/config"
+	"net/http"
 	errcode "ngrok-client/ngrokc/err"
 	"ngrok-client/ngrokc/util"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// 在进程内处理HTTP请求时，读取请求头的超时时间
+const httpReadHeaderTimeout = time.Minute
+
 type ProxyConnection struct {
 	ClientId string
 
@@ -21,33 +29,54 @@ type ProxyConnection struct {
 	// 远程地址(ip:端口号 / 域名:端口号)
 	RemoteAddress string
 
-	// 标记是否关闭链接, true:关闭， false:不关闭
-	isClose bool
-	// 链接中其他goroutine的关闭信号
-	closed chan bool
-	// 设置读取IsClose标识的读写锁
-	closeRWMutex sync.RWMutex
+	// 连接的生命周期，由控制连接的proxyCtx派生
+	// 控制连接关闭时，还没有开始代理的连接马上关闭，正在代理的连接在优雅关闭时可以继续传输
+	ctx    context.Context
+	cancel context.CancelFunc
+	// 等待代理连接创建的所有goroutine退出
+	wg sync.WaitGroup
 
 	// proxy 连向服务端的连接
 	proxyConn net.Conn
 
-	// local 连向本地的连接
+	// local 连向本地的连接，在读goroutine中设置，需要通过connMutex访问
 	localConn net.Conn
+	// 设置和关闭localConn的锁
+	connMutex sync.Mutex
 
-	// 本地服务写缓冲通道
+	// 本地服务写缓冲通道，通道不会被关闭，发送时需要同时等待ctx
 	localWriteChan chan []byte
 
-	// 服务端写缓冲通道
+	// 服务端写缓冲通道，通道不会被关闭，发送时需要同时等待ctx
 	remoteWriteChan chan []byte
 
 	// 是否已经接收到 StartProxy 正式开始代理
-	isStart bool
+	isStart atomic.Bool
+	// 是否拒绝了这条代理连接
+	rejected bool
+
+	// 从访问者收到的和发送给访问者的字节数，只计算放入发送队列的数据
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	// 开始代理的时间
+	startTime time.Time
+
+	// 代理的隧道名字和它的带宽限制，在 StartProxy 时设置
+	tunnelName string
+	bandwidth  *BandwidthLimit
 
 	// 指向控制链接的指针
 	controlConn *ControlConnection
 
 	// 释放信号量的方法
 	releaseSem *func()
+
+	// 访问者的代理连接结束，在 StartProxy 时设置
+	releaseVisitor func()
+
+	// 带宽限制的等待，为nil时为 util.SleepContext，测试时可以替换
+	sleep func(ctx context.Context, d time.Duration) bool
 }
 
 // Init(clientId, remoteAddress string, controlConn *ControlConnection) 初始化连接，只是初始化参数，并没有真正连接，
@@ -58,10 +87,13 @@ func (conn *ProxyConnection) Init(clientId, remoteAddress string, controlConn *C
 
 	conn.controlConn = controlConn
 
-	conn.closed = make(chan bool)
+	conn.ctx, conn.cancel = context.WithCancel(controlConn.proxyCtx)
+
+	conn.remoteWriteChan = make(chan []byte, 10)
+	conn.localWriteChan = make(chan []byte, 10)
 }
 
-// 设置是信号量的函数，设置后，将在Close()时调用
+// 设置是信号量的函数，设置后，将在连接关闭并且所有goroutine退出后调用
 func (conn *ProxyConnection) SetReleaseSem(releaseSem *func()) {
 	conn.releaseSem = releaseSem
 }
@@ -69,10 +101,7 @@ func (conn *ProxyConnection) SetReleaseSem(releaseSem *func()) {
 // connectServ() 连接服务端
 func (conn *ProxyConnection) connectServ() error {
 
-	// 无视ssl证书，仅用于测试
-	config := &tls.Config{InsecureSkipVerify: true}
-
-	connection, err := tls.Dial("tcp", conn.RemoteAddress, config)
+	connection, err := conn.controlConn.dialServer(conn.ctx, conn.RemoteAddress)
 
 	if err == nil {
 		conn.proxyConn = connection
@@ -92,43 +121,104 @@ func (conn *ProxyConnection) connectLocal(isSSL bool, port uint) error {
 		// SSL 连接
 
 		// 无视ssl证书，仅用于测试
-		config := &tls.Config{InsecureSkipVerify: true}
+		dialer := &tls.Dialer{Config: &tls.Config{InsecureSkipVerify: true}}
 
-		connection, err = tls.Dial("tcp", address, config)
+		connection, err = dialer.DialContext(conn.ctx, "tcp", address)
 	} else {
 		// 普通连接
-		connection, err = net.Dial("tcp", address)
+		dialer := &net.Dialer{}
+
+		connection, err = dialer.DialContext(conn.ctx, "tcp", address)
 	}
 
 	if err != nil {
-		// TODO: 错误处理
-		fmt.Println("connectLocal():" + err.Error())
-	} else {
-		conn.localConn = connection
+		return err
 	}
 
-	return err
+	return conn.setLocalConn(connection)
+}
+
+// setLocalConn() 设置本地连接，如果代理连接已经关闭，直接关闭本地连接并返回错误
+func (conn *ProxyConnection) setLocalConn(localConn net.Conn) error {
+	conn.connMutex.Lock()
+	defer conn.connMutex.Unlock()
+
+	if conn.IsClose() {
+		localConn.Close()
+		return errcode.New(errcode.ErrSessionClosed, "proxy connection is closed")
+	}
+
+	conn.localConn = localConn
+
+	return nil
+}
+
+// connectListener() 通过管道把代理连接交给Listener，管道的一端作为本地连接
+func (conn *ProxyConnection) connectListener(listener *Listener) error {
+	local, remote := net.Pipe()
+
+	accepted := &listenerConn{
+		Conn:       remote,
+		localAddr:  proxyAddr{network: "ngrok", address: conn.Url},
+		remoteAddr: proxyAddr{network: "tcp", address: conn.ClientAddr},
+	}
+
+	if err := listener.deliver(accepted, conn.ctx.Done()); err != nil {
+		local.Close()
+		remote.Close()
+		return err
+	}
+
+	return conn.setLocalConn(local)
 }
 
-// Start() 开始服务
+// connectHandler(handler http.Handler) 在进程内用 net/http 处理代理连接上的HTTP请求(包括 keep-alive 和分块传输)，
+// 管道的一端作为本地连接；请求的 RemoteAddr 是访问者的地址
+func (conn *ProxyConnection) connectHandler(handler http.Handler) error {
+	local, remote := net.Pipe()
+
+	listener := newConnListener(&listenerConn{
+		Conn:       remote,
+		localAddr:  proxyAddr{network: "ngrok", address: conn.Url},
+		remoteAddr: proxyAddr{network: "tcp", address: conn.ClientAddr},
+	})
+
+	server := &http.Server{Handler: handler, ConnState: listener.connState, ReadHeaderTimeout: httpReadHeaderTimeout}
+
+	if err := conn.setLocalConn(local); err != nil {
+		remote.Close()
+		return err
+	}
+
+	// 代理连接关闭时管道被关闭，连接结束后 Serve() 返回
+	conn.spawn(func() { server.Serve(listener) })
+
+	return nil
+}
+
+// Start() 开始服务，该函数阻塞，直到代理连接关闭并且所有goroutine退出
 func (conn *ProxyConnection) Start() {
 
+	defer conn.finish()
+
 	// 连接服务器失败
 	err := conn.connectServ()
 
 	if err != nil {
-		fmt.Printf("Failed to connect to server: %s", err)
+		if !conn.IsClose() {
+			fmt.Printf("Failed to connect to server: %s\n", err)
+		}
 		conn.Close()
 		return
 	}
 
-	conn.remoteWriteChan = make(chan []byte, 10)
-	conn.localWriteChan = make(chan []byte, 10)
+	// 连接关闭时关闭socket，使阻塞中的读写返回
+	conn.spawn(conn.closeConns)
 
 	// 为发送给服务器数据建立单独的goroutine, 通过 remoteWriteChan 缓冲通道交给writeRemote()函数发送数据
-	go conn.writeRemote()
+	conn.spawn(conn.writeRemote)
 
-	go conn.readRemote()
+	conn.spawn(conn.readRemote)
 
 	// 发送 RegProxy 请求
 	regProxy := util.RegProxy{ClientId: conn.ClientId}
@@ -137,46 +227,111 @@ func (conn *ProxyConnection) Start() {
 
 	if err != nil {
 		// 组装Payload错误
-		fmt.Printf("PayloadStructToBytes() Failed in Start(): %s", err)
+		fmt.Printf("PayloadStructToBytes() Failed in Start(): %s\n", err)
 		conn.Close()
 		return
 	}
 
-	conn.remoteWriteChan <- content
+	conn.sendRemote(content)
+
+}
+
+// finish() 等待所有goroutine退出后，清理代理连接
+func (conn *ProxyConnection) finish() {
+	conn.wg.Wait()
+
+	conn.controlConn.removeProxy(conn)
+
+	if conn.releaseVisitor != nil {
+		conn.releaseVisitor()
+	}
+
+	if conn.releaseSem != nil {
+		// 如果有释放信号量的函数，就调用
+		(*conn.releaseSem)()
+	}
+}
+
+// spawn(f func()) 在新的goroutine中执行f，Start()会等待它退出
+func (conn *ProxyConnection) spawn(f func()) {
+	conn.wg.Add(1)
+
+	go func() {
+		defer conn.wg.Done()
+		f()
+	}()
+}
+
+// closeConns() 连接关闭后，关闭服务端和本地的socket
+func (conn *ProxyConnection) closeConns() {
+	select {
+	case <-conn.ctx.Done():
+	case <-conn.controlConn.ctx.Done():
+		// 控制连接关闭时，还没有开始代理的连接马上关闭
+		if !conn.isStart.Load() {
+			conn.Close()
+		}
+		<-conn.ctx.Done()
+	}
+
+	conn.proxyConn.Close()
 
+	conn.connMutex.Lock()
+	if conn.localConn != nil {
+		conn.localConn.Close()
+	}
+	conn.connMutex.Unlock()
+}
+
+// sendRemote(buf []byte) 将数据放入发送给服务端的缓存队列，连接关闭时返回false
+func (conn *ProxyConnection) sendRemote(buf []byte) bool {
+	select {
+	case conn.remoteWriteChan <- buf:
+		return true
+	case <-conn.ctx.Done():
+		return false
+	}
+}
+
+// sendLocal(buf []byte) 将数据放入发送给本地的缓存队列，连接关闭时返回false
+func (conn *ProxyConnection) sendLocal(buf []byte) bool {
+	select {
+	case conn.localWriteChan <- buf:
+		return true
+	case <-conn.ctx.Done():
+		return false
+	}
 }
 
 // writeLocal() 链接写函数，通过 localWriteChan 缓冲通道接收要发送给本地的数据，再逐一发送
 // 目前设计为执行在一个单独的goroutine中
 func (conn *ProxyConnection) writeLocal() {
 
-	for conn.IsClose() == false {
+	for {
 
 		select {
-		case _, ok := <-conn.closed:
-			if !ok {
+		case <-conn.ctx.Done():
+			return
+		case buf := <-conn.localWriteChan:
+			if buf == nil {
+				// 服务端已经关闭，之前的数据已经发送完
+				conn.Close()
 				return
 			}
-		case buf, ok := <-conn.localWriteChan:
-			if ok {
-
-				var n = 0
 
-				for n < len(buf) {
+			for len(buf) > 0 {
 
-					n, err := conn.localConn.Write(buf)
+				n, err := conn.localConn.Write(buf)
 
-					if err != nil {
-						// TODO: 错误处理
+				if err != nil {
+					if !conn.IsClose() {
 						fmt.Println("writeLocal():" + err.Error())
-						conn.Close()
-						return
 					}
-
-					buf = buf[n:]
+					conn.Close()
+					return
 				}
-			} else {
-				return
+
+				buf = buf[n:]
 			}
 		}
 
@@ -188,32 +343,31 @@ func (conn *ProxyConnection) writeLocal() {
 // 目前设计为执行在一个单独的goroutine中
 func (conn *ProxyConnection) writeRemote() {
 
-	for conn.IsClose() == false {
+	for {
 
 		select {
-		case _, ok := <-conn.closed:
-			if !ok {
+		case <-conn.ctx.Done():
+			return
+		case buf := <-conn.remoteWriteChan:
+			if buf == nil {
+				// 本地服务已经关闭，之前的数据已经发送完
+				conn.Close()
 				return
 			}
-		case buf, ok := <-conn.remoteWriteChan:
-			if ok {
-				var n = 0
 
-				for n < len(buf) {
+			for len(buf) > 0 {
 
-					n, err := conn.proxyConn.Write(buf)
+				n, err := conn.proxyConn.Write(buf)
 
-					if err != nil {
-						// TODO: 错误处理
+				if err != nil {
+					if !conn.IsClose() {
 						fmt.Println("writeRemote():" + err.Error())
-						conn.Close()
-						return
 					}
-
-					buf = buf[n:]
+					conn.Close()
+					return
 				}
-			} else {
-				return
+
+				buf = buf[n:]
 			}
 
 		}
@@ -225,289 +379,268 @@ func (conn *ProxyConnection) writeRemote() {
 // readLocal() 从本地服务读取数据
 func (conn *ProxyConnection) readLocal() {
 
-	buf := make([]byte, config.CONFIG.ReadBufSize)
-
 	for conn.IsClose() == false {
 
+		// 每次读取使用新的缓存，放入队列的数据不能被下一次读取覆盖
+		buf := make([]byte, conn.controlConn.ReadBufSize)
+
 		n, err := conn.localConn.Read(buf)
-		if err != nil {
-			// TODO: 错误处理
-			fmt.Println("readLocal():" + err.Error())
-			conn.Close()
-			return
-		}
 
-		select {
-		case _, ok := <-conn.closed:
-			if !ok {
+		if n > 0 {
+			if !conn.transfer(DIRECTION_OUTBOUND, n) || !conn.throttle(DIRECTION_OUTBOUND, n) || !conn.sendRemote(buf[0:n]) {
 				return
 			}
-		case conn.remoteWriteChan <- buf[0:n]:
-			continue
+
+			// 被拒绝或者连接关闭时没有发送的数据不计算
+			conn.bytesOut.Add(int64(n))
+		}
+
+		if err != nil {
+			if !conn.IsClose() && err != io.EOF {
+				fmt.Println("readLocal():" + err.Error())
+			}
+			// 放入nil，队列中的数据发送完后关闭连接
+			conn.sendRemote(nil)
+			return
 		}
 
 	}
 }
 
 // readRemote() 从服务端读取数据
+// 先读取 StartProxy 命令，之后的数据(包括和命令一起读到缓存中的数据)都转发给本地连接
 func (conn *ProxyConnection) readRemote() {
 
-	var cmdBuffer *bytes.Buffer = nil
-	var tempBuffer *bytes.Buffer = nil
-
-	// 存储proxy数据的buffer
-	var dataBuffer *bytes.Buffer = nil
-
-	var cmdLen uint16 = 0
-
-	for conn.IsClose() == false {
-
-		buf := make([]byte, config.CONFIG.ReadBufSize)
+	reader := bufio.NewReaderSize(conn.proxyConn, int(conn.controlConn.ReadBufSize))
 
-		select {
-		case _, ok := <-conn.closed:
-			if !ok {
-				return
-			}
-		default:
+	// 还未接收 StartProxy 命令
+	for !conn.isStart.Load() {
 
-			n, err := conn.proxyConn.Read(buf)
+		cmdBytes, err := util.ReadFrame(reader)
 
-			if err != nil {
-				// TODO: 错误处理
-				conn.Close()
+		if err != nil {
+			if !conn.IsClose() {
 				fmt.Println("readRemote():" + err.Error())
-				return
 			}
+			conn.Close()
+			return
+		}
 
-			if n <= 0 {
-				// TODO: 错误处理
-				conn.Close()
-				fmt.Println("conn.proxyConn.Read() get 0 bytes:" + err.Error())
-				return
-			}
-
-			if !conn.isStart {
-				// 还未接收 StartProxy 命令
-
-				if n > 8 && tempBuffer == nil {
-					// 新的命令
-
-					cmdLenBytes := buf[:8]
-					// 获取到命令的长度
-					cmdLen = util.ToLen(cmdLenBytes)
-
-					if uint16(n-8) == cmdLen {
-						// 接收到的数据长度刚好等于命令长度
-						cmdBuffer = &bytes.Buffer{}
-						cmdBuffer.Write(buf[8:n])
-
-					} else if uint16(n-8) > cmdLen {
-						// 接收到的数据长度大于命令长度，说明完整的命令后接着可能是代理的数据了
-						cmdBuffer = &bytes.Buffer{}
-						cmdBuffer.Write(buf[8 : cmdLen+8])
-
-						dataBuffer = &bytes.Buffer{}
-						dataBuffer.Write(buf[cmdLen+8 : n])
-
-					} else {
-						// 接收到的数据长度少于命令长度，说明该命令不完整，还需要继续获取
-						tempBuffer = &bytes.Buffer{}
-						tempBuffer.Write(buf[:n])
-					}
-
-				} else if tempBuffer != nil {
-					// 未接收完的命令
-
-					// 先将所有数据写入临时缓存
-					tempBuffer.Write(buf[:n])
-
-					tempBytes := tempBuffer.Bytes()
-
-					cmdLenBytes := tempBytes[:8]
-					// 获取到命令的长度
-					cmdLen = util.ToLen(cmdLenBytes)
-
-					// 缓存中数据的长度
-					bufLen := tempBuffer.Len()
-
-					if uint16(bufLen-8) == cmdLen {
-						// 接收到的数据长度刚好等于命令长度
-						cmdBuffer = &bytes.Buffer{}
-						cmdBuffer.Write(tempBytes[8:bufLen])
-
-						tempBuffer = nil
-
-					} else if uint16(n-8) > cmdLen {
-						// 接收到的数据长度大于命令长度，说明完整的命令后接着有其他命令
-						cmdBuffer = &bytes.Buffer{}
-						cmdBuffer.Write(tempBytes[8 : cmdLen+8])
-
-						dataBuffer = &bytes.Buffer{}
-						dataBuffer.Write(tempBytes[cmdLen+8 : bufLen])
-
-					}
-
-					cmdLen = 0
-
-				} else {
-					// 长度少于8byte,且不是未接收完的数据，需要错误处理
-					conn.Close()
-				}
-
-				if cmdBuffer != nil {
-					// 接收到一条完整的命令
-
-					// fmt.Println(cmdBuffer.String())
-					conn.dispatch(cmdBuffer.Bytes())
-					cmdBuffer = nil
-				}
-
-				if dataBuffer != nil {
-					// fmt.Println(dataBuffer.String())
-					conn.localWriteChan <- dataBuffer.Bytes()
-					dataBuffer = nil
+		conn.dispatch(cmdBytes)
 
-				}
+		if conn.IsClose() {
+			return
+		}
 
-			} else {
-				// 已经接收 StartProxy 命令
+		if conn.rejected {
+			// 读取并丢弃访问者的数据，直到拒绝的响应发送完之后连接关闭
+			io.Copy(io.Discard, reader)
+			return
+		}
+	}
 
-				if dataBuffer == nil {
-					dataBuffer = &bytes.Buffer{}
-				} else {
+	// 已经接收 StartProxy 命令，读写数据，传入本地连接
+	for conn.IsClose() == false {
 
-					if dataBuffer.Len() > 0 {
+		buf := make([]byte, conn.controlConn.ReadBufSize)
 
-						conn.localWriteChan <- dataBuffer.Bytes()
-					}
+		n, err := reader.Read(buf)
 
-					dataBuffer.Reset()
-				}
+		if n > 0 {
+			if !conn.transfer(DIRECTION_INBOUND, n) || !conn.throttle(DIRECTION_INBOUND, n) || !conn.sendLocal(buf[0:n]) {
+				return
+			}
 
-				dataBuffer.Write(buf[0:n])
+			conn.bytesIn.Add(int64(n))
+		}
 
-				// 读写数据，传入本地连接
-				conn.localWriteChan <- dataBuffer.Bytes()
+		if err != nil {
+			if !conn.IsClose() && err != io.EOF {
+				fmt.Println("readRemote():" + err.Error())
 			}
 
+			// 放入nil，队列中的数据发送完后关闭连接
+			conn.sendLocal(nil)
+			return
 		}
-
 	}
 }
 
 // dispatch() 解析命令，并将命令分配给各个函数处理
 func (conn *ProxyConnection) dispatch(cmdBytes []byte) {
-	resp, respType, errno := util.ParsePayloadStruct(cmdBytes)
+	resp, respType, err := util.ParsePayloadStruct(cmdBytes)
 
-	if errno != errcode.ERR_SUCCESS {
+	if err != nil {
 		// 命令解析错误
 
-		fmt.Printf("util.ParsePayloadStruct() err: %s", errcode.GetErrMsg(errno))
+		fmt.Println("util.ParsePayloadStruct() err:" + err.Error())
 
 		// 关闭连接
 		conn.Close()
 		return
 	}
 
-	var handlerErr int
-
 	switch respType {
 	case util.START_PROXY_TYPE:
-		handlerErr = conn.startProxyHandler(resp.(util.StartProxy))
+		err = conn.startProxyHandler(resp.(util.StartProxy))
 	default:
 		// 未知命令，可能版本问题
-		handlerErr = errcode.ERR_UNKNOW_RESP
+		err = errcode.New(errcode.ErrUnknowResp, "type "+respType)
 	}
 
-	if handlerErr != errcode.ERR_SUCCESS {
+	if err != nil {
 		// 错误处理
+		fmt.Println("ProxyConnection dispatch():" + err.Error())
 		// 关闭连接
 		conn.Close()
 	}
 }
 
 // startProxyHandler() 处理 StartProxy 请求
-func (conn *ProxyConnection) startProxyHandler(resp util.StartProxy) int {
+func (conn *ProxyConnection) startProxyHandler(resp util.StartProxy) error {
 
-	var errnum = errcode.ERR_SUCCESS
+	tunnel := conn.controlConn.tunnelByUrl(resp.Url)
 
-	if resp.Url == conn.controlConn.HTTPUrl {
-		// 代理HTTP
+	if tunnel == nil {
+		return &errcode.Error{Kind: errcode.ErrUnknowProxyUrl, Tunnel: resp.Url}
+	}
 
-		err := conn.connectLocal(false, conn.controlConn.HTTPLocalPort)
+	conn.Url = resp.Url
+	conn.ClientAddr = resp.ClientAddr
+	conn.tunnelName = tunnel.Name
+	conn.bandwidth = tunnel.bandwidth
 
-		if err == nil {
-			conn.isStart = true
+	if err := tunnel.checkClientAddr(resp.ClientAddr); err != nil {
+		conn.reject(tunnel, err)
+		return nil
+	}
 
-			go conn.writeLocal()
-			go conn.readLocal()
-		} else {
-			// 连接本地端口失败
-			fmt.Println("startProxyHandler() failed to connect local HTTP service:" + err.Error())
-			conn.Close()
-			errnum = errcode.ERR_CONNECT_LOCAL_FAILED
+	if admission := conn.controlConn.Admission; admission != nil {
+		if err := admission(*tunnel, resp.ClientAddr); err != nil {
+			conn.reject(tunnel, err)
+			return nil
 		}
+	}
 
-	} else if resp.Url == conn.controlConn.HTTPSUrl {
-		// 代理HTTPS
-		err := conn.connectLocal(true, conn.controlConn.HTTPSLocalPort)
+	// 最后检查访问者的限制，通过后才计入访问者的连接
+	release, err := tunnel.visitors.acquire(resp.ClientAddr)
+	if err != nil {
+		conn.reject(tunnel, err)
+		return nil
+	}
+	conn.releaseVisitor = release
 
-		if err == nil {
-			conn.isStart = true
+	if tunnel.Listener != nil {
+		err = conn.connectListener(tunnel.Listener)
+	} else if tunnel.Handler != nil && tunnel.Protocol != util.PROTOCOL_TCP {
+		err = conn.connectHandler(tunnel.Handler)
+	} else {
+		err = conn.connectLocal(tunnel.Protocol == util.PROTOCOL_HTTPS, tunnel.LocalPort)
+	}
 
-			go conn.writeLocal()
-			go conn.readLocal()
-		} else {
-			fmt.Println("startProxyHandler()failed to connect local HTTPS service:" + err.Error())
-			conn.Close()
-			errnum = errcode.ERR_CONNECT_LOCAL_FAILED
-		}
+	if err != nil {
+		// 连接本地端口失败
+		conn.Close()
+		return &errcode.Error{Kind: errcode.ErrConnectLocalFailed, Tunnel: tunnel.Name, Err: err}
+	}
 
-	} else {
-		errnum = errcode.ERR_UNKNOW_PROXY_URL
+	conn.isStart.Store(true)
+	conn.startTime = time.Now()
+
+	conn.controlConn.addProxy(conn)
+
+	conn.spawn(conn.writeLocal)
+	conn.spawn(conn.readLocal)
+
+	return nil
+}
+
+// reject(tunnel *Tunnel, reason error) 拒绝代理连接，http/https 隧道返回 403(访问者超过连接限制时为 429)后关闭，
+// tcp 隧道直接关闭
+func (conn *ProxyConnection) reject(tunnel *Tunnel, reason error) {
+	conn.rejected = true
+
+	err := &errcode.Error{Kind: errcode.ErrProxyRejected, Tunnel: tunnel.Name, Err: reason}
+
+	if conn.controlConn.Events.OnProxyReject != nil {
+		conn.controlConn.Events.OnProxyReject(conn.info(), err)
+	}
+
+	if tunnel.Protocol == util.PROTOCOL_TCP {
+		conn.Close()
+		return
 	}
 
-	return errnum
+	status := http.StatusForbidden
+	if errors.Is(reason, errcode.ErrTooManyConnections) {
+		status = http.StatusTooManyRequests
+	}
+
+	body := reason.Error() + "\n"
+	response := "HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\nContent-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\nConnection: close\r\n\r\n" + body
+
+	// 放入nil，响应发送完后关闭连接
+	if conn.sendRemote([]byte(response)) {
+		conn.sendRemote(nil)
+	}
 }
 
-// Close()关闭代理连接的方法
-func (conn *ProxyConnection) Close() {
+// transfer(direction string, n int) 传输n字节之前调用 ControlConnection.Transfer，返回错误时关闭代理连接并返回false
+func (conn *ProxyConnection) transfer(direction string, n int) bool {
+	check := conn.controlConn.Transfer
+	if check == nil {
+		return true
+	}
 
-	if !conn.IsClose() {
+	if err := check(conn.tunnelName, conn.ClientAddr, direction, n); err != nil {
+		fmt.Printf("ProxyConnection transfer(): tunnel %s, client %s: %v\n", conn.tunnelName, conn.ClientAddr, err)
+		conn.Close()
+		return false
+	}
 
-		// 关闭closed通道，使得其他goroutine能够知道要关闭连接
-		close(conn.closed)
+	return true
+}
 
-		conn.closeRWMutex.Lock()
-		conn.isClose = true
-		conn.closeRWMutex.Unlock()
+// throttle(direction string, n int) 按隧道和全局的带宽限制等待，然后才能传输n字节，连接关闭时返回false
+func (conn *ProxyConnection) throttle(direction string, n int) bool {
+	delay := max(conn.bandwidth.reserve(direction, n), conn.controlConn.Bandwidth.reserve(direction, n))
 
-		if conn.localConn != nil {
-			conn.localConn.Close()
-		}
+	if delay <= 0 {
+		return true
+	}
 
-		if conn.proxyConn != nil {
-			conn.proxyConn.Close()
-		}
+	if conn.controlConn.Events.OnThrottle != nil {
+		conn.controlConn.Events.OnThrottle(conn.tunnelName, direction, delay)
+	}
 
-		if conn.releaseSem != nil {
-			// 如果有释放信号量的函数，就调用
-			(*conn.releaseSem)()
-		}
+	sleep := util.SleepContext
+	if conn.sleep != nil {
+		sleep = conn.sleep
+	}
+
+	return sleep(conn.ctx, delay)
+}
+
+// Close()关闭代理连接的方法，可以在任意goroutine中重复调用
+// 只负责取消ctx，socket由closeConns()关闭，信号量在所有goroutine退出后由finish()释放
+func (conn *ProxyConnection) Close() {
+	conn.cancel()
+}
 
-		close(conn.localWriteChan)
-		close(conn.remoteWriteChan)
+// info() 获取代理连接的信息
+func (conn *ProxyConnection) info() ProxyInfo {
+	return ProxyInfo{
+		Tunnel:     conn.tunnelName,
+		Url:        conn.Url,
+		ClientAddr: conn.ClientAddr,
+		StartTime:  conn.startTime,
+		BytesIn:    conn.bytesIn.Load(),
+		BytesOut:   conn.bytesOut.Load(),
 	}
 }
 
 // 获取是否已经连接关闭
 func (conn *ProxyConnection) IsClose() bool {
-	tempVal := false
-
-	conn.closeRWMutex.RLock()
-	tempVal = conn.isClose
-	conn.closeRWMutex.RUnlock()
-
-	return tempVal
+	return conn.ctx.Err() != nil
 }
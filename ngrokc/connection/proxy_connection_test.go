@@ -0,0 +1,87 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeConn(transfer ProxyTransfer) 本地连接是管道的代理连接，返回管道的另一端(本地服务)
+func pipeConn(t *testing.T, transfer ProxyTransfer) (*ProxyConnection, net.Conn) {
+	local, service := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		service.Close()
+	})
+
+	conn := &ProxyConnection{
+		tunnelName:      "echo",
+		ClientAddr:      "10.0.0.1:50000",
+		localConn:       local,
+		controlConn:     &ControlConnection{ReadBufSize: 1024, Transfer: transfer},
+		remoteWriteChan: make(chan []byte, 10),
+		localWriteChan:  make(chan []byte, 10),
+	}
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+
+	return conn, service
+}
+
+func TestTransferRefused(t *testing.T) {
+	errQuota := errors.New("quota exceeded")
+
+	// 允许传输3KB，之后的传输被拒绝
+	var transferred int
+	conn, service := pipeConn(t, func(tunnel, clientAddr, direction string, n int) error {
+		if tunnel != "echo" || clientAddr != "10.0.0.1:50000" || direction != DIRECTION_OUTBOUND {
+			t.Errorf("Transfer(%s, %s, %s)", tunnel, clientAddr, direction)
+		}
+		if transferred >= 3*1024 {
+			return errQuota
+		}
+		transferred += n
+		return nil
+	})
+
+	done := make(chan bool)
+	go func() {
+		conn.readLocal()
+		close(done)
+	}()
+
+	// 一直不关闭的本地服务，每次发送1KB
+	go func() {
+		for i := 0; i < 10; i++ {
+			if _, err := service.Write(make([]byte, 1024)); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("readLocal did not return after the transfer was refused")
+	}
+
+	if !conn.IsClose() {
+		t.Fatal("connection not closed after the transfer was refused")
+	}
+
+	// 被拒绝的数据没有发送给服务端
+	sent := 0
+	for len(conn.remoteWriteChan) > 0 {
+		sent += len(<-conn.remoteWriteChan)
+	}
+
+	if sent != 3*1024 {
+		t.Fatalf("sent %d bytes to the server, want 3KB", sent)
+	}
+
+	// 被拒绝的数据也不计入流量
+	if info := conn.info(); info.BytesOut != 3*1024 || info.BytesIn != 0 {
+		t.Fatalf("BytesOut = %d, BytesIn = %d, want 3KB and 0", info.BytesOut, info.BytesIn)
+	}
+}
@@ -0,0 +1,160 @@
+package connection
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"ngrok-client/ngrokc/util"
+	"time"
+)
+
+// Tunnel 一条隧道的配置和状态
+type Tunnel struct {
+	// 隧道名字，同一个控制连接中唯一
+	Name     string
+	Protocol string
+
+	// http/https only
+	Hostname  string
+	Subdomain string
+	HttpAuth  string
+
+	// tcp only
+	RemotePort uint16
+
+	// 本地服务的端口
+	LocalPort uint
+
+	// http/https only，本地目录，不为空时代理连接上的请求由 Handler(middleware.FileServer)直接提供目录中的文件，不使用 LocalPort
+	Root string
+
+	// 这条隧道的带宽限制，每个方向每秒的字节数，为0时不限制
+	BandwidthLimit uint64
+	// 可以突发的字节数，为0时等于 BandwidthLimit
+	BandwidthBurst uint64
+
+	// 访问者IP的访问控制，先检查 DenyCIDRs；AllowCIDRs 不为空时只允许其中的地址
+	// 被拒绝时 http/https 隧道返回 403，tcp 隧道直接关闭
+	AllowCIDRs []netip.Prefix
+	DenyCIDRs  []netip.Prefix
+
+	// 每个访问者IP每秒可以新建的代理连接数，为0时不限制
+	VisitorRate uint64
+	// 每个访问者IP可以突发新建的代理连接数，为0时等于 VisitorRate
+	VisitorBurst uint64
+	// 每个访问者IP同时进行的代理连接数，为0时不限制
+	VisitorMaxConnections int
+
+	// 不为nil时，代理连接交给Listener处理，不连接本地端口
+	Listener *Listener
+
+	// http/https 隧道的HTTP处理，不为nil时代理连接上的请求在进程内用 net/http 解析后交给Handler，
+	// 由Handler(例如 middleware.ReverseProxy)访问本地服务，用于改写请求和响应
+	Handler http.Handler
+
+	// 服务器返回的 URL，为空表示还没有建立成功
+	Url string
+
+	// ReqTunnel 请求的ID，用于匹配服务器返回的 NewTunnel
+	ReqId string
+
+	// 验证成功之后才添加的隧道，请求失败时只删除这条隧道，不关闭控制连接
+	dynamic bool
+
+	// 这条隧道所有代理连接共用的令牌桶
+	bandwidth *BandwidthLimit
+	// 这条隧道的访问者限制
+	visitors *visitorLimiter
+}
+
+// checkLocal() 检查代理连接的去向：Listener、本地目录或者本地端口
+func (tunnel *Tunnel) checkLocal() error {
+	if tunnel.Root != "" {
+		if tunnel.Protocol == util.PROTOCOL_TCP || tunnel.Handler == nil {
+			return fmt.Errorf("tunnel %s: root %s requires an http/https tunnel with a Handler", tunnel.Name, tunnel.Root)
+		}
+
+		return nil
+	}
+
+	if tunnel.Listener == nil && (tunnel.LocalPort == 0 || tunnel.LocalPort > 65535) {
+		return fmt.Errorf("tunnel %s: invalid local port %d", tunnel.Name, tunnel.LocalPort)
+	}
+
+	return nil
+}
+
+// sameRequest(other Tunnel) 两条隧道向服务器请求的内容是否相同，不比较本地端口
+func (tunnel *Tunnel) sameRequest(other Tunnel) bool {
+	return tunnel.Protocol == other.Protocol &&
+		tunnel.Hostname == other.Hostname &&
+		tunnel.Subdomain == other.Subdomain &&
+		tunnel.HttpAuth == other.HttpAuth &&
+		tunnel.RemotePort == other.RemotePort
+}
+
+// reqTunnel() 生成这条隧道的 ReqTunnel 请求
+func (tunnel *Tunnel) reqTunnel() util.ReqTunnel {
+	return util.ReqTunnel{
+		ReqId:      tunnel.ReqId,
+		Protocol:   tunnel.Protocol,
+		Hostname:   tunnel.Hostname,
+		Subdomain:  tunnel.Subdomain,
+		HttpAuth:   tunnel.HttpAuth,
+		RemotePort: tunnel.RemotePort,
+	}
+}
+
+// ProxyInfo 一条代理连接的信息
+type ProxyInfo struct {
+	// 代理的隧道名字和 URL
+	Tunnel string
+	Url    string
+	// 访问者的地址
+	ClientAddr string
+	// 开始代理的时间
+	StartTime time.Time
+
+	// 从访问者收到的和发送给访问者的字节数
+	BytesIn  int64
+	BytesOut int64
+}
+
+// ProxyAdmission 在代理连接连接本地服务之前调用，返回错误时拒绝这条代理连接：
+// http/https 隧道给访问者返回错误页面，tcp 隧道直接关闭
+// 在代理连接的goroutine中同步调用，可以同时被多个代理连接调用
+type ProxyAdmission func(tunnel Tunnel, clientAddr string) error
+
+// ProxyAccept 代理连接通过所有检查、连接本地服务成功之后，在 Events.OnProxyStart 之前调用
+// 在代理连接的goroutine中同步调用，可以同时被多个代理连接调用，不应该阻塞
+type ProxyAccept func(tunnel, clientAddr string)
+
+// ProxyTransfer 代理连接每次传输数据之前调用，n 为这次传输的字节数，direction 为 DIRECTION_INBOUND/DIRECTION_OUTBOUND，
+// 返回错误时不传输这些数据并关闭这条代理连接
+// 在代理连接的goroutine中同步调用，可以同时被多个代理连接调用，不应该阻塞
+type ProxyTransfer func(tunnel, clientAddr, direction string, n int) error
+
+// Events 控制连接上发生的事件的回调，为nil的回调会被忽略
+// 回调在连接内部的goroutine中同步调用，不应该阻塞
+type Events struct {
+	// 验证成功
+	OnAuth func(clientId string)
+	// 隧道建立成功，tunnel.Url 为服务器返回的URL
+	OnTunnel func(tunnel Tunnel)
+	// 验证成功之后添加的隧道请求失败，隧道已经被删除
+	// 验证之前添加的隧道请求失败时会关闭控制连接，通过 OnClose 通知
+	OnTunnelError func(name string, err error)
+	// 代理连接开始代理
+	OnProxyStart func(proxy ProxyInfo)
+	// 代理连接关闭
+	OnProxyClose func(proxy ProxyInfo)
+	// 代理连接被拒绝，没有连接本地服务
+	OnProxyReject func(proxy ProxyInfo, err error)
+	// 代理连接因为带宽限制需要等待delay，direction 为 DIRECTION_INBOUND/DIRECTION_OUTBOUND
+	OnThrottle func(tunnel, direction string, delay time.Duration)
+	// 连接或者验证一个服务器失败，或者已经建立的控制连接断开，接下来会尝试下一个服务器
+	// 所有服务器都失败时通过 OnClose 通知最后一个错误
+	OnServerError func(addr string, err error)
+	// 控制连接关闭，err 为导致关闭的错误，主动关闭时为nil
+	OnClose func(err error)
+}
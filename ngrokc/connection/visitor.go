@@ -0,0 +1,120 @@
+package connection
+
+import (
+	"net"
+	errcode "ngrok-client/ngrokc/err"
+	"ngrok-client/ngrokc/util"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 清理不再限制的访问者的最小间隔
+const visitorSweepInterval = time.Minute
+
+// visitorLimiter 一条隧道按访问者IP限制新建代理连接的速率和同时进行的代理连接数
+type visitorLimiter struct {
+	mutex sync.Mutex
+
+	// 每个IP每秒可以新建的代理连接数和可以突发的连接数，rate 为0时不限制速率
+	rate  uint64
+	burst uint64
+	// 每个IP同时进行的代理连接数，为0时不限制
+	maxConnections int
+
+	visitors map[string]*visitorState
+
+	// 上一次清理的时间
+	lastSweep time.Time
+
+	// 获取当前时间
+	now func() time.Time
+}
+
+// visitorState 一个访问者的状态
+type visitorState struct {
+	bucket *util.TokenBucket
+	active int
+}
+
+// newVisitorLimiter(rate, burst uint64, maxConnections int) 创建访问者限制，都为0时返回nil，不限制
+func newVisitorLimiter(rate, burst uint64, maxConnections int) *visitorLimiter {
+	return newVisitorLimiterClock(rate, burst, maxConnections, time.Now)
+}
+
+// newVisitorLimiterClock(rate, burst uint64, maxConnections int, now func() time.Time) 和 newVisitorLimiter 相同，使用 now 获取当前时间
+func newVisitorLimiterClock(rate, burst uint64, maxConnections int, now func() time.Time) *visitorLimiter {
+	if rate == 0 && maxConnections <= 0 {
+		return nil
+	}
+
+	return &visitorLimiter{
+		rate:           rate,
+		burst:          burst,
+		maxConnections: maxConnections,
+		visitors:       make(map[string]*visitorState),
+		lastSweep:      now(),
+		now:            now,
+	}
+}
+
+// acquire(clientAddr string) 访问者(ip:端口)新建一条代理连接，超过限制时返回错误
+// 成功时返回的函数需要在代理连接结束时调用
+func (limiter *visitorLimiter) acquire(clientAddr string) (func(), error) {
+	if limiter == nil {
+		return func() {}, nil
+	}
+
+	ip := clientAddr
+	if host, _, err := net.SplitHostPort(clientAddr); err == nil {
+		ip = host
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.sweep()
+
+	visitor, ok := limiter.visitors[ip]
+	if !ok {
+		visitor = &visitorState{bucket: util.NewTokenBucketClock(limiter.rate, limiter.burst, limiter.now)}
+		limiter.visitors[ip] = visitor
+	}
+
+	if limiter.maxConnections > 0 && visitor.active >= limiter.maxConnections {
+		return nil, &errcode.Error{Kind: errcode.ErrTooManyConnections, Msg: ip + " has " + strconv.Itoa(visitor.active) + " active connections"}
+	}
+
+	if !visitor.bucket.Allow(1) {
+		return nil, &errcode.Error{Kind: errcode.ErrTooManyConnections, Msg: ip + " exceeds " + strconv.FormatUint(limiter.rate, 10) + " connections per second"}
+	}
+
+	visitor.active++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			limiter.mutex.Lock()
+			visitor.active--
+			limiter.mutex.Unlock()
+		})
+	}
+
+	return release, nil
+}
+
+// sweep() 定期删除没有进行中的连接并且令牌桶已经补满的访问者，需要持有锁
+func (limiter *visitorLimiter) sweep() {
+	now := limiter.now()
+	if now.Sub(limiter.lastSweep) < visitorSweepInterval {
+		return
+	}
+
+	limiter.lastSweep = now
+
+	for ip, visitor := range limiter.visitors {
+		if visitor.active == 0 && visitor.bucket.Full() {
+			delete(limiter.visitors, ip)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package connection
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	errcode "ngrok-client/ngrokc/err"
+)
+
+func TestVisitorMaxConnections(t *testing.T) {
+	limiter := newVisitorLimiter(0, 0, 2)
+
+	first, err := limiter.acquire("10.0.0.1:50000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := limiter.acquire("10.0.0.1:50001"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一个IP的第三条连接，端口不同
+	if _, err := limiter.acquire("10.0.0.1:50002"); !errors.Is(err, errcode.ErrTooManyConnections) {
+		t.Fatalf("third connection = %v, want ErrTooManyConnections", err)
+	}
+
+	// 其他访问者不受影响
+	if _, err := limiter.acquire("10.0.0.2:50000"); err != nil {
+		t.Fatalf("other visitor = %v", err)
+	}
+
+	// 连接结束后可以再连接，重复释放只算一次
+	first()
+	first()
+
+	if _, err := limiter.acquire("10.0.0.1:50003"); err != nil {
+		t.Fatalf("after release = %v", err)
+	}
+
+	if _, err := limiter.acquire("10.0.0.1:50004"); !errors.Is(err, errcode.ErrTooManyConnections) {
+		t.Fatalf("after double release = %v, want ErrTooManyConnections", err)
+	}
+}
+
+func TestVisitorRate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := newVisitorLimiterClock(1, 2, 0, func() time.Time { return now })
+
+	// 每秒1个，可以突发2个
+	for i, want := range []bool{true, true, false} {
+		release, err := limiter.acquire("10.0.0.1:1")
+		if (err == nil) != want {
+			t.Fatalf("connection %d = %v", i, err)
+		}
+		if err == nil {
+			release()
+		}
+	}
+
+	now = now.Add(time.Second)
+
+	if _, err := limiter.acquire("10.0.0.1:1"); err != nil {
+		t.Fatalf("after a second = %v", err)
+	}
+
+	if _, err := limiter.acquire("10.0.0.1:1"); !errors.Is(err, errcode.ErrTooManyConnections) {
+		t.Fatalf("second connection after a second = %v, want ErrTooManyConnections", err)
+	}
+}
+
+func TestVisitorSweep(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := newVisitorLimiterClock(10, 0, 1, func() time.Time { return now })
+
+	active, _ := limiter.acquire("10.0.0.1:1")
+	idle, _ := limiter.acquire("10.0.0.2:1")
+	idle()
+
+	// 清理没有进行中的连接并且令牌桶已经补满的访问者
+	now = now.Add(visitorSweepInterval)
+	limiter.acquire("10.0.0.3:1")
+
+	if _, ok := limiter.visitors["10.0.0.2"]; ok {
+		t.Fatal("idle visitor was not swept")
+	}
+
+	if _, ok := limiter.visitors["10.0.0.1"]; !ok {
+		t.Fatal("visitor with an active connection was swept")
+	}
+
+	active()
+
+	if newVisitorLimiter(0, 0, 0) != nil {
+		t.Fatal("newVisitorLimiter without limits != nil")
+	}
+
+	var unlimited *visitorLimiter
+	if release, err := unlimited.acquire("10.0.0.1:1"); err != nil || release == nil {
+		t.Fatalf("nil limiter acquire = %v", err)
+	}
+}
@@ -0,0 +1,1324 @@
+package ngrokc_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"ngrok-client/ngrokc"
+	"ngrok-client/ngrokc/connection"
+	"ngrok-client/ngrokc/metrics"
+	"ngrok-client/ngrokc/middleware"
+	errcode "ngrok-client/ngrokc/err"
+	"ngrok-client/ngrokc/testserver"
+	"ngrok-client/ngrokc/transport"
+	"ngrok-client/ngrokc/usage"
+	"ngrok-client/ngrokc/util"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func startServer(t *testing.T, configure func(server *testserver.Server)) *testserver.Server {
+	t.Helper()
+
+	server := &testserver.Server{}
+	if configure != nil {
+		configure(server)
+	}
+
+	if err := server.Start(); err != nil {
+		t.Fatalf("start test server: %v", err)
+	}
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func newClient(server *testserver.Server, tunnels ...ngrokc.TunnelOptions) *ngrokc.Client {
+	return ngrokc.NewClient(ngrokc.Options{
+		ServerHostname: server.Host(),
+		ServerPort:     server.Port(),
+		User:           "user",
+		Password:       "password",
+		Tunnels:        tunnels,
+	})
+}
+
+func startClient(t *testing.T, server *testserver.Server, tunnels ...ngrokc.TunnelOptions) (*ngrokc.Client, []connection.Tunnel) {
+	t.Helper()
+
+	client := newClient(server, tunnels...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	established, err := client.Start(ctx)
+
+	if err != nil {
+		t.Fatalf("start client: %v", err)
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		client.Wait()
+	})
+
+	return client, established
+}
+
+func localPort(t *testing.T, listener net.Listener) uint {
+	t.Helper()
+
+	port, err := testserver.LocalPort(listener.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return port
+}
+
+// publicAddr(url string) 去掉隧道URL中的协议
+func publicAddr(url string) string {
+	return url[strings.Index(url, "://")+3:]
+}
+
+func helloServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+}
+
+func get(t *testing.T, client *http.Client, url string) string {
+	t.Helper()
+
+	resp, err := client.Get(url)
+
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		t.Fatalf("read body of %s: %v", url, err)
+	}
+
+	return string(body)
+}
+
+func TestHTTPTunnel(t *testing.T) {
+	server := startServer(t, nil)
+
+	local := helloServer()
+	defer local.Close()
+
+	_, tunnels := startClient(t, server, ngrokc.TunnelOptions{Name: "web", Proto: util.PROTOCOL_HTTP, LocalPort: localPort(t, local.Listener)})
+
+	if len(tunnels) != 1 || tunnels[0].Url == "" {
+		t.Fatalf("unexpected tunnels: %+v", tunnels)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			path := fmt.Sprintf("/page/%d", i)
+			if body := get(t, http.DefaultClient, tunnels[0].Url+path); body != "hello "+path {
+				t.Errorf("GET %s = %q", path, body)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestHTTPSTunnel(t *testing.T) {
+	server := startServer(t, nil)
+
+	local := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "secure")
+	}))
+	defer local.Close()
+
+	_, tunnels := startClient(t, server, ngrokc.TunnelOptions{Name: "secure", Proto: util.PROTOCOL_HTTPS, LocalPort: localPort(t, local.Listener)})
+
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	if body := get(t, httpClient, tunnels[0].Url); body != "secure" {
+		t.Fatalf("GET = %q", body)
+	}
+}
+
+func TestTCPTunnel(t *testing.T) {
+	server := startServer(t, nil)
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	_, tunnels := startClient(t, server, ngrokc.TunnelOptions{Name: "echo", Proto: util.PROTOCOL_TCP, LocalPort: localPort(t, echo)})
+
+	visitor, err := net.Dial("tcp", publicAddr(tunnels[0].Url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+
+	go visitor.Write(data)
+
+	visitor.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(visitor, received); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+
+	if !bytes.Equal(data, received) {
+		t.Fatal("echoed data differs")
+	}
+}
+
+// TestServerFraming 服务器分片、延迟发送帧，或者把 StartProxy 和访问者的数据一起发送
+func TestServerFraming(t *testing.T) {
+	local := helloServer()
+	defer local.Close()
+
+	for name, configure := range map[string]func(server *testserver.Server){
+		"fragmented and delayed": func(server *testserver.Server) {
+			server.FragmentSize = 3
+			server.Delay = 5 * time.Millisecond
+		},
+		"coalesced start proxy": func(server *testserver.Server) {
+			server.CoalesceStartProxy = true
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := startServer(t, configure)
+
+			_, tunnels := startClient(t, server,
+				ngrokc.TunnelOptions{Name: "a", Proto: util.PROTOCOL_HTTP, LocalPort: localPort(t, local.Listener)},
+				ngrokc.TunnelOptions{Name: "b", Proto: util.PROTOCOL_HTTP, LocalPort: localPort(t, local.Listener)},
+			)
+
+			for _, tunnel := range tunnels {
+				if body := get(t, http.DefaultClient, tunnel.Url+"/"+tunnel.Name); body != "hello /"+tunnel.Name {
+					t.Fatalf("GET via %s = %q", tunnel.Name, body)
+				}
+			}
+		})
+	}
+}
+
+func TestListener(t *testing.T) {
+	server := startServer(t, nil)
+
+	client, _ := startClient(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	listener, err := client.Listen(ctx, ngrokc.TunnelOptions{Name: "inproc", Proto: util.PROTOCOL_HTTP})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+
+	remoteAddrs := make(chan string, 1)
+
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrs <- r.RemoteAddr
+		fmt.Fprint(w, "in-process")
+	}))
+
+	url := listener.Addr().String()
+
+	if body := get(t, http.DefaultClient, url); body != "in-process" {
+		t.Fatalf("GET = %q", body)
+	}
+
+	if addr := <-remoteAddrs; !strings.HasPrefix(addr, "127.0.0.1:") {
+		t.Fatalf("RemoteAddr = %q, want visitor address", addr)
+	}
+
+	listener.Close()
+
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept after Close = %v", err)
+	}
+}
+
+func echoServer(t *testing.T) net.Listener {
+	t.Helper()
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return echo
+}
+
+// waitTunnel(client *ngrokc.Client, name string) 等待隧道建立并返回它的URL
+func waitTunnel(t *testing.T, client *ngrokc.Client, name string) string {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, tunnel := range client.Tunnels() {
+			if tunnel.Name == name && tunnel.Url != "" {
+				return tunnel.Url
+			}
+		}
+	}
+
+	t.Fatalf("tunnel %s not established", name)
+	return ""
+}
+
+func TestUpdateTunnels(t *testing.T) {
+	server := startServer(t, func(server *testserver.Server) {
+		server.TunnelError = func(req util.ReqTunnel) string {
+			if req.Subdomain == "taken" {
+				return "subdomain taken"
+			}
+			return ""
+		}
+	})
+
+	oldLocal := helloServer()
+	defer oldLocal.Close()
+
+	newLocal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "new local")
+	}))
+	defer newLocal.Close()
+
+	echo := echoServer(t)
+	defer echo.Close()
+
+	web := ngrokc.TunnelOptions{Name: "web", Proto: util.PROTOCOL_HTTP, LocalPort: localPort(t, oldLocal.Listener)}
+	ssh := ngrokc.TunnelOptions{Name: "ssh", Proto: util.PROTOCOL_TCP, LocalPort: localPort(t, echo)}
+	old := ngrokc.TunnelOptions{Name: "old", Proto: util.PROTOCOL_HTTP, LocalPort: localPort(t, oldLocal.Listener)}
+	blog := ngrokc.TunnelOptions{Name: "blog", Proto: util.PROTOCOL_HTTP, LocalPort: localPort(t, oldLocal.Listener)}
+	api := ngrokc.TunnelOptions{Name: "api", Proto: util.PROTOCOL_HTTP, LocalPort: localPort(t, oldLocal.Listener)}
+
+	client, tunnels := startClient(t, server, web, ssh, old, blog, api)
+
+	urls := make(map[string]string)
+	for _, tunnel := range tunnels {
+		urls[tunnel.Name] = tunnel.Url
+	}
+
+	// 重新加载前建立的代理连接
+	visitor, err := net.Dial("tcp", publicAddr(urls["ssh"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+
+	echoed := func(message string) {
+		t.Helper()
+
+		visitor.SetDeadline(time.Now().Add(5 * time.Second))
+		visitor.Write([]byte(message))
+
+		buf := make([]byte, len(message))
+		if _, err := io.ReadFull(visitor, buf); err != nil || string(buf) != message {
+			t.Fatalf("echo = %q, %v", buf, err)
+		}
+	}
+
+	echoed("before")
+
+	// 运行时通过管理API添加的隧道不在配置中，重新加载时保留
+	runtime := ngrokc.TunnelOptions{Name: "runtime", Proto: util.PROTOCOL_HTTP, LocalPort: localPort(t, oldLocal.Listener)}
+	if err := client.ControlConnection().AddTunnel(connection.Tunnel{Name: runtime.Name, Protocol: runtime.Proto, LocalPort: runtime.LocalPort}); err != nil {
+		t.Fatal(err)
+	}
+	waitTunnel(t, client, "runtime")
+
+	web.LocalPort = localPort(t, newLocal.Listener)
+	added := ngrokc.TunnelOptions{Name: "added", Proto: util.PROTOCOL_HTTP, LocalPort: localPort(t, oldLocal.Listener)}
+	taken := ngrokc.TunnelOptions{Name: "taken", Proto: util.PROTOCOL_HTTP, Subdomain: "taken", LocalPort: 80}
+	// 重新请求被拒绝时保留旧的隧道，成功时替换旧的隧道
+	blog.Subdomain = "taken"
+	api.Subdomain = "v2"
+
+	if err := client.UpdateTunnels([]ngrokc.TunnelOptions{web, ssh, added, taken, blog, api}); err != nil {
+		t.Fatalf("UpdateTunnels: %v", err)
+	}
+
+	// 没有变化的隧道上的代理连接不受影响
+	echoed("after")
+
+	if body := get(t, http.DefaultClient, urls["web"]); body != "new local" {
+		t.Fatalf("GET web after update = %q, want new local target", body)
+	}
+
+	if body := get(t, http.DefaultClient, waitTunnel(t, client, "added")+"/added"); body != "hello /added" {
+		t.Fatalf("GET added = %q", body)
+	}
+
+	var updated map[string]connection.Tunnel
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		names := []string{}
+		updated = make(map[string]connection.Tunnel)
+		for _, tunnel := range client.Tunnels() {
+			names = append(names, tunnel.Name)
+			updated[tunnel.Name] = tunnel
+		}
+
+		// old 被删除，taken 请求失败后被删除，api 的新隧道建立，控制连接没有关闭
+		if strings.Join(names, ",") == "added,api,blog,runtime,ssh,web" && updated["api"].Subdomain == "v2" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnels after update = %v", names)
+		}
+	}
+
+	if blog := updated["blog"]; blog.Url != urls["blog"] || blog.Subdomain != "" {
+		t.Fatalf("blog after rejected update = %s %q, want the old tunnel %s", blog.Url, blog.Subdomain, urls["blog"])
+	}
+
+	if body := get(t, http.DefaultClient, urls["blog"]+"/blog"); body != "hello /blog" {
+		t.Fatalf("GET blog after rejected update = %q", body)
+	}
+
+	if api := updated["api"]; api.Url == "" || api.Url == urls["api"] {
+		t.Fatalf("api after update = %q, want a new URL", api.Url)
+	}
+
+	if body := get(t, http.DefaultClient, updated["api"].Url+"/api"); body != "hello /api" {
+		t.Fatalf("GET api after update = %q", body)
+	}
+
+	if resp, err := http.Get(urls["old"]); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Fatal("removed tunnel still proxies")
+		}
+	}
+
+	echoed("still alive")
+
+	// 上次重新加载添加的隧道从配置中删除后被删除
+	if err := client.UpdateTunnels([]ngrokc.TunnelOptions{web, ssh}); err != nil {
+		t.Fatalf("UpdateTunnels: %v", err)
+	}
+
+	names := []string{}
+	for _, tunnel := range client.Tunnels() {
+		names = append(names, tunnel.Name)
+	}
+	if strings.Join(names, ",") != "runtime,ssh,web" {
+		t.Fatalf("tunnels after second update = %v", names)
+	}
+}
+
+func TestListenTunnelFailed(t *testing.T) {
+	server := startServer(t, func(server *testserver.Server) {
+		server.TunnelError = func(req util.ReqTunnel) string {
+			if req.Subdomain == "taken" {
+				return "subdomain taken"
+			}
+			return ""
+		}
+	})
+
+	client, _ := startClient(t, server, ngrokc.TunnelOptions{Name: "web", Proto: util.PROTOCOL_HTTP, LocalPort: 80})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.Listen(ctx, ngrokc.TunnelOptions{Name: "inproc", Proto: util.PROTOCOL_HTTP, Subdomain: "taken"})
+
+	if !errors.Is(err, errcode.ErrNewTunnel) {
+		t.Fatalf("Listen = %v, want ErrNewTunnel", err)
+	}
+
+	if len(client.Tunnels()) != 1 {
+		t.Fatalf("tunnels = %+v, want only web", client.Tunnels())
+	}
+}
+
+func TestShutdownDrainsProxies(t *testing.T) {
+	server := startServer(t, nil)
+
+	echo := echoServer(t)
+	defer echo.Close()
+
+	client, tunnels := startClient(t, server, ngrokc.TunnelOptions{Name: "echo", Proto: util.PROTOCOL_TCP, LocalPort: localPort(t, echo)})
+
+	visitor, err := net.Dial("tcp", publicAddr(tunnels[0].Url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+
+	visitor.SetDeadline(time.Now().Add(5 * time.Second))
+
+	echoed := func(message string) error {
+		if _, err := visitor.Write([]byte(message)); err != nil {
+			return err
+		}
+
+		buf := make([]byte, len(message))
+		if _, err := io.ReadFull(visitor, buf); err != nil {
+			return err
+		}
+
+		if string(buf) != message {
+			return fmt.Errorf("echo = %q", buf)
+		}
+
+		return nil
+	}
+
+	if err := echoed("before"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- client.Shutdown(ctx) }()
+
+	// 控制连接关闭后，服务器不再接受新的访问
+	for deadline := time.Now().Add(5 * time.Second); server.Sessions() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("control connection not closed")
+		}
+	}
+
+	if conn, err := net.Dial("tcp", publicAddr(tunnels[0].Url)); err == nil {
+		conn.Close()
+		t.Fatal("new visitor accepted while draining")
+	}
+
+	// 正在进行的代理连接继续传输
+	if err := echoed("during shutdown"); err != nil {
+		t.Fatalf("active proxy broken while draining: %v", err)
+	}
+
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned %v before the proxy finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	visitor.Close()
+
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("Shutdown = %v, want nil", err)
+	}
+
+	if err := client.Wait(); err != nil {
+		t.Fatalf("Wait = %v, want nil", err)
+	}
+}
+
+func TestShutdownGracePeriodExpired(t *testing.T) {
+	server := startServer(t, nil)
+
+	echo := echoServer(t)
+	defer echo.Close()
+
+	client, tunnels := startClient(t, server, ngrokc.TunnelOptions{Name: "echo", Proto: util.PROTOCOL_TCP, LocalPort: localPort(t, echo)})
+
+	visitor, err := net.Dial("tcp", publicAddr(tunnels[0].Url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+
+	visitor.SetDeadline(time.Now().Add(5 * time.Second))
+	visitor.Write([]byte("x"))
+	io.ReadFull(visitor, make([]byte, 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := client.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown = %v, want DeadlineExceeded", err)
+	}
+
+	// 被强制关闭的代理连接
+	if _, err := visitor.Read(make([]byte, 1)); err == nil {
+		t.Fatal("visitor still connected after force close")
+	}
+
+	if len(client.ControlConnection().Proxies()) != 0 {
+		t.Fatalf("proxies after shutdown: %+v", client.ControlConnection().Proxies())
+	}
+}
+
+// connectProxy() 记录连接次数的 HTTP CONNECT 代理
+func connectProxy(t *testing.T) (*url.URL, *atomic.Int32) {
+	t.Helper()
+
+	var connects atomic.Int32
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		connects.Add(1)
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+		go io.Copy(target, buf)
+		io.Copy(conn, target)
+	}))
+	t.Cleanup(proxy.Close)
+
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	return proxyURL, &connects
+}
+
+// TestTransports 控制连接和代理连接都经过代理、自定义的Dialer或者WebSocket网关，各种传输的细节由 transport 包的单元测试验证
+func TestTransports(t *testing.T) {
+	server := startServer(t, nil)
+
+	local := helloServer()
+	defer local.Close()
+
+	proxyURL, connects := connectProxy(t)
+
+	// 不使用网络，通过内存管道连接测试服务器
+	var dials atomic.Int32
+	pipe := transport.DialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+
+		clientConn, serverConn := net.Pipe()
+		server.ServeConn(serverConn)
+
+		return clientConn, nil
+	})
+
+	// 服务器端的网关，把WebSocket的数据转发给测试服务器
+	var upgrades atomic.Int32
+	gatewayHandler := transport.WebSocketGateway(net.JoinHostPort(server.Host(), fmt.Sprint(server.Port())))
+	gateway := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrades.Add(1)
+		gatewayHandler.ServeHTTP(w, r)
+	}))
+	defer gateway.Close()
+
+	roots := gateway.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	tests := []struct {
+		name      string
+		configure func(opts *ngrokc.Options)
+		// 经过代理、Dialer或者网关的连接数
+		count *atomic.Int32
+	}{
+		{"http connect proxy", func(opts *ngrokc.Options) { opts.Proxy = transport.FixedProxy(proxyURL) }, connects},
+		{"custom dialer", func(opts *ngrokc.Options) {
+			opts.ServerHostname, opts.ServerPort = "ngrok.invalid", 4443
+			opts.Dialer = &transport.TLSDialer{Base: pipe}
+		}, &dials},
+		{"websocket", func(opts *ngrokc.Options) {
+			opts.Dialer = &transport.TLSDialer{Base: &transport.WebSocketDialer{
+				URL:       "wss" + strings.TrimPrefix(gateway.URL, "https") + "/ngrok",
+				TLSConfig: &tls.Config{RootCAs: roots},
+			}}
+		}, &upgrades},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := ngrokc.Options{
+				ServerHostname: server.Host(),
+				ServerPort:     server.Port(),
+				Tunnels:        []ngrokc.TunnelOptions{{Name: "web", Proto: util.PROTOCOL_HTTP, LocalPort: localPort(t, local.Listener)}},
+			}
+			test.configure(&opts)
+
+			client := ngrokc.NewClient(opts)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			tunnels, err := client.Start(ctx)
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			defer client.Close()
+
+			if body := get(t, http.DefaultClient, tunnels[0].Url+"/transport"); body != "hello /transport" {
+				t.Fatalf("GET = %q", body)
+			}
+
+			// 控制连接和代理连接都经过
+			if n := test.count.Load(); n < 2 {
+				t.Fatalf("count = %d, want control and proxy connections", n)
+			}
+		})
+	}
+}
+
+// deadServer(t *testing.T) 一个没有服务器监听的地址
+func deadServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	return listener.Addr().String()
+}
+
+// silentServer(t *testing.T) 接受连接但是不回应的服务器
+func silentServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conns []net.Conn
+	var mutex sync.Mutex
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			conns = append(conns, conn)
+			mutex.Unlock()
+		}
+	}()
+
+	t.Cleanup(func() {
+		listener.Close()
+		mutex.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mutex.Unlock()
+	})
+
+	return listener.Addr().String()
+}
+
+func TestServerFailover(t *testing.T) {
+	rejecting := startServer(t, func(server *testserver.Server) {
+		server.AuthError = func(auth util.Auth) string { return "region disabled" }
+	})
+	healthy := startServer(t, nil)
+
+	local := helloServer()
+	defer local.Close()
+
+	dead := deadServer(t)
+
+	var failedMutex sync.Mutex
+	var failed []string
+
+	client := ngrokc.NewClient(ngrokc.Options{
+		Servers: []string{dead, rejecting.Addr(), healthy.Addr()},
+		Tunnels: []ngrokc.TunnelOptions{{Name: "web", Proto: util.PROTOCOL_HTTP, LocalPort: localPort(t, local.Listener)}},
+		Events: connection.Events{OnServerError: func(addr string, err error) {
+			failedMutex.Lock()
+			failed = append(failed, addr)
+			failedMutex.Unlock()
+		}},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tunnels, err := client.Start(ctx)
+	if err != nil {
+		t.Fatalf("Start with failover: %v", err)
+	}
+	defer client.Close()
+
+	if addr := client.ControlConnection().ServerAddress(); addr != healthy.Addr() {
+		t.Fatalf("ServerAddress = %s, want %s", addr, healthy.Addr())
+	}
+
+	failedMutex.Lock()
+	if len(failed) != 2 || failed[0] != dead || failed[1] != rejecting.Addr() {
+		t.Fatalf("OnServerError = %v", failed)
+	}
+	failedMutex.Unlock()
+
+	// 代理连接连接控制连接所在的服务器
+	if body := get(t, http.DefaultClient, tunnels[0].Url+"/failover"); body != "hello /failover" {
+		t.Fatalf("GET = %q", body)
+	}
+}
+
+func TestServerFailoverAfterDisconnect(t *testing.T) {
+	primary := startServer(t, nil)
+	secondary := startServer(t, nil)
+
+	local := helloServer()
+	defer local.Close()
+
+	var failedMutex sync.Mutex
+	var failed []string
+
+	client := ngrokc.NewClient(ngrokc.Options{
+		Servers: []string{primary.Addr(), secondary.Addr()},
+		Tunnels: []ngrokc.TunnelOptions{{Name: "web", Proto: util.PROTOCOL_HTTP, LocalPort: localPort(t, local.Listener)}},
+		Events: connection.Events{OnServerError: func(addr string, err error) {
+			failedMutex.Lock()
+			failed = append(failed, addr)
+			failedMutex.Unlock()
+		}},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tunnels, err := client.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// 会话建立之后主服务器宕机，切换到下一个服务器并重新请求隧道
+	primary.Close()
+
+	var url string
+	for deadline := time.Now().Add(5 * time.Second); url == ""; time.Sleep(10 * time.Millisecond) {
+		if client.ControlConnection().ServerAddress() == secondary.Addr() {
+			for _, tunnel := range client.Tunnels() {
+				if tunnel.Url != "" && tunnel.Url != tunnels[0].Url {
+					url = tunnel.Url
+				}
+			}
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("no failover after the primary went down, server = %s", client.ControlConnection().ServerAddress())
+		}
+	}
+
+	if body := get(t, http.DefaultClient, url+"/failover"); body != "hello /failover" {
+		t.Fatalf("GET after failover = %q", body)
+	}
+
+	failedMutex.Lock()
+	if len(failed) != 1 || failed[0] != primary.Addr() {
+		t.Fatalf("OnServerError = %v", failed)
+	}
+	failedMutex.Unlock()
+
+	// 其他服务器都失败时退出
+	secondary.Close()
+
+	if err := client.Wait(); !errors.Is(err, errcode.ErrConnectServer) {
+		t.Fatalf("Wait after all servers went down = %v, want ErrConnectServer", err)
+	}
+}
+
+func TestServerFailoverAllFailed(t *testing.T) {
+	rejecting := startServer(t, func(server *testserver.Server) {
+		server.AuthError = func(auth util.Auth) string { return "region disabled" }
+	})
+
+	client := ngrokc.NewClient(ngrokc.Options{
+		Servers: []string{rejecting.Addr(), deadServer(t)},
+		Tunnels: []ngrokc.TunnelOptions{{Name: "web", Proto: util.PROTOCOL_HTTP, LocalPort: 80}},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 返回最后一个服务器的错误
+	if _, err := client.Start(ctx); !errors.Is(err, errcode.ErrConnectServer) {
+		t.Fatalf("Start = %v, want ErrConnectServer", err)
+	}
+}
+
+func TestServerSelectionLatency(t *testing.T) {
+	healthy := startServer(t, nil)
+
+	client := ngrokc.NewClient(ngrokc.Options{
+		Servers:         []string{silentServer(t), deadServer(t), healthy.Addr()},
+		ServerSelection: connection.SERVER_SELECTION_LATENCY,
+		Tunnels:         []ngrokc.TunnelOptions{{Name: "web", Proto: util.PROTOCOL_HTTP, LocalPort: 80}},
+	})
+
+	// 不回应的服务器排在前面，按顺序连接时需要等待超时
+	ctx, cancel := context.WithTimeout(context.Background(), connection.ServerTimeout/2)
+	defer cancel()
+
+	if _, err := client.Start(ctx); err != nil {
+		t.Fatalf("Start with latency selection: %v", err)
+	}
+
+	if addr := client.ControlConnection().ServerAddress(); addr != healthy.Addr() {
+		t.Fatalf("ServerAddress = %s, want %s", addr, healthy.Addr())
+	}
+
+	client.Close()
+
+	if err := client.Wait(); err != nil {
+		t.Fatalf("Wait = %v", err)
+	}
+}
+
+// adminRequest(t *testing.T, client *http.Client, method, path, body string) 请求管理API，返回状态码和响应
+func adminRequest(t *testing.T, client *http.Client, method, path, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, "http://admin"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+
+	return resp.StatusCode, string(data)
+}
+
+func TestGroup(t *testing.T) {
+	internal := startServer(t, nil)
+	customer := startServer(t, func(server *testserver.Server) {
+		server.AuthError = func(auth util.Auth) string { return "expired token" }
+	})
+
+	local := helloServer()
+	defer local.Close()
+
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+
+	group, err := ngrokc.NewGroup([]ngrokc.Options{
+		{
+			Name:           "internal",
+			ServerHostname: internal.Host(),
+			ServerPort:     internal.Port(),
+			Tunnels:        []ngrokc.TunnelOptions{{Name: "web", Proto: util.PROTOCOL_HTTP, LocalPort: localPort(t, local.Listener)}},
+		},
+		{
+			Name:           "customer",
+			ServerHostname: customer.Host(),
+			ServerPort:     customer.Port(),
+			Tunnels:        []ngrokc.TunnelOptions{{Name: "web", Proto: util.PROTOCOL_HTTP, LocalPort: localPort(t, local.Listener)}},
+		},
+	}, "unix:"+socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 一个会话失败不影响其他会话
+	err = group.Start(ctx)
+	if !errors.Is(err, errcode.ErrAuthFailed) || !strings.Contains(err.Error(), "session customer") {
+		t.Fatalf("Start = %v, want auth error of session customer", err)
+	}
+
+	tunnels := group.Client("internal").Tunnels()
+	if body := get(t, http.DefaultClient, tunnels[0].Url+"/group"); body != "hello /group" {
+		t.Fatalf("GET = %q", body)
+	}
+
+	admin := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	if status, body := adminRequest(t, admin, http.MethodGet, "/api/sessions", ""); status != http.StatusOK ||
+		!strings.Contains(body, `"name":"internal","server_addr":"`+internal.Addr()+`","connected":true`) ||
+		!strings.Contains(body, `"name":"customer","server_addr":"","connected":false`) {
+		t.Fatalf("GET /api/sessions = %d %s", status, body)
+	}
+
+	if status, body := adminRequest(t, admin, http.MethodGet, "/api/tunnels", ""); status != http.StatusOK || !strings.Contains(body, `"session":"internal","name":"web"`) {
+		t.Fatalf("GET /api/tunnels = %d %s", status, body)
+	}
+
+	// 有多个会话时需要指定会话
+	if status, body := adminRequest(t, admin, http.MethodPost, "/api/tunnels", `{"name": "api", "proto": "http", "local_port": 8080}`); status != http.StatusBadRequest || !strings.Contains(body, "session is required") {
+		t.Fatalf("POST /api/tunnels without session = %d %s", status, body)
+	}
+
+	if status, body := adminRequest(t, admin, http.MethodGet, "/metrics", ""); status != http.StatusOK ||
+		!strings.Contains(body, `ngrokc_session_up{session="internal"} 1`) ||
+		!strings.Contains(body, `ngrokc_session_up{session="customer"} 0`) ||
+		!strings.Contains(body, `ngrokc_proxy_connections_total{session="internal"} 1`) {
+		t.Fatalf("GET /metrics = %d %s", status, body)
+	}
+
+	group.Close()
+
+	if err := group.Wait(); !errors.Is(err, errcode.ErrAuthFailed) {
+		t.Fatalf("Wait = %v, want auth error of session customer", err)
+	}
+}
+
+// TestTunnelOptions 隧道的选项是否从 TunnelOptions 传到代理连接上，每种选项的逻辑由 middleware、connection 和 usage 包的单元测试验证
+func TestTunnelOptions(t *testing.T) {
+	server := startServer(t, nil)
+
+	// 返回请求的路径、Host 和验证过的用户名
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.URL.Path, r.Host, r.Header.Get(middleware.USER_HEADER))
+	}))
+	defer local.Close()
+
+	port := localPort(t, local.Listener)
+
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, middleware.INDEX_FILE), []byte("<h1>docs</h1>"), 0644)
+	os.WriteFile(filepath.Join(root, ".env"), []byte("TOKEN=secret"), 0644)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	denyLocal, err := connection.ParseCIDRList([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ledger, err := usage.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ledger.Close()
+
+	registry := metrics.NewRegistry()
+
+	// webhook 请求，secret 为空时不签名
+	webhook := func(secret string) func(r *http.Request) {
+		return func(r *http.Request) {
+			const payload = `{"action":"opened"}`
+
+			r.Method = http.MethodPost
+			r.Body = io.NopCloser(strings.NewReader(payload))
+			r.ContentLength = int64(len(payload))
+
+			if secret != "" {
+				mac := hmac.New(sha256.New, []byte(secret))
+				mac.Write([]byte(payload))
+				r.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+			}
+		}
+	}
+
+	type request struct {
+		path   string
+		setup  func(r *http.Request)
+		status int
+		// 响应中应该包含的内容
+		want string
+	}
+
+	tests := []struct {
+		tunnel   ngrokc.TunnelOptions
+		requests []request
+	}{
+		{ngrokc.TunnelOptions{Name: "plain"}, []request{{"/plain", nil, http.StatusOK, "/plain "}}},
+		{ngrokc.TunnelOptions{Name: "headers", Headers: &middleware.Headers{Host: middleware.HOST_REWRITE}},
+			[]request{{"/", nil, http.StatusOK, "/ " + middleware.LocalAddress(port)}}},
+		{ngrokc.TunnelOptions{Name: "auth", Auth: &middleware.Auth{Users: map[string]string{"alice": string(hash)}}}, []request{
+			{"/", nil, http.StatusUnauthorized, ""},
+			{"/", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, http.StatusOK, "alice"},
+		}},
+		{ngrokc.TunnelOptions{Name: "webhook", Webhook: &middleware.Webhook{Provider: middleware.WEBHOOK_GITHUB, Secret: "s3cret"}}, []request{
+			{"/hook", webhook(""), http.StatusUnauthorized, ""},
+			{"/hook", webhook("guessed"), http.StatusUnauthorized, ""},
+			{"/hook", webhook("s3cret"), http.StatusOK, "/hook"},
+		}},
+		{ngrokc.TunnelOptions{Name: "files", Root: root}, []request{
+			{"/", nil, http.StatusOK, "<h1>docs</h1>"},
+			{"/.env", nil, http.StatusNotFound, ""},
+		}},
+		{ngrokc.TunnelOptions{Name: "cidr", DenyCIDRs: denyLocal}, []request{{"/", nil, http.StatusForbidden, "client address not allowed: 127.0.0.1"}}},
+		{ngrokc.TunnelOptions{Name: "visitors", VisitorRate: 1, VisitorBurst: 1}, []request{
+			{"/", nil, http.StatusOK, ""},
+			{"/", nil, http.StatusTooManyRequests, ""},
+		}},
+		// 第一个请求和响应用完配额
+		{ngrokc.TunnelOptions{Name: "quota", DailyQuota: 200}, []request{
+			{"/", nil, http.StatusOK, ""},
+			{"/", nil, http.StatusForbidden, "traffic quota exceeded"},
+		}},
+		// 请求超过突发，需要等待
+		{ngrokc.TunnelOptions{Name: "bandwidth", BandwidthLimit: 64 * 1024, BandwidthBurst: 64}, []request{{"/", nil, http.StatusOK, ""}}},
+	}
+
+	var tunnels []ngrokc.TunnelOptions
+	for _, test := range tests {
+		tunnel := test.tunnel
+		tunnel.Proto = util.PROTOCOL_HTTP
+		tunnel.LocalPort = port
+		tunnels = append(tunnels, tunnel)
+	}
+
+	client := ngrokc.NewClient(ngrokc.Options{
+		Name:           "options",
+		ServerHostname: server.Host(),
+		ServerPort:     server.Port(),
+		Usage:          ledger,
+		Metrics:        registry,
+		Tunnels:        tunnels,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	established, err := client.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	urls := make(map[string]string)
+	for _, tunnel := range established {
+		urls[tunnel.Name] = tunnel.Url
+	}
+
+	// 每个请求使用新的代理连接
+	visitor := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	for _, test := range tests {
+		t.Run(test.tunnel.Name, func(t *testing.T) {
+			for i, request := range test.requests {
+				req, _ := http.NewRequest(http.MethodGet, urls[test.tunnel.Name]+request.path, nil)
+				if request.setup != nil {
+					request.setup(req)
+				}
+
+				resp, err := visitor.Do(req)
+				if err != nil {
+					t.Fatalf("request %d: %v", i, err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+
+				if resp.StatusCode != request.status || !strings.Contains(string(body), request.want) {
+					t.Fatalf("request %d: %s %s = %d %q, want %d %q", i, req.Method, request.path, resp.StatusCode, body, request.status, request.want)
+				}
+			}
+		})
+	}
+
+	var text strings.Builder
+	registry.WriteText(&text)
+
+	if !strings.Contains(text.String(), `ngrokc_throttled_seconds_total{direction="`+connection.DIRECTION_INBOUND+`",session="options",tunnel="bandwidth"}`) {
+		t.Fatalf("bandwidth tunnel was not throttled:\n%s", text.String())
+	}
+
+	if web := ledger.Tunnels("options")["quota"]; web.Connections != 1 || web.DayBytes < 200 {
+		t.Fatalf("quota usage = %+v", web)
+	}
+}
+
+func TestAuthFailed(t *testing.T) {
+	server := startServer(t, func(server *testserver.Server) {
+		server.AuthError = func(auth util.Auth) string { return "bad password for " + auth.User }
+	})
+
+	client := newClient(server, ngrokc.TunnelOptions{Name: "web", Proto: util.PROTOCOL_HTTP, LocalPort: 80})
+
+	_, err := client.Start(context.Background())
+
+	if !errors.Is(err, errcode.ErrAuthFailed) {
+		t.Fatalf("Start = %v, want ErrAuthFailed", err)
+	}
+
+	var e *errcode.Error
+	if !errors.As(err, &e) || e.Msg != "bad password for user" {
+		t.Fatalf("Start = %#v, want server message", err)
+	}
+}
+
+func TestNewTunnelFailed(t *testing.T) {
+	server := startServer(t, func(server *testserver.Server) {
+		server.TunnelError = func(req util.ReqTunnel) string { return "subdomain " + req.Subdomain + " taken" }
+	})
+
+	client := newClient(server, ngrokc.TunnelOptions{Name: "web", Proto: util.PROTOCOL_HTTP, Subdomain: "demo", LocalPort: 80})
+
+	_, err := client.Start(context.Background())
+
+	var e *errcode.Error
+	if !errors.Is(err, errcode.ErrNewTunnel) || !errors.As(err, &e) || e.Tunnel != "web" || e.Msg != "subdomain demo taken" {
+		t.Fatalf("Start = %v, want ErrNewTunnel for tunnel web", err)
+	}
+
+	if client.Wait() != err {
+		t.Fatalf("Wait = %v, want %v", client.Wait(), err)
+	}
+}
+
+func TestStartContextCanceled(t *testing.T) {
+	server := startServer(t, func(server *testserver.Server) {
+		server.Delay = 300 * time.Millisecond
+	})
+
+	client := newClient(server, ngrokc.TunnelOptions{Name: "web", Proto: util.PROTOCOL_HTTP, LocalPort: 80})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := client.Start(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Start = %v, want DeadlineExceeded", err)
+	}
+
+	if err := client.Wait(); err != nil {
+		t.Fatalf("Wait = %v, want nil after Close", err)
+	}
+}
+
+// TestSessionErrors 服务器断开或者发送无效的帧时，会话结束并返回对应的错误
+func TestSessionErrors(t *testing.T) {
+	nullPayload := `{"Type":"NewTunnel","Payload":null}`
+
+	tests := []struct {
+		name string
+		send func(server *testserver.Server)
+		want error
+	}{
+		{"disconnect", func(server *testserver.Server) { server.Disconnect() }, errcode.ErrSessionClosed},
+		{"malformed", func(server *testserver.Server) { server.WriteRaw(append(util.LenToBytes(5), "{bad}"...)) }, errcode.ErrBytesToPayload},
+		{"null payload", func(server *testserver.Server) {
+			server.WriteRaw(append(util.LenToBytes(uint16(len(nullPayload))), nullPayload...))
+		}, errcode.ErrUnknowResp},
+		{"oversized", func(server *testserver.Server) { server.WriteRaw([]byte{0xff, 0xff, 0xff, 0x7f, 0, 0, 0, 0}) }, errcode.ErrBytesToPayload},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := startServer(t, nil)
+
+			client, _ := startClient(t, server, ngrokc.TunnelOptions{Name: "web", Proto: util.PROTOCOL_HTTP, LocalPort: 80})
+
+			test.send(server)
+
+			if err := client.Wait(); !errors.Is(err, test.want) {
+				t.Fatalf("Wait = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestConcurrentClose(t *testing.T) {
+	server := startServer(t, nil)
+
+	local := helloServer()
+	defer local.Close()
+
+	client, tunnels := startClient(t, server, ngrokc.TunnelOptions{Name: "web", Proto: util.PROTOCOL_HTTP, LocalPort: localPort(t, local.Listener)})
+
+	var wg sync.WaitGroup
+
+	// 在代理连接进行中并发关闭
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp, err := http.Get(tunnels[0].Url); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Close()
+		}()
+	}
+
+	wg.Wait()
+
+	if err := client.Wait(); err != nil {
+		t.Fatalf("Wait = %v, want nil after Close", err)
+	}
+}
@@ -1,49 +1,97 @@
 package err
 
-const (
-	ERR_SUCCESS = 0
+import (
+	"errors"
+	"strings"
+)
+
+// 错误的类型，可以通过 errors.Is(err, ErrXXX) 判断
+var (
+	// 连接服务器失败
+	ErrConnectServer = errors.New("failed to connect server")
+
+	// 连接被服务器断开，或者读写出错
+	ErrSessionClosed = errors.New("session closed")
 
 	// 未知的响应
-	ERR_UNKNOW_RESP = -100
+	ErrUnknowResp = errors.New("unknow response")
 
 	// 验证失败
-	ERR_AUTH_FAILED = -101
+	ErrAuthFailed = errors.New("auth failed")
 
 	// ReqTunnel 请求失败, 返回的NewTunnel中含有错误信息
-	ERR_NEW_TUNNEL_ERROR = -102
+	ErrNewTunnel = errors.New("new tunnel request error")
 
 	// 不是客户端代理的URL
-	ERR_UNKNOW_PROXY_URL = -103
+	ErrUnknowProxyUrl = errors.New("unknow proxy url")
 
 	// 代理连接，连接本地端口失败
-	ERR_CONNECT_LOCAL_FAILED = -104
+	ErrConnectLocalFailed = errors.New("ngrok proxy failed to connect local service")
+
+	// 代理连接被拒绝(例如超过流量配额)，没有连接本地服务
+	ErrProxyRejected = errors.New("proxy connection rejected")
+
+	// 访问者的地址不在隧道允许的范围内
+	ErrClientNotAllowed = errors.New("client address not allowed")
+
+	// 访问者新建代理连接太快或者同时进行的代理连接太多
+	ErrTooManyConnections = errors.New("too many connections from client")
 
 	// 从结构体转为字节时出错
-	ERR_PAYLOAD_TO_BYTES = -105
+	ErrPayloadToBytes = errors.New("failed from payload to bytes")
 
 	// 从字节转为结构体时出错
-	ERR_BYTES_TO_PAYLOAD = -106
+	ErrBytesToPayload = errors.New("failed from bytes to payload")
 )
 
-func GetErrMsg(errno int) string {
-	switch errno {
-	case ERR_SUCCESS:
-		return "Success"
-	case ERR_UNKNOW_RESP:
-		return "Unknow response"
-	case ERR_AUTH_FAILED:
-		return "Auth failed"
-	case ERR_NEW_TUNNEL_ERROR:
-		return "New tunnel request error"
-	case ERR_UNKNOW_PROXY_URL:
-		return "Unknow proxy url"
-	case ERR_CONNECT_LOCAL_FAILED:
-		return "Ngrok proxy failed to connect local service"
-	case ERR_PAYLOAD_TO_BYTES:
-		return "Failed from payload to bytes"
-	case ERR_BYTES_TO_PAYLOAD:
-		return "Failed from bytes to payload"
-	default:
-		return "Unknow error code, please check!!!"
+// Error 带上下文的错误，可以通过 errors.As(err, &e) 获取
+type Error struct {
+	// 错误的类型，上面定义的 ErrXXX 之一
+	Kind error
+
+	// 出错的隧道名字或者URL，可以为空
+	Tunnel string
+
+	// 服务器返回的错误信息(AuthResp.Error, NewTunnel.Error)，可以为空
+	Msg string
+
+	// 底层的错误，可以为nil
+	Err error
+}
+
+// New(kind error, msg string) 创建一个带服务器错误信息的错误
+func New(kind error, msg string) *Error {
+	return &Error{Kind: kind, Msg: msg}
+}
+
+// Wrap(kind error, err error) 创建一个带底层错误的错误
+func Wrap(kind error, err error) *Error {
+	return &Error{Kind: kind, Err: err}
+}
+
+func (e *Error) Error() string {
+	parts := []string{e.Kind.Error()}
+
+	if e.Tunnel != "" {
+		parts = append(parts, "tunnel "+e.Tunnel)
+	}
+
+	if e.Msg != "" {
+		parts = append(parts, e.Msg)
+	}
+
+	if e.Err != nil {
+		parts = append(parts, e.Err.Error())
+	}
+
+	return strings.Join(parts, ": ")
+}
+
+// Unwrap() 同时支持 errors.Is(err, ErrXXX) 和判断底层错误
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
 	}
+
+	return []error{e.Kind, e.Err}
 }
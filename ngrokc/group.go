@@ -0,0 +1,185 @@
+package ngrokc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ngrok-client/ngrokc/admin"
+	"ngrok-client/ngrokc/metrics"
+	"sync"
+)
+
+// Group 在同一个进程中运行的多个独立会话，每个会话有自己的服务器、验证信息和隧道，
+// 共用指标和本地管理API；一个会话失败或者断开不影响其他会话
+type Group struct {
+	clients []*Client
+
+	// 所有会话共用的指标
+	metrics *metrics.Registry
+
+	adminAddr   string
+	adminServer *admin.Server
+
+	// 管理API开启成功，所有会话已经开始连接
+	started bool
+
+	closeOnce sync.Once
+}
+
+// NewGroup(sessions []Options, adminAddr string) 为每个会话创建一个Client，会话的名字必须唯一
+// 所有会话的指标记录在同一个 Registry 中，adminAddr 不为空时开启管理所有会话的管理API，会话自己的 AdminAddr 被忽略
+func NewGroup(sessions []Options, adminAddr string) (*Group, error) {
+	group := &Group{metrics: metrics.NewRegistry(), adminAddr: adminAddr}
+
+	names := make(map[string]bool)
+
+	for _, opts := range sessions {
+		if names[opts.Name] {
+			return nil, fmt.Errorf("duplicate session name %q", opts.Name)
+		}
+		names[opts.Name] = true
+
+		opts.AdminAddr = ""
+		opts.Metrics = group.metrics
+
+		group.clients = append(group.clients, NewClient(opts))
+	}
+
+	return group, nil
+}
+
+// Start(ctx context.Context) 开启管理API并同时启动所有会话，等待所有会话建立隧道或者失败后返回
+// 返回所有启动失败的会话的错误，启动成功的会话继续运行；所有会话都失败时关闭Group
+func (group *Group) Start(ctx context.Context) error {
+	if group.adminAddr != "" {
+		group.adminServer = &admin.Server{}
+		group.adminServer.Init(group.adminAddr, nil)
+		group.adminServer.Metrics = group.metrics
+
+		// 会话共用的流量统计
+		for _, client := range group.clients {
+			if client.opts.Usage != nil {
+				group.adminServer.Usage = client.opts.Usage
+			}
+		}
+
+		for _, client := range group.clients {
+			group.adminServer.AddSession(client.Name(), client.ControlConnection())
+		}
+
+		if err := group.adminServer.Start(); err != nil {
+			return err
+		}
+	}
+
+	group.started = true
+
+	errs := make([]error, len(group.clients))
+
+	var wg sync.WaitGroup
+	for i, client := range group.clients {
+		wg.Add(1)
+		go func(i int, client *Client) {
+			defer wg.Done()
+
+			if _, err := client.Start(ctx); err != nil {
+				errs[i] = fmt.Errorf("session %s: %w", client.Name(), err)
+			}
+		}(i, client)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+
+	if failed == len(group.clients) {
+		group.Close()
+	}
+
+	return errors.Join(errs...)
+}
+
+// Clients() 所有会话的Client，顺序和 NewGroup() 中的一致
+func (group *Group) Clients() []*Client {
+	return group.clients
+}
+
+// Client(name string) 根据名字查找会话，找不到时返回nil
+func (group *Group) Client(name string) *Client {
+	for _, client := range group.clients {
+		if client.Name() == name {
+			return client
+		}
+	}
+
+	return nil
+}
+
+// Metrics() 所有会话共用的指标
+func (group *Group) Metrics() *metrics.Registry {
+	return group.metrics
+}
+
+// Wait() 阻塞直到所有会话都结束，返回所有会话的错误
+func (group *Group) Wait() error {
+	var errs []error
+
+	for _, client := range group.clients {
+		if err := client.Wait(); err != nil {
+			errs = append(errs, fmt.Errorf("session %s: %w", client.Name(), err))
+		}
+	}
+
+	group.closeAdmin()
+
+	return errors.Join(errs...)
+}
+
+// Shutdown(ctx context.Context) 同时优雅关闭所有会话，有会话的代理连接被强制关闭时返回 ctx.Err()
+func (group *Group) Shutdown(ctx context.Context) error {
+	group.closeAdmin()
+
+	errs := make([]error, len(group.clients))
+
+	var wg sync.WaitGroup
+	for i, client := range group.clients {
+		wg.Add(1)
+		go func(i int, client *Client) {
+			defer wg.Done()
+			errs[i] = client.Shutdown(ctx)
+		}(i, client)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close() 关闭所有会话和管理API，可以重复调用
+func (group *Group) Close() error {
+	group.closeAdmin()
+
+	for _, client := range group.clients {
+		client.Close()
+	}
+
+	return nil
+}
+
+// closeAdmin() 关闭管理API
+func (group *Group) closeAdmin() {
+	group.closeOnce.Do(func() {
+		if group.adminServer != nil {
+			group.adminServer.Close()
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 指标的类型
+const (
+	TYPE_COUNTER = "counter"
+	TYPE_GAUGE   = "gauge"
+)
+
+// Registry 一组指标，多个会话可以共用，以 Prometheus 的文本格式输出
+// nil 的 Registry 也可以使用，返回的 Value 不会被输出
+type Registry struct {
+	mutex    sync.Mutex
+	families map[string]*family
+}
+
+// family 同名的一组指标，不同的标签对应不同的值
+type family struct {
+	name   string
+	help   string
+	kind   string
+	series map[string]*Value
+}
+
+// Value 一个指标的值，可以在多个goroutine中同时修改
+type Value struct {
+	bits atomic.Uint64
+}
+
+// NewRegistry() 创建一个空的 Registry
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Counter(name, help string, labels ...string) 获取一个只增加的计数器，labels 为 key, value 交替的标签
+// 同样的名字和标签返回同一个 Value
+func (registry *Registry) Counter(name, help string, labels ...string) *Value {
+	return registry.value(name, help, TYPE_COUNTER, labels)
+}
+
+// Gauge(name, help string, labels ...string) 获取一个可以增加和减少的值，labels 为 key, value 交替的标签
+func (registry *Registry) Gauge(name, help string, labels ...string) *Value {
+	return registry.value(name, help, TYPE_GAUGE, labels)
+}
+
+// value() 查找或者创建一个指标
+func (registry *Registry) value(name, help, kind string, labels []string) *Value {
+	if registry == nil {
+		return &Value{}
+	}
+
+	if len(labels)%2 != 0 {
+		panic("metrics: labels must be key, value pairs")
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	f, ok := registry.families[name]
+	if !ok {
+		f = &family{name: name, help: help, kind: kind, series: make(map[string]*Value)}
+		registry.families[name] = f
+	} else if f.kind != kind {
+		panic("metrics: " + name + " registered as " + f.kind)
+	}
+
+	key := formatLabels(labels)
+
+	value, ok := f.series[key]
+	if !ok {
+		value = &Value{}
+		f.series[key] = value
+	}
+
+	return value
+}
+
+// formatLabels(labels []string) 按key排序后格式化为 {k1="v1",k2="v2"}
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+
+	sort.Strings(pairs)
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// WriteText(w io.Writer) 以 Prometheus 的文本格式输出所有指标，按名字和标签排序
+func (registry *Registry) WriteText(w io.Writer) error {
+	registry.mutex.Lock()
+
+	names := make([]string, 0, len(registry.families))
+	for name := range registry.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+
+	for _, name := range names {
+		f := registry.families[name]
+
+		fmt.Fprintf(&builder, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(&builder, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			fmt.Fprintf(&builder, "%s%s %s\n", f.name, key, strconv.FormatFloat(f.series[key].Get(), 'g', -1, 64))
+		}
+	}
+
+	registry.mutex.Unlock()
+
+	_, err := io.WriteString(w, builder.String())
+	return err
+}
+
+// Add(delta float64) 增加delta，计数器的delta不能为负数
+func (value *Value) Add(delta float64) {
+	for {
+		old := value.bits.Load()
+		if value.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+// Inc() 增加1
+func (value *Value) Inc() {
+	value.Add(1)
+}
+
+// Dec() 减少1，只用于Gauge
+func (value *Value) Dec() {
+	value.Add(-1)
+}
+
+// Set(v float64) 设置为v，只用于Gauge
+func (value *Value) Set(v float64) {
+	value.bits.Store(math.Float64bits(v))
+}
+
+// Get() 获取当前的值
+func (value *Value) Get() float64 {
+	return math.Float64frombits(value.bits.Load())
+}
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+
+	registry.Counter("ngrokc_proxy_connections_total", "Proxy connections started.", "session", "b").Add(2)
+	registry.Counter("ngrokc_proxy_connections_total", "Proxy connections started.", "session", "a").Inc()
+
+	active := registry.Gauge("ngrokc_proxy_connections_active", "Proxy connections in progress.", "session", "a", "tunnel", `we"b`)
+	active.Inc()
+	active.Inc()
+	active.Dec()
+
+	// 同样的名字和标签返回同一个值，标签的顺序不影响
+	if value := registry.Gauge("ngrokc_proxy_connections_active", "", "tunnel", `we"b`, "session", "a"); value != active {
+		t.Fatal("same labels returned a different value")
+	}
+
+	var builder strings.Builder
+	if err := registry.WriteText(&builder); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP ngrokc_proxy_connections_active Proxy connections in progress.
+# TYPE ngrokc_proxy_connections_active gauge
+ngrokc_proxy_connections_active{session="a",tunnel="we\"b"} 1
+# HELP ngrokc_proxy_connections_total Proxy connections started.
+# TYPE ngrokc_proxy_connections_total counter
+ngrokc_proxy_connections_total{session="a"} 1
+ngrokc_proxy_connections_total{session="b"} 2
+`
+	if builder.String() != want {
+		t.Fatalf("WriteText =\n%s\nwant\n%s", builder.String(), want)
+	}
+}
+
+func TestRegistryKindConflict(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("requests_total", "")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a counter as gauge did not panic")
+		}
+	}()
+
+	registry.Gauge("requests_total", "")
+}
+
+func TestNilRegistry(t *testing.T) {
+	var registry *Registry
+
+	value := registry.Counter("requests_total", "", "session", "a")
+	value.Add(1.5)
+
+	if value.Get() != 1.5 {
+		t.Fatalf("Get = %v", value.Get())
+	}
+}
+
+func TestValueConcurrent(t *testing.T) {
+	value := &Value{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				value.Add(0.5)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value.Get() != 4000 {
+		t.Fatalf("Get = %v, want 4000", value.Get())
+	}
+}
@@ -0,0 +1,232 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 验证通过后设置的请求头，值为用户名或者 OAuth 登录的邮箱；访问者自己发送的这个头会被删除
+const USER_HEADER = "X-Forwarded-User"
+
+// 缓存的验证通过的用户名和密码的最大数量，超过后清空
+const maxCachedCredentials = 1024
+
+// Auth HTTP隧道在客户端验证访问者，验证失败的请求不会转发给本地服务
+// 配置了多种方式时满足其中一种即可；都没有配置时拒绝所有请求
+type Auth struct {
+	// 401 响应中的 realm，为空时为 ngrok
+	Realm string
+
+	// Basic 验证的用户，用户名 -> bcrypt 哈希，可以用 LoadHtpasswd 读取
+	Users map[string]string
+
+	// 允许的 Bearer token
+	BearerTokens []string
+
+	// OAuth2/OIDC 登录，为nil时不使用
+	OAuth *OAuth
+}
+
+// LoadHtpasswd(path string) 读取 htpasswd 文件，每行为 user:hash，只支持 bcrypt(htpasswd -B)
+// 空行和 # 开头的行被忽略
+func LoadHtpasswd(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: not in the form user:hash", path, line)
+		}
+
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: user %s: only bcrypt passwords are supported", path, line, user)
+		}
+
+		if _, ok := users[user]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate user %s", path, line, user)
+		}
+
+		users[user] = hash
+	}
+
+	return users, scanner.Err()
+}
+
+// authenticator 一个隧道的验证状态
+type authenticator struct {
+	auth *Auth
+
+	// Bearer token 的 sha256，比较时长度固定
+	tokens [][sha256.Size]byte
+
+	// bcrypt 很慢，缓存验证通过的 用户名+密码 的 sha256
+	mutex    sync.Mutex
+	verified map[[sha256.Size]byte]bool
+}
+
+// Middleware(publicProto string) 验证访问者的中间件，publicProto 为隧道的公网协议 http/https
+// 使用的 Authorization 头和 OAuth 的 cookie 不会转发给本地服务
+func (auth *Auth) Middleware(publicProto string) Middleware {
+	a := &authenticator{auth: auth, verified: make(map[[sha256.Size]byte]bool)}
+
+	for _, token := range auth.BearerTokens {
+		a.tokens = append(a.tokens, sha256.Sum256([]byte(token)))
+	}
+
+	var oauth *oauthHandler
+	if auth.OAuth != nil {
+		oauth = newOAuthHandler(auth.OAuth, publicProto)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Del(USER_HEADER)
+
+			if oauth != nil && r.URL.Path == OAUTH_CALLBACK_PATH {
+				oauth.callback(w, r)
+				return
+			}
+
+			user, ok := a.authorization(r)
+
+			if !ok && oauth != nil {
+				user, ok = oauth.session(r)
+			}
+
+			if !ok {
+				// 浏览器访问时跳转到登录页面
+				if oauth != nil && r.Header.Get("Authorization") == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+					oauth.login(w, r)
+					return
+				}
+
+				a.unauthorized(w)
+				return
+			}
+
+			if user != "" {
+				r.Header.Set(USER_HEADER, user)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authorization(r *http.Request) 验证 Authorization 头中的 Basic 或者 Bearer 凭据，通过时删除这个头
+// 返回用户名(Bearer 为空)和是否通过
+func (a *authenticator) authorization(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", false
+	}
+
+	scheme, credentials, _ := strings.Cut(header, " ")
+	credentials = strings.TrimSpace(credentials)
+
+	var user string
+	var ok bool
+
+	switch {
+	case strings.EqualFold(scheme, "Basic"):
+		var password string
+		if user, password, ok = r.BasicAuth(); ok {
+			ok = a.checkUser(user, password)
+		}
+	case strings.EqualFold(scheme, "Bearer"):
+		ok = a.checkToken(credentials)
+	}
+
+	if ok {
+		r.Header.Del("Authorization")
+	}
+
+	return user, ok
+}
+
+// checkUser(user, password string) 验证用户名和密码
+func (a *authenticator) checkUser(user, password string) bool {
+	hash, ok := a.auth.Users[user]
+	if !ok {
+		return false
+	}
+
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+
+	a.mutex.Lock()
+	verified := a.verified[key]
+	a.mutex.Unlock()
+
+	if verified {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+
+	a.mutex.Lock()
+	if len(a.verified) >= maxCachedCredentials {
+		a.verified = make(map[[sha256.Size]byte]bool)
+	}
+	a.verified[key] = true
+	a.mutex.Unlock()
+
+	return true
+}
+
+// checkToken(token string) 验证 Bearer token，比较时间和 token 的内容无关
+func (a *authenticator) checkToken(token string) bool {
+	if token == "" {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(token))
+
+	ok := false
+	for _, allowed := range a.tokens {
+		if subtle.ConstantTimeCompare(sum[:], allowed[:]) == 1 {
+			ok = true
+		}
+	}
+
+	return ok
+}
+
+// unauthorized(w http.ResponseWriter) 返回 401，按配置的验证方式设置 WWW-Authenticate
+func (a *authenticator) unauthorized(w http.ResponseWriter) {
+	realm := a.auth.Realm
+	if realm == "" {
+		realm = "ngrok"
+	}
+
+	if len(a.auth.Users) > 0 {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm))
+	}
+
+	if len(a.tokens) > 0 {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", realm))
+	}
+
+	http.Error(w, "ngrok client authentication required", http.StatusUnauthorized)
+}
@@ -0,0 +1,303 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// seenUser 返回本地服务看到的 X-Forwarded-User、Authorization 和 Cookie
+var seenUser = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(r.Header.Get(USER_HEADER) + "|" + r.Header.Get("Authorization") + "|" + r.Header.Get("Cookie")))
+})
+
+func TestLoadHtpasswd(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "htpasswd")
+	os.WriteFile(path, []byte("# users\nalice:"+string(hash)+"\n\nbob:"+strings.Replace(string(hash), "$2a$", "$2y$", 1)+"\n"), 0600)
+
+	users, err := LoadHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(users) != 2 || users["alice"] != string(hash) {
+		t.Fatalf("users = %v", users)
+	}
+
+	for content, want := range map[string]string{
+		"carol:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n":                "only bcrypt passwords are supported",
+		"alice:" + string(hash) + "\nalice:" + string(hash) + "\n": "duplicate user alice",
+		"no-separator\n": "not in the form user:hash",
+	} {
+		os.WriteFile(path, []byte(content), 0600)
+
+		if _, err := LoadHtpasswd(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("LoadHtpasswd(%q) = %v, want %q", content, err, want)
+		}
+	}
+}
+
+func TestBasicAndBearerAuth(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	auth := &Auth{
+		Users:        map[string]string{"alice": string(hash)},
+		BearerTokens: []string{"token-1", "token-2"},
+	}
+	handler := Chain(seenUser, auth.Middleware("https"))
+
+	request := func(setup func(r *http.Request)) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "https://demo.ngrok.example.com/", nil)
+		r.Header.Set(USER_HEADER, "spoofed")
+		setup(r)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := request(func(r *http.Request) { r.SetBasicAuth("alice", "secret") })
+		if w.Code != http.StatusOK || w.Body.String() != "alice||" {
+			t.Fatalf("basic auth: %d %q", w.Code, w.Body.String())
+		}
+	}
+
+	w := request(func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-2") })
+	if w.Code != http.StatusOK || w.Body.String() != "||" {
+		t.Fatalf("bearer: %d %q", w.Code, w.Body.String())
+	}
+
+	for name, setup := range map[string]func(r *http.Request){
+		"no credentials": func(r *http.Request) {},
+		"wrong password": func(r *http.Request) { r.SetBasicAuth("alice", "wrong") },
+		"unknown user":   func(r *http.Request) { r.SetBasicAuth("mallory", "secret") },
+		"wrong token":    func(r *http.Request) { r.Header.Set("Authorization", "Bearer token-3") },
+		"empty token":    func(r *http.Request) { r.Header.Set("Authorization", "Bearer ") },
+	} {
+		w := request(setup)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: status %d, want 401", name, w.Code)
+		}
+
+		challenges := w.Header().Values("WWW-Authenticate")
+		if len(challenges) != 2 || !strings.HasPrefix(challenges[0], `Basic realm="ngrok"`) || challenges[1] != `Bearer realm="ngrok"` {
+			t.Fatalf("%s: WWW-Authenticate = %q", name, challenges)
+		}
+	}
+
+	// 没有配置验证方式时拒绝所有请求
+	w = httptest.NewRecorder()
+	Chain(seenUser, (&Auth{}).Middleware("https")).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("empty auth: status %d, want 401", w.Code)
+	}
+}
+
+// oidcProvider 本地的 OIDC 授权服务器，授权时不需要登录，直接跳转回来
+func oidcProvider(t *testing.T, email string) (*httptest.Server, *atomic.Int32) {
+	var exchanges atomic.Int32
+	mux := http.NewServeMux()
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	mux.HandleFunc(oidcDiscoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"userinfo_endpoint":      server.URL + "/userinfo",
+		})
+	})
+
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("client_id") != "tunnel-client" || query.Get("response_type") != "code" || query.Get("scope") != "openid email profile" {
+			http.Error(w, "bad authorize request", http.StatusBadRequest)
+			return
+		}
+
+		redirect := query.Get("redirect_uri") + "?" + url.Values{"code": {"code-123"}, "state": {query.Get("state")}}.Encode()
+		http.Redirect(w, r, redirect, http.StatusFound)
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if r.Method != http.MethodPost || id != "tunnel-client" || secret != "client-secret" || r.PostFormValue("code") != "code-123" ||
+			!strings.HasSuffix(r.PostFormValue("redirect_uri"), OAUTH_CALLBACK_PATH) {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		exchanges.Add(1)
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "access-123", "token_type": "Bearer"})
+	})
+
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-123" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"sub": "user-1", "email": email, "email_verified": true})
+	})
+
+	return server, &exchanges
+}
+
+func TestOAuth(t *testing.T) {
+	provider, exchanges := oidcProvider(t, "alice@example.com")
+
+	auth := &Auth{OAuth: &OAuth{
+		Issuer:       provider.URL,
+		ClientID:     "tunnel-client",
+		ClientSecret: "client-secret",
+		AllowDomains: []string{"example.com"},
+	}}
+
+	tunnel := httptest.NewServer(Chain(seenUser, auth.Middleware("http")))
+	defer tunnel.Close()
+
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Jar: jar}
+
+	// 登录后回到原来的地址，session cookie 不会转发给本地服务
+	tunnelURL, _ := url.Parse(tunnel.URL)
+	jar.SetCookies(tunnelURL, []*http.Cookie{{Name: "app", Value: "1"}})
+
+	resp, err := browser.Get(tunnel.URL + "/private?page=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readBody(t, resp)
+
+	if resp.StatusCode != http.StatusOK || body != "alice@example.com||app=1" {
+		t.Fatalf("after login: %d %q", resp.StatusCode, body)
+	}
+
+	if resp.Request.URL.RequestURI() != "/private?page=2" {
+		t.Fatalf("redirected back to %s", resp.Request.URL.RequestURI())
+	}
+
+	// 已经登录，不需要再次获取 token
+	resp, err = browser.Get(tunnel.URL + "/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); body != "alice@example.com||app=1" || exchanges.Load() != 1 {
+		t.Fatalf("second request: %q, %d exchanges", body, exchanges.Load())
+	}
+
+	// 伪造的 session cookie
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.AddCookie(&http.Cookie{Name: OAUTH_SESSION_COOKIE, Value: "YWxpY2U.9999999999.forged"})
+	w := httptest.NewRecorder()
+	Chain(seenUser, auth.Middleware("http")).ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("forged session: status %d, want 401", w.Code)
+	}
+
+	// 没有 state cookie 的回调
+	resp, err = http.Get(tunnel.URL + OAUTH_CALLBACK_PATH + "?code=code-123&state=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("callback without state: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestOAuthNotAllowed(t *testing.T) {
+	provider, _ := oidcProvider(t, "mallory@evil.example")
+
+	auth := &Auth{OAuth: &OAuth{
+		AuthURL:     provider.URL + "/authorize",
+		TokenURL:    provider.URL + "/token",
+		UserInfoURL: provider.URL + "/userinfo",
+		ClientID:    "tunnel-client", ClientSecret: "client-secret",
+		AllowEmails: []string{"alice@example.com"},
+	}}
+
+	var reached atomic.Bool
+	tunnel := httptest.NewServer(Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached.Store(true) }), auth.Middleware("http")))
+	defer tunnel.Close()
+
+	jar, _ := cookiejar.New(nil)
+	resp, err := (&http.Client{Jar: jar}).Get(tunnel.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+
+	if resp.StatusCode != http.StatusForbidden || reached.Load() {
+		t.Fatalf("status %d, reached local service %v", resp.StatusCode, reached.Load())
+	}
+}
+
+func TestOAuthStateCookieIsNotSession(t *testing.T) {
+	provider, _ := oidcProvider(t, "alice@example.com")
+
+	auth := &Auth{OAuth: &OAuth{
+		Issuer:       provider.URL,
+		ClientID:     "tunnel-client",
+		ClientSecret: "client-secret",
+		AllowDomains: []string{"example.com"},
+	}}
+	handler := Chain(seenUser, auth.Middleware("http"))
+
+	// 未登录的访问者得到签名的 state cookie
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/private", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: status %d, want 302", w.Code)
+	}
+
+	var state *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oauthStateCookie {
+			state = cookie
+		}
+	}
+	if state == nil {
+		t.Fatal("login did not set the state cookie")
+	}
+
+	// 把 state cookie 当作 session cookie 发送
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		r := httptest.NewRequest(method, "/private", nil)
+		r.AddCookie(&http.Cookie{Name: OAUTH_SESSION_COOKIE, Value: state.Value})
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusFound && w.Code != http.StatusUnauthorized {
+			t.Fatalf("%s with replayed state cookie: status %d %q", method, w.Code, w.Body.String())
+		}
+	}
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(body)
+}
@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// 目录中作为首页的文件
+const INDEX_FILE = "index.html"
+
+// 以 . 开头的文件和目录中唯一公开的目录(RFC 8615)
+const WELL_KNOWN_DIR = ".well-known"
+
+// FileServer(root string, listing bool) 提供本地目录中文件的 http.Handler，不需要本地服务
+// 支持 Range 请求和 If-Modified-Since 等条件请求，目录中有 index.html 时返回 index.html；
+// 没有 index.html 的目录在 listing 为true时列出目录中的文件，否则返回 404
+// 以 . 开头的文件和目录(.git、.env、.htpasswd 等，.well-known 除外)和指向 root 之外的符号链接返回 404，也不会被列出
+func FileServer(root string, listing bool) http.Handler {
+	// root 本身可以是符号链接
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+
+	return http.FileServer(fileSystem{root: filepath.Clean(root), listing: listing})
+}
+
+// fileSystem 只能访问 root 中的文件，不列出目录时把没有 index.html 的目录当作不存在
+type fileSystem struct {
+	// 解析符号链接后的本地目录
+	root string
+
+	listing bool
+}
+
+func (fsys fileSystem) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+
+	if hiddenPath(name) {
+		return nil, fs.ErrNotExist
+	}
+
+	real, err := fsys.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(real)
+	if err != nil {
+		return nil, openError(err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return file, nil
+	}
+
+	if !fsys.listing {
+		index, err := fsys.Open(path.Join(name, INDEX_FILE))
+		if err != nil {
+			file.Close()
+			return nil, fs.ErrNotExist
+		}
+		index.Close()
+	}
+
+	return &directory{File: file, fsys: fsys, name: name}, nil
+}
+
+// resolve(name string) 解析符号链接后的本地路径，不在 root 中时返回 fs.ErrNotExist
+func (fsys fileSystem) resolve(name string) (string, error) {
+	real, err := filepath.EvalSymlinks(filepath.Join(fsys.root, filepath.FromSlash(name)))
+	if err != nil {
+		return "", openError(err)
+	}
+
+	rel, err := filepath.Rel(fsys.root, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", fs.ErrNotExist
+	}
+
+	return real, nil
+}
+
+// openError(err error) 和 http.Dir 一样，除了没有权限之外的错误都当作不存在，不会返回 500
+func openError(err error) error {
+	if errors.Is(err, fs.ErrPermission) {
+		return fs.ErrPermission
+	}
+
+	return fs.ErrNotExist
+}
+
+// hiddenPath(name string) 路径中是否有以 . 开头的部分
+func hiddenPath(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if hiddenName(part) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hiddenName(name string) 以 . 开头的文件或者目录，.well-known 除外
+func hiddenName(name string) bool {
+	return strings.HasPrefix(name, ".") && name != WELL_KNOWN_DIR
+}
+
+// directory 列出目录时去掉隐藏的文件和指向 root 之外的符号链接
+type directory struct {
+	http.File
+
+	fsys fileSystem
+	name string
+}
+
+func (dir *directory) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := dir.File.Readdir(count)
+
+	visible := infos[:0]
+	for _, info := range infos {
+		if hiddenName(info.Name()) {
+			continue
+		}
+
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if _, err := dir.fsys.resolve(path.Join(dir.name, info.Name())); err != nil {
+				continue
+			}
+		}
+
+		visible = append(visible, info)
+	}
+
+	return visible, err
+}
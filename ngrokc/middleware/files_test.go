@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileServer(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "app.js"), []byte("console.log('hello')"), 0644)
+	os.MkdirAll(filepath.Join(root, "site"), 0755)
+	os.WriteFile(filepath.Join(root, "site", INDEX_FILE), []byte("<h1>site</h1>"), 0644)
+	os.MkdirAll(filepath.Join(root, "builds"), 0755)
+	os.WriteFile(filepath.Join(root, "builds", "v1.tar.gz"), []byte("0123456789"), 0644)
+
+	get := func(handler http.Handler, target string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		for name, value := range header {
+			r.Header.Set(name, value)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, listing := range []bool{true, false} {
+		handler := FileServer(root, listing)
+
+		if w := get(handler, "/app.js", nil); w.Code != http.StatusOK || w.Body.String() != "console.log('hello')" {
+			t.Fatalf("listing=%v: GET /app.js = %d %q", listing, w.Code, w.Body.String())
+		}
+
+		if w := get(handler, "/site/", nil); w.Code != http.StatusOK || w.Body.String() != "<h1>site</h1>" {
+			t.Fatalf("listing=%v: GET /site/ = %d %q", listing, w.Code, w.Body.String())
+		}
+
+		w := get(handler, "/builds/v1.tar.gz", map[string]string{"Range": "bytes=2-5"})
+		if w.Code != http.StatusPartialContent || w.Body.String() != "2345" || w.Header().Get("Content-Range") != "bytes 2-5/10" {
+			t.Fatalf("listing=%v: range request = %d %q %q", listing, w.Code, w.Body.String(), w.Header().Get("Content-Range"))
+		}
+
+		if w := get(handler, "/../../../../etc/passwd", nil); strings.Contains(w.Body.String(), "root:") {
+			t.Fatalf("listing=%v: served a file outside the root", listing)
+		}
+
+		w = get(handler, "/builds/", nil)
+		if listing && (w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "v1.tar.gz")) {
+			t.Fatalf("listing enabled: GET /builds/ = %d %q", w.Code, w.Body.String())
+		}
+		if !listing && w.Code != http.StatusNotFound {
+			t.Fatalf("listing disabled: GET /builds/ = %d, want 404", w.Code)
+		}
+	}
+}
+
+func TestFileServerHiddenAndOutside(t *testing.T) {
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "app.js"), []byte("app"), 0644)
+	os.WriteFile(filepath.Join(root, ".env"), []byte("TOKEN=secret"), 0644)
+	os.WriteFile(filepath.Join(root, ".htpasswd"), []byte("admin:secret"), 0644)
+	os.MkdirAll(filepath.Join(root, ".git"), 0755)
+	os.WriteFile(filepath.Join(root, ".git", "config"), []byte("[core]"), 0644)
+	os.MkdirAll(filepath.Join(root, "assets", ".cache"), 0755)
+	os.WriteFile(filepath.Join(root, "assets", ".cache", "data"), []byte("cache"), 0644)
+	os.MkdirAll(filepath.Join(root, ".well-known", "acme-challenge"), 0755)
+	os.WriteFile(filepath.Join(root, ".well-known", "acme-challenge", "token"), []byte("challenge"), 0644)
+
+	// 指向目录之外的文件和目录，以及目录之内的文件
+	for link, target := range map[string]string{
+		"leak.txt": filepath.Join(outside, "secret.txt"),
+		"leak":     outside,
+		"app.mjs":  filepath.Join(root, "app.js"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("symlink: %v", err)
+		}
+	}
+
+	// root 本身是符号链接
+	linkedRoot := filepath.Join(t.TempDir(), "public")
+	if err := os.Symlink(root, linkedRoot); err != nil {
+		t.Skipf("symlink: %v", err)
+	}
+
+	for _, dir := range []string{root, linkedRoot} {
+		handler := FileServer(dir, true)
+
+		get := func(target string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+			return w
+		}
+
+		for _, target := range []string{"/.env", "/.htpasswd", "/.git/config", "/.git/", "/assets/.cache/data", "/leak.txt", "/leak/secret.txt", "/leak/"} {
+			if w := get(target); w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "secret") {
+				t.Fatalf("root %s: GET %s = %d %q, want 404", dir, target, w.Code, w.Body.String())
+			}
+		}
+
+		if w := get("/app.mjs"); w.Code != http.StatusOK || w.Body.String() != "app" {
+			t.Fatalf("root %s: GET symlink inside the root = %d %q", dir, w.Code, w.Body.String())
+		}
+
+		if w := get("/.well-known/acme-challenge/token"); w.Code != http.StatusOK || w.Body.String() != "challenge" {
+			t.Fatalf("root %s: GET .well-known = %d %q", dir, w.Code, w.Body.String())
+		}
+
+		w := get("/")
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "app.mjs") {
+			t.Fatalf("root %s: GET / = %d %q", dir, w.Code, w.Body.String())
+		}
+		for _, name := range []string{".env", ".htpasswd", ".git", "leak"} {
+			if strings.Contains(w.Body.String(), `href="`+name) {
+				t.Fatalf("root %s: listing shows %s: %q", dir, name, w.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+)
+
+// Host 头的改写方式
+const (
+	// 保留访问者请求的 Host(公网域名)
+	HOST_PRESERVE = ""
+	// 改写为本地服务的地址
+	HOST_REWRITE = "rewrite"
+)
+
+// X-Forwarded-* 头
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"}
+
+// Headers HTTP隧道的请求头和响应头改写
+type Headers struct {
+	// Host 头：HOST_PRESERVE 保留，HOST_REWRITE 改写为本地服务的地址，其他值直接作为新的 Host
+	Host string
+
+	// 设置(覆盖)和删除的请求头，先删除后设置
+	RequestAdd    map[string]string
+	RequestRemove []string
+
+	// 设置(覆盖)和删除的响应头，先删除后设置
+	ResponseAdd    map[string]string
+	ResponseRemove []string
+
+	// 是否设置 X-Forwarded-For(访问者的IP)、X-Forwarded-Host(公网域名) 和 X-Forwarded-Proto(公网协议)
+	// 访问者自己发送的这些头会被覆盖
+	XForwarded bool
+}
+
+// Middleware(localAddr, publicProto string) 按配置改写请求头和响应头的中间件
+// localAddr 为本地服务的地址，publicProto 为隧道的公网协议 http/https
+func (headers *Headers) Middleware(localAddr, publicProto string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if headers.XForwarded {
+				clientIP := r.RemoteAddr
+				if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+					clientIP = host
+				}
+
+				r.Header.Set("X-Forwarded-For", clientIP)
+				r.Header.Set("X-Forwarded-Host", r.Host)
+				r.Header.Set("X-Forwarded-Proto", publicProto)
+			}
+
+			switch headers.Host {
+			case HOST_PRESERVE:
+			case HOST_REWRITE:
+				r.Host = localAddr
+			default:
+				r.Host = headers.Host
+			}
+
+			for _, name := range headers.RequestRemove {
+				r.Header.Del(name)
+			}
+
+			for name, value := range headers.RequestAdd {
+				r.Header.Set(name, value)
+			}
+
+			if len(headers.ResponseAdd) > 0 || len(headers.ResponseRemove) > 0 {
+				w = &headerWriter{ResponseWriter: w, headers: headers}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// headerWriter 在写响应头之前改写响应头
+type headerWriter struct {
+	http.ResponseWriter
+
+	headers     *Headers
+	wroteHeader bool
+}
+
+// rewrite() 改写响应头，只执行一次
+func (w *headerWriter) rewrite() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	header := w.ResponseWriter.Header()
+
+	for _, name := range w.headers.ResponseRemove {
+		header.Del(name)
+	}
+
+	for name, value := range w.headers.ResponseAdd {
+		header.Set(name, value)
+	}
+}
+
+func (w *headerWriter) WriteHeader(statusCode int) {
+	// 1xx 的响应之后还有最终的响应
+	if statusCode >= 200 {
+		w.rewrite()
+	}
+
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	w.rewrite()
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap() 用于 http.ResponseController 的 Flush/Hijack(WebSocket)
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+)
+
+// Middleware 包装一个 http.Handler，在代理的请求和响应上增加处理
+type Middleware func(next http.Handler) http.Handler
+
+// Chain(handler http.Handler, middlewares ...Middleware) 按顺序组合中间件，第一个中间件最先处理请求
+func Chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+// LocalAddress(port uint) 本地服务的地址
+func LocalAddress(port uint) string {
+	return net.JoinHostPort("127.0.0.1", strconv.FormatUint(uint64(port), 10))
+}
+
+// ReverseProxy(localAddr string, isSSL bool) 把请求转发给本地服务的 http.Handler，isSSL 时使用TLS连接本地服务
+// 保留请求的Host，不修改 X-Forwarded-* 头，需要时使用 Headers
+func ReverseProxy(localAddr string, isSSL bool) http.Handler {
+	scheme := "http"
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if isSSL {
+		scheme = "https"
+		// 无视ssl证书，和直接连接本地服务时一样
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = scheme
+			r.Out.URL.Host = localAddr
+			// Rewrite 之前删除了 X-Forwarded-*，这里恢复访问者发送的或者中间件设置的值
+			for _, name := range forwardedHeaders {
+				if values, ok := r.In.Header[name]; ok {
+					r.Out.Header[name] = values
+				}
+			}
+		},
+		Transport: transport,
+		// 按 Content-Type 和分块自动刷新，流式响应(text/event-stream 等)不会被缓存
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			fmt.Println("middleware ReverseProxy():" + err.Error())
+			http.Error(w, "ngrok proxy failed to connect local service", http.StatusBadGateway)
+		},
+	}
+}
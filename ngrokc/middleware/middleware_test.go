@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		w.Header().Set("Server", "dev-server")
+		w.Header().Set("X-Powered-By", "php")
+		w.Header().Set("X-Seen", strings.Join([]string{
+			r.Host, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Host"), r.Header.Get("X-Forwarded-Proto"),
+			r.Header.Get("X-Tunnel"), r.Header.Get("Cookie"), string(body),
+		}, "|"))
+	}))
+	defer backend.Close()
+
+	localAddr := strings.TrimPrefix(backend.URL, "http://")
+
+	headers := &Headers{
+		Host:           HOST_REWRITE,
+		RequestAdd:     map[string]string{"X-Tunnel": "demo"},
+		RequestRemove:  []string{"Cookie"},
+		ResponseAdd:    map[string]string{"Server": "ngrok-client"},
+		ResponseRemove: []string{"X-Powered-By"},
+		XForwarded:     true,
+	}
+
+	handler := Chain(ReverseProxy(localAddr, false), headers.Middleware(localAddr, "https"))
+
+	r := httptest.NewRequest(http.MethodPost, "http://demo.ngrok.example.com/upload", strings.NewReader("payload"))
+	r.RemoteAddr = "203.0.113.7:50000"
+	r.Header.Set("Cookie", "session=secret")
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	want := localAddr + "|203.0.113.7|demo.ngrok.example.com|https|demo||payload"
+	if seen := w.Header().Get("X-Seen"); seen != want {
+		t.Fatalf("backend saw %q, want %q", seen, want)
+	}
+
+	if server := w.Header().Get("Server"); server != "ngrok-client" {
+		t.Fatalf("Server = %q", server)
+	}
+
+	if _, ok := w.Header()["X-Powered-By"]; ok {
+		t.Fatal("X-Powered-By was not removed")
+	}
+}
+
+func TestReverseProxyPreservesHost(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+"|"+r.Header.Get("X-Forwarded-For"))
+	}))
+	defer backend.Close()
+
+	handler := ReverseProxy(strings.TrimPrefix(backend.URL, "http://"), false)
+
+	r := httptest.NewRequest(http.MethodGet, "http://demo.ngrok.example.com/", nil)
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	// 没有 Headers 时不修改 Host 和 X-Forwarded-*
+	if body := w.Body.String(); body != "demo.ngrok.example.com|10.0.0.1" {
+		t.Fatalf("backend saw %q", body)
+	}
+}
+
+func TestReverseProxyLocalDown(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	localAddr := strings.TrimPrefix(backend.URL, "http://")
+	backend.Close()
+
+	w := httptest.NewRecorder()
+	ReverseProxy(localAddr, false).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", w.Code)
+	}
+}
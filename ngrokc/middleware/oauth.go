@@ -0,0 +1,486 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ngrok-client/ngrokc/util"
+)
+
+// OAuth 登录后授权服务器跳转回来的路径，需要在授权服务器上登记 公网协议://隧道域名/_ngrokc/oauth/callback
+const OAUTH_CALLBACK_PATH = "/_ngrokc/oauth/callback"
+
+// OAuth 使用的 cookie
+const (
+	OAUTH_SESSION_COOKIE = "ngrokc_session"
+	oauthStateCookie     = "ngrokc_oauth_state"
+)
+
+// 登录的有效时间，超过后需要重新登录
+const DefaultSessionDuration = 24 * time.Hour
+
+// 签名 cookie 时区分用途，一种用途的 cookie 不能当作另一种使用
+const (
+	cookiePurposeState   = "state"
+	cookiePurposeSession = "session"
+)
+
+// 从跳转到授权服务器到跳转回来的最长时间
+const oauthStateDuration = 10 * time.Minute
+
+// 请求授权服务器的超时时间
+const oauthRequestTimeout = 10 * time.Second
+
+// 读取授权服务器响应的最大字节数
+const maxOAuthResponseSize = 1 << 20
+
+// OIDC 发现文档的路径
+const oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+// OAuth OAuth2/OIDC 授权码登录，使用 userinfo 接口获取登录的用户
+type OAuth struct {
+	// OIDC 的 issuer，AuthURL/TokenURL/UserInfoURL 为空时从 issuer 的发现文档中读取
+	Issuer string
+	// 授权、获取 token 和获取用户信息的地址
+	AuthURL     string
+	TokenURL    string
+	UserInfoURL string
+
+	ClientID     string
+	ClientSecret string
+	// 为空时为 openid email profile
+	Scopes []string
+
+	// 允许登录的邮箱和邮箱的域名，都为空时允许所有登录成功的用户
+	AllowEmails  []string
+	AllowDomains []string
+
+	// 登录的有效时间，为0时为 DefaultSessionDuration
+	SessionDuration time.Duration
+
+	// 请求授权服务器使用的 http.Client，为nil时使用超时为10秒的默认客户端
+	Client *http.Client
+}
+
+// oidcEndpoints OIDC 发现文档中使用的地址
+type oidcEndpoints struct {
+	AuthURL     string `json:"authorization_endpoint"`
+	TokenURL    string `json:"token_endpoint"`
+	UserInfoURL string `json:"userinfo_endpoint"`
+}
+
+// oauthHandler 一个隧道的 OAuth 登录
+type oauthHandler struct {
+	oauth       *OAuth
+	publicProto string
+	client      *http.Client
+
+	// 签名 cookie 的密钥
+	key []byte
+
+	// 从发现文档中读取的地址，成功后缓存
+	mutex     sync.Mutex
+	endpoints *oidcEndpoints
+}
+
+// newOAuthHandler(oauth *OAuth, publicProto string) 创建 OAuth 登录的处理
+func newOAuthHandler(oauth *OAuth, publicProto string) *oauthHandler {
+	handler := &oauthHandler{oauth: oauth, publicProto: publicProto, client: oauth.Client}
+
+	if handler.client == nil {
+		handler.client = &http.Client{Timeout: oauthRequestTimeout}
+	}
+
+	// 由 client secret 派生密钥，重启和重新加载配置后登录仍然有效，修改 secret 后所有登录失效
+	if oauth.ClientSecret != "" {
+		mac := hmac.New(sha256.New, []byte(oauth.ClientSecret))
+		mac.Write([]byte("ngrokc oauth session " + oauth.ClientID))
+		handler.key = mac.Sum(nil)
+	} else {
+		handler.key = make([]byte, sha256.Size)
+		rand.Read(handler.key)
+	}
+
+	if oauth.AuthURL != "" && oauth.TokenURL != "" && oauth.UserInfoURL != "" {
+		handler.endpoints = &oidcEndpoints{AuthURL: oauth.AuthURL, TokenURL: oauth.TokenURL, UserInfoURL: oauth.UserInfoURL}
+	}
+
+	return handler
+}
+
+// discover(ctx context.Context) 获取授权服务器的地址，没有配置时读取 issuer 的发现文档
+func (handler *oauthHandler) discover(ctx context.Context) (*oidcEndpoints, error) {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+
+	if handler.endpoints != nil {
+		return handler.endpoints, nil
+	}
+
+	var endpoints oidcEndpoints
+	if err := handler.getJSON(ctx, strings.TrimSuffix(handler.oauth.Issuer, "/")+oidcDiscoveryPath, "", &endpoints); err != nil {
+		return nil, err
+	}
+
+	// 配置的地址优先
+	if handler.oauth.AuthURL != "" {
+		endpoints.AuthURL = handler.oauth.AuthURL
+	}
+	if handler.oauth.TokenURL != "" {
+		endpoints.TokenURL = handler.oauth.TokenURL
+	}
+	if handler.oauth.UserInfoURL != "" {
+		endpoints.UserInfoURL = handler.oauth.UserInfoURL
+	}
+
+	if endpoints.AuthURL == "" || endpoints.TokenURL == "" || endpoints.UserInfoURL == "" {
+		return nil, errors.New("oidc discovery: authorization_endpoint, token_endpoint or userinfo_endpoint missing")
+	}
+
+	handler.endpoints = &endpoints
+
+	return handler.endpoints, nil
+}
+
+// redirectURL(r *http.Request) 授权服务器跳转回来的地址
+func (handler *oauthHandler) redirectURL(r *http.Request) string {
+	return handler.publicProto + "://" + r.Host + OAUTH_CALLBACK_PATH
+}
+
+// login(w http.ResponseWriter, r *http.Request) 跳转到授权服务器登录，登录后回到现在访问的地址
+func (handler *oauthHandler) login(w http.ResponseWriter, r *http.Request) {
+	endpoints, err := handler.discover(r.Context())
+	if err != nil {
+		fmt.Println("middleware oauth login():" + err.Error())
+		http.Error(w, "ngrok client authentication provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	state := hex.EncodeToString(nonce)
+
+	expires := time.Now().Add(oauthStateDuration)
+	handler.setCookie(w, oauthStateCookie, handler.sign(cookiePurposeState, state+"|"+r.URL.RequestURI(), expires), oauthStateDuration)
+
+	scopes := handler.oauth.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {handler.oauth.ClientID},
+		"redirect_uri":  {handler.redirectURL(r)},
+		"scope":         {strings.Join(scopes, " ")},
+		"state":         {state},
+	}
+
+	separator := "?"
+	if strings.Contains(endpoints.AuthURL, "?") {
+		separator = "&"
+	}
+
+	http.Redirect(w, r, endpoints.AuthURL+separator+query.Encode(), http.StatusFound)
+}
+
+// callback(w http.ResponseWriter, r *http.Request) 授权服务器跳转回来，用授权码获取用户，登录成功后设置 session cookie
+func (handler *oauthHandler) callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if errCode := query.Get("error"); errCode != "" {
+		http.Error(w, "ngrok client authentication failed: "+errCode, http.StatusUnauthorized)
+		return
+	}
+
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil {
+		http.Error(w, "ngrok client authentication failed: missing state", http.StatusBadRequest)
+		return
+	}
+
+	value, ok := handler.verify(cookiePurposeState, cookie.Value)
+	state, returnTo, found := strings.Cut(value, "|")
+	if !ok || !found || query.Get("state") == "" || !hmac.Equal([]byte(state), []byte(query.Get("state"))) {
+		http.Error(w, "ngrok client authentication failed: invalid state", http.StatusBadRequest)
+		return
+	}
+
+	handler.setCookie(w, oauthStateCookie, "", -1)
+
+	user, err := handler.exchange(r, query.Get("code"))
+	if err != nil {
+		fmt.Println("middleware oauth callback():" + err.Error())
+		http.Error(w, "ngrok client authentication failed", http.StatusUnauthorized)
+		return
+	}
+
+	if !handler.allowed(user) {
+		http.Error(w, "ngrok client authentication failed: "+user.Email+" is not allowed", http.StatusForbidden)
+		return
+	}
+
+	name := user.Email
+	if name == "" {
+		name = user.Subject
+	}
+
+	duration := handler.oauth.SessionDuration
+	if duration <= 0 {
+		duration = DefaultSessionDuration
+	}
+
+	handler.setCookie(w, OAUTH_SESSION_COOKIE, handler.sign(cookiePurposeSession, name, time.Now().Add(duration)), duration)
+
+	// 只跳转到同一个站点的路径
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		returnTo = "/"
+	}
+
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// oauthUser userinfo 接口返回的用户
+type oauthUser struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+}
+
+// exchange(r *http.Request, code string) 用授权码获取 access token，再从 userinfo 接口获取用户
+func (handler *oauthHandler) exchange(r *http.Request, code string) (*oauthUser, error) {
+	if code == "" {
+		return nil, errors.New("missing code")
+	}
+
+	endpoints, err := handler.discover(r.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {handler.redirectURL(r)},
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, endpoints.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// RFC 6749 2.3.1
+	req.SetBasicAuth(url.QueryEscape(handler.oauth.ClientID), url.QueryEscape(handler.oauth.ClientSecret))
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := handler.doJSON(req, &token); err != nil {
+		return nil, fmt.Errorf("token: %w", err)
+	}
+
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("token: no access_token: %s", token.Error)
+	}
+
+	var user oauthUser
+	if err := handler.getJSON(r.Context(), endpoints.UserInfoURL, token.AccessToken, &user); err != nil {
+		return nil, fmt.Errorf("userinfo: %w", err)
+	}
+
+	if user.Subject == "" && user.Email == "" {
+		return nil, errors.New("userinfo: no sub or email")
+	}
+
+	return &user, nil
+}
+
+// allowed(user *oauthUser) 用户是否在允许的邮箱或者域名中，限制邮箱时邮箱需要已经验证
+func (handler *oauthHandler) allowed(user *oauthUser) bool {
+	if len(handler.oauth.AllowEmails) == 0 && len(handler.oauth.AllowDomains) == 0 {
+		return true
+	}
+
+	if user.Email == "" || (user.EmailVerified != nil && !*user.EmailVerified) {
+		return false
+	}
+
+	for _, email := range handler.oauth.AllowEmails {
+		if strings.EqualFold(email, user.Email) {
+			return true
+		}
+	}
+
+	_, domain, _ := strings.Cut(user.Email, "@")
+	for _, allowed := range handler.oauth.AllowDomains {
+		if strings.EqualFold(allowed, domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// session(r *http.Request) 验证 session cookie，通过时从请求中删除这个 cookie，返回登录的用户
+func (handler *oauthHandler) session(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(OAUTH_SESSION_COOKIE)
+	if err != nil {
+		return "", false
+	}
+
+	user, ok := handler.verify(cookiePurposeSession, cookie.Value)
+	if !ok || !validSessionUser(user) {
+		return "", false
+	}
+
+	removeCookies(r, OAUTH_SESSION_COOKIE, oauthStateCookie)
+
+	return user, true
+}
+
+// getJSON(ctx context.Context, url, accessToken string, result interface{}) GET 请求授权服务器，accessToken 不为空时作为 Bearer token
+func (handler *oauthHandler) getJSON(ctx context.Context, url, accessToken string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	return handler.doJSON(req, result)
+}
+
+// doJSON(req *http.Request, result interface{}) 发送请求并解析JSON响应
+func (handler *oauthHandler) doJSON(req *http.Request, result interface{}) error {
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxOAuthResponseSize))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return json.Unmarshal(body, result)
+}
+
+// validSessionUser(user string) session 中的用户为邮箱或者 sub，不能为空，不能含有 state 使用的 | 和控制字符
+func validSessionUser(user string) bool {
+	if user == "" || strings.Contains(user, "|") {
+		return false
+	}
+
+	for _, c := range user {
+		if c < 0x20 || c == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sign(purpose, value string, expires time.Time) 签名 cookie 的值：base64(value).过期时间.签名，purpose 参与签名但不写入 cookie
+func (handler *oauthHandler) sign(purpose, value string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(value)) + "." + strconv.FormatInt(expires.Unix(), 10)
+
+	return payload + "." + handler.mac(purpose, payload)
+}
+
+// mac(purpose, payload string) 用途和内容的 HMAC-SHA256
+func (handler *oauthHandler) mac(purpose, payload string) string {
+	mac := hmac.New(sha256.New, handler.key)
+	mac.Write([]byte("ngrokc " + purpose + "\x00" + payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify(purpose, signed string) 验证 sign 以同样用途签名的值，签名错误、用途不同或者过期时返回false
+func (handler *oauthHandler) verify(purpose, signed string) (string, bool) {
+	index := strings.LastIndex(signed, ".")
+	if index < 0 {
+		return "", false
+	}
+	payload, signature := signed[:index], signed[index+1:]
+
+	expected := handler.mac(purpose, payload)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", false
+	}
+
+	encoded, expiresText, _ := strings.Cut(payload, ".")
+
+	expires, err := strconv.ParseInt(expiresText, 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return "", false
+	}
+
+	value, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+
+	return string(value), true
+}
+
+// setCookie(w http.ResponseWriter, name, value string, maxAge time.Duration) 设置或者删除(maxAge < 0) cookie
+func (handler *oauthHandler) setCookie(w http.ResponseWriter, name, value string, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   handler.publicProto == util.PROTOCOL_HTTPS,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(maxAge / time.Second),
+	}
+
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+
+	http.SetCookie(w, cookie)
+}
+
+// removeCookies(r *http.Request, names ...string) 从请求的 Cookie 头中删除这些 cookie
+func removeCookies(r *http.Request, names ...string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+
+	for _, cookie := range cookies {
+		removed := false
+		for _, name := range names {
+			if cookie.Name == name {
+				removed = true
+			}
+		}
+
+		if !removed {
+			r.AddCookie(cookie)
+		}
+	}
+}
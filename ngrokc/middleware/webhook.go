@@ -0,0 +1,318 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhook 签名的格式
+const (
+	// 请求体的 HMAC-SHA256，签名所在的头可以配置
+	WEBHOOK_HMAC_SHA256 = "hmac-sha256"
+	// GitHub 的 X-Hub-Signature-256
+	WEBHOOK_GITHUB = "github"
+	// Stripe 的 Stripe-Signature
+	WEBHOOK_STRIPE = "stripe"
+	// Slack 的 X-Slack-Signature 和 X-Slack-Request-Timestamp
+	WEBHOOK_SLACK = "slack"
+)
+
+// WEBHOOK_HMAC_SHA256 默认的签名头
+const DefaultWebhookHeader = "X-Signature"
+
+// Stripe 和 Slack 签名中的时间戳和当前时间允许的最大差值
+const DefaultWebhookTolerance = 5 * time.Minute
+
+// 验证签名时默认读取的请求体的最大字节数，超过时返回 413
+const DefaultWebhookBodySize = 1024 * 1024
+
+// ErrInvalidSignature webhook 请求的签名无效
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Webhook HTTP隧道验证 webhook 请求的签名，签名无效的请求返回 401，不会转发给本地服务
+// 先检查签名头是否存在、格式和时间戳是否正确，通过后才读取请求体，没有签名的请求不会占用内存
+type Webhook struct {
+	// 签名的格式 WEBHOOK_HMAC_SHA256/WEBHOOK_GITHUB/WEBHOOK_STRIPE/WEBHOOK_SLACK
+	Provider string
+	// 签名的密钥
+	Secret string
+
+	// WEBHOOK_HMAC_SHA256 only，签名所在的头，为空时为 DefaultWebhookHeader
+	// 值为 hex 或者 base64 编码的签名，可以带有 sha256= 前缀
+	Header string
+
+	// WEBHOOK_STRIPE/WEBHOOK_SLACK only，为0时为 DefaultWebhookTolerance
+	Tolerance time.Duration
+
+	// 验证签名时读取的请求体的最大字节数，超过时返回 413，为0时为 DefaultWebhookBodySize
+	// 请求体在验证期间完整地保存在内存中，GitHub 的请求体最大为 25MB
+	MaxBodySize int64
+
+	// 拒绝请求时调用，为nil时输出日志
+	OnReject func(r *http.Request, err error)
+
+	// 获取当前时间，测试时可以替换
+	now func() time.Time
+}
+
+// signature 从请求头中解析出的签名
+type signature struct {
+	// 签名所在的头
+	header string
+	// 签名的内容为 prefix + 请求体
+	prefix string
+	// 任意一个等于签名内容的 HMAC-SHA256 时有效
+	values [][]byte
+}
+
+// Middleware() 验证 webhook 签名的中间件，验证后请求体原样转发给本地服务
+func (webhook *Webhook) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// 签名头无效时不读取请求体
+			sig, err := webhook.parse(r.Header)
+			if err != nil {
+				webhook.reject(r, err)
+				http.Error(w, "invalid webhook signature", http.StatusUnauthorized)
+				return
+			}
+
+			maxBodySize := webhook.MaxBodySize
+			if maxBodySize <= 0 {
+				maxBodySize = DefaultWebhookBodySize
+			}
+
+			if r.ContentLength > maxBodySize {
+				webhook.reject(r, fmt.Errorf("body larger than %d bytes", maxBodySize))
+				http.Error(w, "webhook body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+			r.Body.Close()
+
+			if err != nil {
+				webhook.reject(r, fmt.Errorf("read body: %w", err))
+				http.Error(w, "ngrok client failed to read webhook body", http.StatusBadRequest)
+				return
+			}
+
+			if int64(len(body)) > maxBodySize {
+				webhook.reject(r, fmt.Errorf("body larger than %d bytes", maxBodySize))
+				http.Error(w, "webhook body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			if err := webhook.check(sig, body); err != nil {
+				webhook.reject(r, err)
+				http.Error(w, "invalid webhook signature", http.StatusUnauthorized)
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.TransferEncoding = nil
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// reject(r *http.Request, err error) 记录被拒绝的请求
+func (webhook *Webhook) reject(r *http.Request, err error) {
+	if webhook.OnReject != nil {
+		webhook.OnReject(r, err)
+		return
+	}
+
+	fmt.Printf("middleware webhook: %s %s from %s rejected: %v\n", r.Method, r.URL.Path, r.RemoteAddr, err)
+}
+
+// Verify(header http.Header, body []byte) 验证请求的签名，无效时返回包装了 ErrInvalidSignature 的错误，说明原因
+func (webhook *Webhook) Verify(header http.Header, body []byte) error {
+	sig, err := webhook.parse(header)
+	if err != nil {
+		return err
+	}
+
+	return webhook.check(sig, body)
+}
+
+// parse(header http.Header) 解析请求头中的签名，检查签名头是否存在、格式和时间戳是否正确，不需要请求体
+func (webhook *Webhook) parse(header http.Header) (*signature, error) {
+	switch webhook.Provider {
+	case WEBHOOK_HMAC_SHA256:
+		name := webhook.Header
+		if name == "" {
+			name = DefaultWebhookHeader
+		}
+		return webhook.parseHMAC(header, name)
+	case WEBHOOK_GITHUB:
+		return webhook.parseGitHub(header)
+	case WEBHOOK_STRIPE:
+		return webhook.parseStripe(header)
+	case WEBHOOK_SLACK:
+		return webhook.parseSlack(header)
+	default:
+		return nil, fmt.Errorf("%w: unknown provider %q", ErrInvalidSignature, webhook.Provider)
+	}
+}
+
+// check(sig *signature, body []byte) 检查签名和请求体是否匹配
+func (webhook *Webhook) check(sig *signature, body []byte) error {
+	expected := webhook.sign(append([]byte(sig.prefix), body...))
+
+	for _, value := range sig.values {
+		if hmac.Equal(value, expected) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s does not match the body", ErrInvalidSignature, sig.header)
+}
+
+// parseHMAC(header http.Header, name string) 头 name 中的签名为请求体的 HMAC-SHA256
+func (webhook *Webhook) parseHMAC(header http.Header, name string) (*signature, error) {
+	value := header.Get(name)
+	if value == "" {
+		return nil, fmt.Errorf("%w: missing %s header", ErrInvalidSignature, name)
+	}
+
+	decoded := decodeSignature(strings.TrimPrefix(value, "sha256="))
+	if len(decoded) != sha256.Size {
+		return nil, fmt.Errorf("%w: %s is not a hex or base64 HMAC-SHA256", ErrInvalidSignature, name)
+	}
+
+	return &signature{header: name, values: [][]byte{decoded}}, nil
+}
+
+// parseGitHub(header http.Header) X-Hub-Signature-256: sha256=请求体的 HMAC-SHA256(hex)
+func (webhook *Webhook) parseGitHub(header http.Header) (*signature, error) {
+	value := header.Get("X-Hub-Signature-256")
+	if value == "" {
+		return nil, fmt.Errorf("%w: missing X-Hub-Signature-256 header", ErrInvalidSignature)
+	}
+
+	encoded, ok := strings.CutPrefix(value, "sha256=")
+	decoded, err := hex.DecodeString(encoded)
+	if !ok || err != nil || len(decoded) != sha256.Size {
+		return nil, fmt.Errorf("%w: X-Hub-Signature-256 is not sha256=<hex>", ErrInvalidSignature)
+	}
+
+	return &signature{header: "X-Hub-Signature-256", values: [][]byte{decoded}}, nil
+}
+
+// parseStripe(header http.Header) Stripe-Signature: t=时间戳,v1=签名[,v1=签名]，签名的内容为 时间戳.请求体
+func (webhook *Webhook) parseStripe(header http.Header) (*signature, error) {
+	value := header.Get("Stripe-Signature")
+	if value == "" {
+		return nil, fmt.Errorf("%w: missing Stripe-Signature header", ErrInvalidSignature)
+	}
+
+	var timestamp string
+	var values [][]byte
+
+	for _, item := range strings.Split(value, ",") {
+		key, v, _ := strings.Cut(strings.TrimSpace(item), "=")
+		switch key {
+		case "t":
+			timestamp = v
+		case "v1":
+			if decoded, err := hex.DecodeString(v); err == nil && len(decoded) == sha256.Size {
+				values = append(values, decoded)
+			}
+		}
+	}
+
+	if timestamp == "" || len(values) == 0 {
+		return nil, fmt.Errorf("%w: Stripe-Signature has no timestamp or v1 signature", ErrInvalidSignature)
+	}
+
+	if err := webhook.checkTimestamp(timestamp); err != nil {
+		return nil, err
+	}
+
+	return &signature{header: "Stripe-Signature", prefix: timestamp + ".", values: values}, nil
+}
+
+// parseSlack(header http.Header) X-Slack-Signature: v0=签名，签名的内容为 v0:时间戳:请求体
+func (webhook *Webhook) parseSlack(header http.Header) (*signature, error) {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	value := header.Get("X-Slack-Signature")
+
+	if timestamp == "" || value == "" {
+		return nil, fmt.Errorf("%w: missing X-Slack-Request-Timestamp or X-Slack-Signature header", ErrInvalidSignature)
+	}
+
+	if err := webhook.checkTimestamp(timestamp); err != nil {
+		return nil, err
+	}
+
+	encoded, ok := strings.CutPrefix(value, "v0=")
+	decoded, err := hex.DecodeString(encoded)
+	if !ok || err != nil || len(decoded) != sha256.Size {
+		return nil, fmt.Errorf("%w: X-Slack-Signature is not v0=<hex>", ErrInvalidSignature)
+	}
+
+	return &signature{header: "X-Slack-Signature", prefix: "v0:" + timestamp + ":", values: [][]byte{decoded}}, nil
+}
+
+// checkTimestamp(timestamp string) 签名中的时间戳(秒)和当前时间的差值不能超过 Tolerance，防止重放
+func (webhook *Webhook) checkTimestamp(timestamp string) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp %q", ErrInvalidSignature, timestamp)
+	}
+
+	tolerance := webhook.Tolerance
+	if tolerance <= 0 {
+		tolerance = DefaultWebhookTolerance
+	}
+
+	now := time.Now
+	if webhook.now != nil {
+		now = webhook.now
+	}
+
+	if diff := now().Unix() - seconds; math.Abs(float64(diff)) > tolerance.Seconds() {
+		return fmt.Errorf("%w: timestamp %s is outside the tolerance of %s", ErrInvalidSignature, timestamp, tolerance)
+	}
+
+	return nil
+}
+
+// sign(payload []byte) 计算 HMAC-SHA256
+func (webhook *Webhook) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write(payload)
+
+	return mac.Sum(nil)
+}
+
+// decodeSignature(value string) 解码 hex 或者 base64 编码的签名，都不是时返回nil
+func decodeSignature(value string) []byte {
+	if signature, err := hex.DecodeString(value); err == nil && len(signature) == sha256.Size {
+		return signature
+	}
+
+	if signature, err := base64.StdEncoding.DecodeString(value); err == nil {
+		return signature
+	}
+
+	if signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "=")); err == nil {
+		return signature
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func hmacHex(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookVerify(t *testing.T) {
+	const body = `{"event":"push"}`
+	now := time.Unix(1700000000, 0)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	old := strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10)
+
+	rawMAC := hmac.New(sha256.New, []byte("s3cret"))
+	rawMAC.Write([]byte(body))
+
+	tests := []struct {
+		name    string
+		webhook Webhook
+		header  map[string]string
+		problem string
+	}{
+		{"github", Webhook{Provider: WEBHOOK_GITHUB}, map[string]string{"X-Hub-Signature-256": "sha256=" + hmacHex("s3cret", body)}, ""},
+		{"github wrong secret", Webhook{Provider: WEBHOOK_GITHUB}, map[string]string{"X-Hub-Signature-256": "sha256=" + hmacHex("other", body)}, "X-Hub-Signature-256 does not match"},
+		{"github missing", Webhook{Provider: WEBHOOK_GITHUB}, nil, "missing X-Hub-Signature-256 header"},
+		{"github bare hex", Webhook{Provider: WEBHOOK_GITHUB}, map[string]string{"X-Hub-Signature-256": hmacHex("s3cret", body)}, "X-Hub-Signature-256 is not sha256=<hex>"},
+		{"github base64", Webhook{Provider: WEBHOOK_GITHUB}, map[string]string{"X-Hub-Signature-256": "sha256=" + base64.StdEncoding.EncodeToString(rawMAC.Sum(nil))}, "X-Hub-Signature-256 is not sha256=<hex>"},
+		{"hmac default header", Webhook{Provider: WEBHOOK_HMAC_SHA256}, map[string]string{"X-Signature": hmacHex("s3cret", body)}, ""},
+		{"hmac base64", Webhook{Provider: WEBHOOK_HMAC_SHA256, Header: "X-Shopify-Hmac-Sha256"}, map[string]string{"X-Shopify-Hmac-Sha256": base64.StdEncoding.EncodeToString(rawMAC.Sum(nil))}, ""},
+		{"hmac garbage", Webhook{Provider: WEBHOOK_HMAC_SHA256}, map[string]string{"X-Signature": "not a signature"}, "X-Signature is not a hex or base64 HMAC-SHA256"},
+		{"stripe", Webhook{Provider: WEBHOOK_STRIPE}, map[string]string{"Stripe-Signature": "t=" + ts + ",v1=" + hmacHex("s3cret", "bad") + ",v1=" + hmacHex("s3cret", ts+"."+body)}, ""},
+		{"stripe replay", Webhook{Provider: WEBHOOK_STRIPE}, map[string]string{"Stripe-Signature": "t=" + old + ",v1=" + hmacHex("s3cret", old+"."+body)}, "outside the tolerance"},
+		{"stripe no v1", Webhook{Provider: WEBHOOK_STRIPE}, map[string]string{"Stripe-Signature": "t=" + ts + ",v0=abc"}, "no timestamp or v1 signature"},
+		{"slack", Webhook{Provider: WEBHOOK_SLACK}, map[string]string{"X-Slack-Request-Timestamp": ts, "X-Slack-Signature": "v0=" + hmacHex("s3cret", "v0:"+ts+":"+body)}, ""},
+		{"slack tampered timestamp", Webhook{Provider: WEBHOOK_SLACK}, map[string]string{"X-Slack-Request-Timestamp": strconv.FormatInt(now.Unix()-1, 10), "X-Slack-Signature": "v0=" + hmacHex("s3cret", "v0:"+ts+":"+body)}, "X-Slack-Signature does not match"},
+		{"slack old with tolerance", Webhook{Provider: WEBHOOK_SLACK, Tolerance: time.Hour}, map[string]string{"X-Slack-Request-Timestamp": old, "X-Slack-Signature": "v0=" + hmacHex("s3cret", "v0:"+old+":"+body)}, ""},
+	}
+
+	for _, test := range tests {
+		webhook := test.webhook
+		webhook.Secret = "s3cret"
+		webhook.now = func() time.Time { return now }
+
+		header := make(http.Header)
+		for name, value := range test.header {
+			header.Set(name, value)
+		}
+
+		err := webhook.Verify(header, []byte(body))
+
+		if test.problem == "" {
+			if err != nil {
+				t.Fatalf("%s: Verify = %v", test.name, err)
+			}
+			continue
+		}
+
+		if !errors.Is(err, ErrInvalidSignature) || !strings.Contains(err.Error(), test.problem) {
+			t.Fatalf("%s: Verify = %v, want %q", test.name, err, test.problem)
+		}
+	}
+}
+
+func TestWebhookMiddleware(t *testing.T) {
+	var rejected []error
+	webhook := &Webhook{Provider: WEBHOOK_GITHUB, Secret: "s3cret", OnReject: func(r *http.Request, err error) {
+		rejected = append(rejected, err)
+	}}
+
+	var reached int
+	handler := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached++
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte(strconv.FormatInt(r.ContentLength, 10) + "|" + string(body)))
+	}), webhook.Middleware())
+
+	// 分块传输的请求体，验证后原样转发
+	r := httptest.NewRequest(http.MethodPost, "/hooks", io.NopCloser(strings.NewReader("payload")))
+	r.ContentLength = -1
+	r.Header.Set("X-Hub-Signature-256", "sha256="+hmacHex("s3cret", "payload"))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || w.Body.String() != "7|payload" {
+		t.Fatalf("valid webhook: %d %q", w.Code, w.Body.String())
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/hooks", strings.NewReader("tampered"))
+	r.Header.Set("X-Hub-Signature-256", "sha256="+hmacHex("s3cret", "payload"))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized || reached != 1 {
+		t.Fatalf("tampered webhook: %d, reached %d", w.Code, reached)
+	}
+
+	if len(rejected) != 1 || !errors.Is(rejected[0], ErrInvalidSignature) {
+		t.Fatalf("rejected = %v", rejected)
+	}
+
+	// 没有签名头时不读取请求体
+	body := &countingReader{Reader: strings.NewReader("unsigned")}
+	r = httptest.NewRequest(http.MethodPost, "/hooks", body)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized || body.read != 0 {
+		t.Fatalf("unsigned webhook: %d, read %d bytes of the body", w.Code, body.read)
+	}
+
+	// 超过 MaxBodySize 的请求体，Content-Length 已知时不读取
+	webhook.MaxBodySize = 4
+	for _, length := range []int64{7, -1} {
+		body := &countingReader{Reader: strings.NewReader("payload")}
+		r = httptest.NewRequest(http.MethodPost, "/hooks", body)
+		r.ContentLength = length
+		r.Header.Set("X-Hub-Signature-256", "sha256="+hmacHex("s3cret", "payload"))
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusRequestEntityTooLarge || reached != 1 {
+			t.Fatalf("large webhook with Content-Length %d: %d, reached %d", length, w.Code, reached)
+		}
+
+		if length > 0 && body.read != 0 {
+			t.Fatalf("large webhook with Content-Length %d: read %d bytes of the body", length, body.read)
+		}
+	}
+}
+
+// countingReader 记录读取了多少字节
+type countingReader struct {
+	io.Reader
+	read int
+}
+
+func (reader *countingReader) Read(p []byte) (int, error) {
+	n, err := reader.Reader.Read(p)
+	reader.read += n
+	return n, err
+}
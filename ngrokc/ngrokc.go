@@ -1,50 +1,372 @@
 package ngrokc
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net/http"
 	"ngrok-client/ngrokc/config"
 	"ngrok-client/ngrokc/connection"
+	"ngrok-client/ngrokc/middleware"
+	"ngrok-client/ngrokc/transport"
+	"ngrok-client/ngrokc/usage"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
-// Ngrok client的启动函数
-func Start() {
+// 进程的退出码
+const (
+	// 正常退出，或者收到关闭信号后所有代理连接都正常结束
+	ExitOK = 0
+	// 配置错误或者连接出错
+	ExitError = 1
+	// 收到关闭信号后，代理连接在等待时间内没有结束，被强制关闭
+	ExitDrainTimeout = 3
+)
+
+// Ngrok client的启动函数，返回进程的退出码
+func Start() int {
 
 	// 异常退出时的处理
 	defer exceptionPrecess()
 
 	// 配置文件的解析
-	config.ParseConfig()
+	if err := config.ParseConfig(); err != nil {
+		fmt.Println(err)
+		return ExitError
+	}
 
-	var ccon = connection.ControlConnection{}
+	sessions := config.CONFIG.AllSessions()
 
-	// 处理关闭信号
-	signalChan := make(chan os.Signal)
-	signal.Notify(signalChan, os.Interrupt, os.Kill, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGQUIT)
-	go exit(signalChan, &ccon)
+	// 全局的带宽限制被所有会话共用
+	bandwidth := connection.NewBandwidthLimit(config.CONFIG.BandwidthLimit, config.CONFIG.BandwidthBurst)
+
+	// 流量统计被所有会话共用，退出时保存
+	ledger, err := usage.Open(config.CONFIG.UsageFile)
+
+	if err != nil {
+		fmt.Println(err)
+		return ExitError
+	}
 
-	// 初始化 control connection
-	ccon.Init(config.CONFIG.ServerHostname, config.CONFIG.ServerPort, config.CONFIG.User, config.CONFIG.Password)
-	// 设置HTTP的配置
-	ccon.SetHTTPConfig(config.CONFIG.HttpHostname, config.CONFIG.HttpSubdomain, config.CONFIG.HttpAuth, config.CONFIG.HttpLocalPort)
-	// 设置HTTPS的配置
-	ccon.SetHTTPSConfig(config.CONFIG.HttpsHostname, config.CONFIG.HttpsSubdomain, config.CONFIG.HttpsAuth, config.CONFIG.HttpsLocalPort)
-	// 开始服务
-	err := ccon.Service()
+	defer func() {
+		if err := ledger.Close(); err != nil {
+			fmt.Println("save usage:", err)
+		}
+	}()
+
+	var allOpts []Options
+	for _, session := range sessions {
+		opts := optionsFromSession(config.CONFIG, session, len(sessions) > 1)
+		opts.Bandwidth = bandwidth
+		opts.Usage = ledger
+		allOpts = append(allOpts, opts)
+	}
+
+	group, err := NewGroup(allOpts, config.CONFIG.AdminAddr)
+
+	if err != nil {
+		fmt.Println(err)
+		return ExitError
+	}
 
-	fmt.Println(err)
+	// 处理关闭信号和重新加载配置的信号
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGQUIT)
 
+	handler := &signalHandler{group: group, shutdownErr: make(chan error, 1)}
+	go handler.handle(signalChan)
+
+	// 开始服务，启动失败的会话不影响其他会话，会话的错误已经通过 OnClose 输出
+	if err := group.Start(context.Background()); err != nil && !group.started {
+		fmt.Println(err)
+		return ExitError
+	}
+
+	err = group.Wait()
+
+	// 收到关闭信号时，等待代理连接结束
+	if handler.shuttingDown.Load() {
+		if err := <-handler.shutdownErr; err != nil {
+			fmt.Println("shutdown: active proxy connections were force closed:", err)
+			return ExitDrainTimeout
+		}
+
+		fmt.Println("shutdown: all proxy connections finished")
+		return ExitOK
+	}
+
+	if err != nil {
+		return ExitError
+	}
+
+	return ExitOK
 }
 
-func exit(signalChan chan os.Signal, ccon *connection.ControlConnection) {
+// optionsFromSession(conf *config.Configuration, session config.SessionConfiguration, prefixLogs bool) 将一个会话的配置转换为Client的配置
+// prefixLogs 为true时，日志前面加上会话的名字
+func optionsFromSession(conf *config.Configuration, session config.SessionConfiguration, prefixLogs bool) Options {
+	opts := Options{
+		Name:            session.Name,
+		ServerHostname:  session.ServerHostname,
+		ServerPort:      session.ServerPort,
+		User:            session.User,
+		Password:        session.Password,
+		Servers:         session.Servers,
+		ServerSelection: session.ServerSelection,
+		ReadBufSize:     conf.ReadBufSize,
+		MaxProxyCount:   conf.MaxProxyCount,
+	}
+
+	switch session.ProxyURL {
+	case config.NoProxy:
+	case "":
+		opts.Proxy = transport.ProxyFromEnvironment
+	default:
+		// 已经在 config.Validate() 中验证过
+		proxyURL, _ := transport.ParseProxyURL(session.ProxyURL)
+		opts.Proxy = transport.FixedProxy(proxyURL)
+	}
+
+	if session.TrustHostRootCerts {
+		// 使用系统的根证书验证服务器证书，ServerName 为连接的服务器的域名
+		opts.TLSConfig = &tls.Config{}
+	}
+
+	if session.TransportURL != "" {
+		// 网关只转发数据，在WebSocket上仍然和ngrokd进行TLS握手
+		opts.Dialer = &transport.TLSDialer{
+			Base:   &transport.WebSocketDialer{URL: session.TransportURL, Base: &transport.TCPDialer{Proxy: opts.Proxy}},
+			Config: opts.TLSConfig,
+		}
+	}
+
+	prefix := ""
+	if prefixLogs {
+		prefix = "[" + session.Name + "] "
+	}
+
+	for _, tunnel := range session.Tunnels {
+		// 已经在 config.Validate() 中验证过
+		allowCIDRs, _ := connection.ParseCIDRList(tunnel.AllowCIDRs)
+		denyCIDRs, _ := connection.ParseCIDRList(tunnel.DenyCIDRs)
+
+		tunnelOpts := TunnelOptions{Name: tunnel.Name, Proto: tunnel.Protocol, Hostname: tunnel.Hostname, Subdomain: tunnel.Subdomain, HttpAuth: tunnel.HttpAuth, RemotePort: tunnel.RemotePort, LocalPort: tunnel.LocalPort,
+			BandwidthLimit: tunnel.BandwidthLimit, BandwidthBurst: tunnel.BandwidthBurst, DailyQuota: tunnel.DailyQuota, MonthlyQuota: tunnel.MonthlyQuota,
+			AllowCIDRs: allowCIDRs, DenyCIDRs: denyCIDRs,
+			VisitorRate: tunnel.VisitorRate, VisitorBurst: tunnel.VisitorBurst, VisitorMaxConnections: int(tunnel.VisitorMaxConnections)}
 
-	sign := <-signalChan
+		if tunnel.Target != "" {
+			// 已经在 config.Validate() 中验证过
+			tunnelOpts.Root, _ = config.FileTargetRoot(tunnel.Target)
+			tunnelOpts.DirectoryListing = tunnel.DirectoryListing
+		}
 
-	fmt.Println(sign)
+		if auth := tunnel.ClientAuth; auth != nil {
+			tunnelOpts.Auth = &middleware.Auth{Realm: auth.Realm, BearerTokens: auth.BearerTokens}
+
+			if auth.Htpasswd != "" {
+				// 已经在 config.Validate() 中读取过，之后读取失败时没有用户，Basic 验证都不会通过
+				tunnelOpts.Auth.Users, _ = middleware.LoadHtpasswd(auth.Htpasswd)
+			}
+
+			if oauth := auth.OAuth; oauth != nil {
+				tunnelOpts.Auth.OAuth = &middleware.OAuth{
+					Issuer:          oauth.Issuer,
+					AuthURL:         oauth.AuthURL,
+					TokenURL:        oauth.TokenURL,
+					UserInfoURL:     oauth.UserInfoURL,
+					ClientID:        oauth.ClientID,
+					ClientSecret:    oauth.ClientSecret,
+					Scopes:          oauth.Scopes,
+					AllowEmails:     oauth.AllowEmails,
+					AllowDomains:    oauth.AllowDomains,
+					SessionDuration: time.Duration(oauth.SessionDuration) * time.Second,
+				}
+			}
+		}
+
+		if webhook := tunnel.Webhook; webhook != nil {
+			tunnelName := tunnel.Name
+			tunnelOpts.Webhook = &middleware.Webhook{
+				Provider:    webhook.Provider,
+				Secret:      webhook.Secret,
+				Header:      webhook.Header,
+				Tolerance:   time.Duration(webhook.Tolerance) * time.Second,
+				MaxBodySize: int64(webhook.MaxBodySize),
+				OnReject: func(r *http.Request, err error) {
+					fmt.Printf("%sWebhook %s %s to tunnel %s from %s rejected: %v\n", prefix, r.Method, r.URL.Path, tunnelName, r.RemoteAddr, err)
+				},
+			}
+		}
+
+		if headers := tunnel.Headers; headers != nil {
+			tunnelOpts.Headers = &middleware.Headers{
+				Host:           headers.Host,
+				RequestAdd:     headers.RequestAdd,
+				RequestRemove:  headers.RequestRemove,
+				ResponseAdd:    headers.ResponseAdd,
+				ResponseRemove: headers.ResponseRemove,
+				XForwarded:     headers.XForwarded,
+			}
+		}
+
+		opts.Tunnels = append(opts.Tunnels, tunnelOpts)
+	}
+
+	opts.Events.OnTunnel = func(tunnel connection.Tunnel) {
+		if tunnel.Root != "" {
+			fmt.Printf("%sTunnel %s established: %s -> %s\n", prefix, tunnel.Name, tunnel.Url, tunnel.Root)
+			return
+		}
+
+		fmt.Printf("%sTunnel %s established: %s -> 127.0.0.1:%d\n", prefix, tunnel.Name, tunnel.Url, tunnel.LocalPort)
+	}
+	opts.Events.OnTunnelError = func(name string, err error) {
+		fmt.Printf("%sTunnel %s failed: %v\n", prefix, name, err)
+	}
+	opts.Events.OnServerError = func(addr string, err error) {
+		fmt.Printf("%sServer %s failed, trying next server: %v\n", prefix, addr, err)
+	}
+	opts.Events.OnProxyReject = func(proxy connection.ProxyInfo, err error) {
+		fmt.Printf("%sProxy connection from %s rejected: %v\n", prefix, proxy.ClientAddr, err)
+	}
+	opts.Events.OnClose = func(err error) {
+		if err != nil {
+			fmt.Printf("%s%v\n", prefix, err)
+		}
+	}
+
+	return opts
+}
+
+// Validate(args []string) 验证配置文件和命令行参数，返回进程的退出码
+// 用于 ngrok-client validate -config file
+func Validate(args []string) int {
+	if err := config.ParseFlags(args); err != nil {
+		return ExitError
+	}
+
+	conf, err := config.Load()
+
+	if err != nil {
+		fmt.Println(err)
+		return ExitError
+	}
+
+	for _, session := range conf.AllSessions() {
+		fmt.Printf("config ok: session %s: %s, %d tunnel(s)\n", session.Name, strings.Join(session.ServerAddresses(), ", "), len(session.Tunnels))
+	}
+
+	return ExitOK
+}
+
+// signalHandler 处理进程收到的信号
+type signalHandler struct {
+	group *Group
+
+	// 是否已经开始优雅关闭
+	shuttingDown atomic.Bool
+	// 取消优雅关闭的等待，强制关闭代理连接
+	forceClose context.CancelFunc
+	// 优雅关闭的结果
+	shutdownErr chan error
+}
+
+// handle(signalChan chan os.Signal) SIGHUP 时重新加载配置；SIGTERM/SIGINT 时优雅关闭，
+// 第二次收到时强制关闭；SIGQUIT 时马上关闭
+func (handler *signalHandler) handle(signalChan chan os.Signal) {
+
+	for sign := range signalChan {
+
+		fmt.Println(sign)
+
+		switch sign {
+		case syscall.SIGHUP:
+			reload(handler.group)
+		case syscall.SIGQUIT:
+			if handler.shuttingDown.Load() {
+				handler.forceClose()
+			}
+			handler.group.Close()
+		default:
+			if handler.shuttingDown.Load() {
+				handler.forceClose()
+				continue
+			}
+
+			gracePeriod := time.Duration(config.CONFIG.GracePeriod) * time.Second
+			fmt.Printf("shutdown: waiting up to %s for active proxy connections, send again to force close\n", gracePeriod)
+
+			ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+			handler.forceClose = cancel
+			handler.shuttingDown.Store(true)
+
+			go func() {
+				defer cancel()
+				handler.shutdownErr <- handler.group.Shutdown(ctx)
+			}()
+		}
+	}
+}
+
+// reload(group *Group) 重新读取配置文件和环境变量，按新的配置更新每个会话的隧道
+// 配置有错误时继续使用原来的配置；服务器等其他配置的修改和会话的增减需要重启才能生效
+func reload(group *Group) {
+	conf, err := config.Load()
+
+	if err != nil {
+		fmt.Println("reload config failed, keep running with the old config:")
+		fmt.Println(err)
+		return
+	}
+
+	oldSessions := config.CONFIG.AllSessions()
+	sessions := conf.AllSessions()
+
+	restart := len(oldSessions) != len(sessions) || conf.ReadBufSize != config.CONFIG.ReadBufSize ||
+		conf.MaxProxyCount != config.CONFIG.MaxProxyCount || conf.AdminAddr != config.CONFIG.AdminAddr ||
+		conf.BandwidthLimit != config.CONFIG.BandwidthLimit || conf.BandwidthBurst != config.CONFIG.BandwidthBurst ||
+		conf.UsageFile != config.CONFIG.UsageFile
+
+	for i, session := range sessions {
+		if i < len(oldSessions) && !sameSessionSettings(oldSessions[i], session) {
+			restart = true
+		}
+
+		client := group.Client(session.Name)
+		if client == nil {
+			restart = true
+			continue
+		}
+
+		opts := optionsFromSession(conf, session, len(sessions) > 1)
+
+		if err := client.UpdateTunnels(opts.Tunnels); err != nil {
+			fmt.Printf("reload config: session %s: %v\n", session.Name, err)
+		}
+	}
+
+	if restart {
+		fmt.Println("reload config: only tunnel changes are applied, restart to apply other changes")
+	}
+
+	config.CONFIG = conf
+
+	fmt.Println("config reloaded")
+}
 
-	ccon.Close()
+// sameSessionSettings(old, session config.SessionConfiguration) 两个会话除了隧道之外的配置是否相同
+func sameSessionSettings(old, session config.SessionConfiguration) bool {
+	return old.Name == session.Name && old.ServerHostname == session.ServerHostname && old.ServerPort == session.ServerPort &&
+		slices.Equal(old.Servers, session.Servers) && old.ServerSelection == session.ServerSelection &&
+		old.User == session.User && old.Password == session.Password && old.TrustHostRootCerts == session.TrustHostRootCerts &&
+		old.ProxyURL == session.ProxyURL && old.TransportURL == session.TransportURL
 }
 
 func exceptionPrecess() {
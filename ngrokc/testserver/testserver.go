@@ -0,0 +1,595 @@
+// testserver 实现了ngrokd服务端协议的一个进程内假服务器，用于集成测试
+//
+// 服务器在回环地址上监听TLS，处理 Auth/ReqTunnel/RegProxy/Ping，
+// 每条隧道会打开一个回环地址上的公网端口，访问该端口的连接会通过 ReqProxy/StartProxy 交给客户端代理。
+// 通过 Server 上的钩子可以注入错误、延迟、分片的命令和断开连接。
+package testserver
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"ngrok-client/ngrokc/util"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 等待客户端 RegProxy 的超时时间
+const proxyTimeout = 10 * time.Second
+
+// Server 假的ngrokd服务器，钩子需要在 Start() 之前设置
+type Server struct {
+	// 返回非空字符串时，AuthResp 返回该错误信息
+	AuthError func(auth util.Auth) string
+
+	// 返回非空字符串时，NewTunnel 返回该错误信息
+	TunnelError func(req util.ReqTunnel) string
+
+	// 每条命令发送前的延迟
+	Delay time.Duration
+
+	// 大于0时，每条命令分成多次写入，每次最多 FragmentSize 个字节
+	FragmentSize int
+
+	// 为true时，StartProxy 命令和访问者发送的第一段数据在同一次写入中发送
+	CoalesceStartProxy bool
+
+	// 为true时，不回复 Ping
+	IgnorePing bool
+
+	listener net.Listener
+	// 服务器证书，https隧道的公网端口也使用它
+	tlsConfig *tls.Config
+
+	mutex sync.Mutex
+	// 以ClientId为key的控制连接
+	sessions map[string]*session
+	// 所有打开的连接，Close()时关闭
+	conns  map[net.Conn]bool
+	closed bool
+	// Close()时关闭，通知等待中的goroutine退出
+	quit chan bool
+
+	wg sync.WaitGroup
+}
+
+// session 一个客户端的控制连接
+type session struct {
+	server   *Server
+	conn     net.Conn
+	clientId string
+
+	// 写控制连接的锁
+	writeMutex sync.Mutex
+
+	// 客户端通过 RegProxy 建立的代理连接
+	proxies chan *proxyConn
+
+	// 控制连接断开时关闭
+	done chan bool
+
+	mutex   sync.Mutex
+	tunnels []*tunnel
+}
+
+// tunnel 一条隧道和它的公网端口
+type tunnel struct {
+	url      string
+	listener net.Listener
+}
+
+// Start() 在回环地址的随机端口上开始监听
+func (server *Server) Start() error {
+	cert, err := selfSignedCert()
+
+	if err != nil {
+		return err
+	}
+
+	server.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server.tlsConfig)
+
+	if err != nil {
+		return err
+	}
+
+	server.listener = listener
+	server.sessions = make(map[string]*session)
+	server.conns = make(map[net.Conn]bool)
+	server.quit = make(chan bool)
+
+	server.spawn(server.accept)
+
+	return nil
+}
+
+// Addr() 服务器的地址 ip:port
+func (server *Server) Addr() string {
+	return server.listener.Addr().String()
+}
+
+// Host() 服务器的IP
+func (server *Server) Host() string {
+	return server.listener.Addr().(*net.TCPAddr).IP.String()
+}
+
+// Port() 服务器的端口
+func (server *Server) Port() uint {
+	return uint(server.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Close() 关闭服务器和所有连接，等待所有goroutine退出，可以重复调用
+func (server *Server) Close() {
+	server.mutex.Lock()
+	if server.closed {
+		server.mutex.Unlock()
+		server.wg.Wait()
+		return
+	}
+	server.closed = true
+	close(server.quit)
+	for conn := range server.conns {
+		conn.Close()
+	}
+	for _, sess := range server.sessions {
+		sess.closeTunnels()
+	}
+	server.mutex.Unlock()
+
+	server.listener.Close()
+
+	server.wg.Wait()
+}
+
+// Disconnect() 断开所有客户端的控制连接，模拟服务端断线
+func (server *Server) Disconnect() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	for clientId, sess := range server.sessions {
+		sess.conn.Close()
+		sess.closeTunnels()
+		delete(server.sessions, clientId)
+	}
+}
+
+// WriteRaw(data []byte) 在所有控制连接上直接写入数据，用于发送畸形的命令
+func (server *Server) WriteRaw(data []byte) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	for _, sess := range server.sessions {
+		sess.writeMutex.Lock()
+		sess.conn.Write(data)
+		sess.writeMutex.Unlock()
+	}
+}
+
+// Sessions() 当前控制连接的数量
+func (server *Server) Sessions() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return len(server.sessions)
+}
+
+func (server *Server) spawn(f func()) {
+	server.wg.Add(1)
+
+	go func() {
+		defer server.wg.Done()
+		f()
+	}()
+}
+
+// track(conn net.Conn) 记录连接，服务器已经关闭时返回false
+func (server *Server) track(conn net.Conn) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.closed {
+		conn.Close()
+		return false
+	}
+
+	server.conns[conn] = true
+
+	return true
+}
+
+func (server *Server) untrack(conn net.Conn) {
+	server.mutex.Lock()
+	delete(server.conns, conn)
+	server.mutex.Unlock()
+
+	conn.Close()
+}
+
+// ServeConn(conn net.Conn) 在已经建立的连接(例如内存管道)上进行TLS握手并处理，不阻塞
+func (server *Server) ServeConn(conn net.Conn) {
+	tlsConn := tls.Server(conn, server.tlsConfig)
+
+	if !server.track(tlsConn) {
+		return
+	}
+
+	server.spawn(func() {
+		defer server.untrack(tlsConn)
+		server.handle(tlsConn)
+	})
+}
+
+// accept() 接受客户端的连接，根据第一条命令区分控制连接和代理连接
+func (server *Server) accept() {
+	for {
+		conn, err := server.listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		if !server.track(conn) {
+			return
+		}
+
+		server.spawn(func() {
+			defer server.untrack(conn)
+			server.handle(conn)
+		})
+	}
+}
+
+// message 客户端发送的命令
+type message struct {
+	Type    string
+	Payload json.RawMessage
+}
+
+func readMessage(reader io.Reader) (message, error) {
+	var msg message
+
+	content, err := util.ReadFrame(reader)
+
+	if err != nil {
+		return msg, err
+	}
+
+	err = json.Unmarshal(content, &msg)
+
+	return msg, err
+}
+
+// handle(conn net.Conn) 处理一条客户端的连接
+func (server *Server) handle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+
+	msg, err := readMessage(reader)
+
+	if err != nil {
+		return
+	}
+
+	switch msg.Type {
+	case util.AUTH_TYPE:
+		var auth util.Auth
+		if json.Unmarshal(msg.Payload, &auth) != nil {
+			return
+		}
+		server.serveControl(conn, reader, auth)
+
+	case util.REG_PROXY_TYPE:
+		var regProxy util.RegProxy
+		if json.Unmarshal(msg.Payload, &regProxy) != nil {
+			return
+		}
+
+		server.mutex.Lock()
+		sess := server.sessions[regProxy.ClientId]
+		server.mutex.Unlock()
+
+		if sess == nil {
+			return
+		}
+
+		done := make(chan bool)
+		select {
+		case sess.proxies <- &proxyConn{Conn: conn, reader: reader, done: done}:
+			// 代理连接由 serveVisitor() 使用，等待它用完
+			<-done
+		case <-time.After(proxyTimeout):
+		case <-server.quit:
+		}
+	}
+}
+
+// serveControl() 处理控制连接
+func (server *Server) serveControl(conn net.Conn, reader *bufio.Reader, auth util.Auth) {
+	if server.AuthError != nil {
+		if msg := server.AuthError(auth); msg != "" {
+			server.writeFrame(conn, util.AuthResp{Version: "2", MmVersion: "1.7", Error: msg}, util.AUTH_RESP_TYPE)
+			return
+		}
+	}
+
+	sess := &session{server: server, conn: conn, clientId: util.RandomId(), proxies: make(chan *proxyConn), done: make(chan bool)}
+
+	server.mutex.Lock()
+	server.sessions[sess.clientId] = sess
+	server.mutex.Unlock()
+
+	defer func() {
+		server.mutex.Lock()
+		delete(server.sessions, sess.clientId)
+		server.mutex.Unlock()
+
+		sess.closeTunnels()
+		close(sess.done)
+	}()
+
+	if err := sess.write(util.AuthResp{Version: "2", MmVersion: "1.7", ClientId: sess.clientId}, util.AUTH_RESP_TYPE); err != nil {
+		return
+	}
+
+	for {
+		msg, err := readMessage(reader)
+
+		if err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case util.REQ_TUNNEL_TYPE:
+			var req util.ReqTunnel
+			if json.Unmarshal(msg.Payload, &req) != nil {
+				return
+			}
+			sess.newTunnel(req)
+
+		case util.PING_TYPE:
+			if !server.IgnorePing {
+				sess.write(util.Pong{}, util.PONG_TYPE)
+			}
+		}
+	}
+}
+
+// newTunnel(req util.ReqTunnel) 打开公网端口并返回 NewTunnel
+func (sess *session) newTunnel(req util.ReqTunnel) {
+	server := sess.server
+
+	if server.TunnelError != nil {
+		if msg := server.TunnelError(req); msg != "" {
+			sess.write(util.NewTunnel{ReqId: req.ReqId, Protocol: req.Protocol, Error: msg}, util.NEW_TUNNEL_TYPE)
+			return
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		sess.write(util.NewTunnel{ReqId: req.ReqId, Protocol: req.Protocol, Error: err.Error()}, util.NEW_TUNNEL_TYPE)
+		return
+	}
+
+	// 和ngrokd一样，https隧道在公网端口上解密，明文交给客户端
+	if req.Protocol == util.PROTOCOL_HTTPS {
+		listener = tls.NewListener(listener, server.tlsConfig)
+	}
+
+	t := &tunnel{url: req.Protocol + "://" + listener.Addr().String(), listener: listener}
+
+	sess.mutex.Lock()
+	sess.tunnels = append(sess.tunnels, t)
+	sess.mutex.Unlock()
+
+	server.spawn(func() {
+		for {
+			visitor, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			if !server.track(visitor) {
+				return
+			}
+
+			server.spawn(func() {
+				defer server.untrack(visitor)
+				sess.serveVisitor(t, visitor)
+			})
+		}
+	})
+
+	sess.write(util.NewTunnel{ReqId: req.ReqId, Url: t.url, Protocol: req.Protocol}, util.NEW_TUNNEL_TYPE)
+}
+
+// proxyConn 客户端的代理连接，reader 中可能有已经缓存的数据
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	done   chan bool
+}
+
+func (conn *proxyConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+// serveVisitor() 请求客户端建立代理连接，然后在访问者和代理连接之间转发数据
+func (sess *session) serveVisitor(t *tunnel, visitor net.Conn) {
+	if err := sess.write(util.ReqProxy{}, util.REQ_PROXY_TYPE); err != nil {
+		return
+	}
+
+	var conn *proxyConn
+
+	select {
+	case conn = <-sess.proxies:
+	case <-time.After(proxyTimeout):
+		return
+	case <-sess.done:
+		return
+	case <-sess.server.quit:
+		return
+	}
+
+	defer close(conn.done)
+
+	frame, err := util.PayloadStructToBytes(util.StartProxy{Url: t.url, ClientAddr: visitor.RemoteAddr().String()}, util.START_PROXY_TYPE)
+
+	if err != nil {
+		return
+	}
+
+	if sess.server.CoalesceStartProxy {
+		// 读取访问者的第一段数据，和 StartProxy 一起发送
+		buf := make([]byte, 4096)
+		n, err := visitor.Read(buf)
+
+		if err != nil {
+			return
+		}
+
+		frame = append(frame, buf[:n]...)
+	}
+
+	if err := sess.server.writeBytes(conn, frame); err != nil {
+		return
+	}
+
+	done := make(chan bool, 2)
+
+	go func() {
+		io.Copy(conn, visitor)
+		conn.Close()
+		done <- true
+	}()
+
+	go func() {
+		io.Copy(visitor, conn)
+		visitor.Close()
+		done <- true
+	}()
+
+	<-done
+	<-done
+}
+
+// closeTunnels() 关闭所有隧道的公网端口
+func (sess *session) closeTunnels() {
+	sess.mutex.Lock()
+	defer sess.mutex.Unlock()
+
+	for _, t := range sess.tunnels {
+		t.listener.Close()
+	}
+
+	sess.tunnels = nil
+}
+
+// write() 在控制连接上发送一条命令
+func (sess *session) write(payload interface{}, payloadType string) error {
+	sess.writeMutex.Lock()
+	defer sess.writeMutex.Unlock()
+
+	return sess.server.writeFrame(sess.conn, payload, payloadType)
+}
+
+// writeFrame() 发送一条命令，会应用 Delay 和 FragmentSize
+func (server *Server) writeFrame(conn net.Conn, payload interface{}, payloadType string) error {
+	frame, err := util.PayloadStructToBytes(payload, payloadType)
+
+	if err != nil {
+		return err
+	}
+
+	return server.writeBytes(conn, frame)
+}
+
+// writeBytes() 发送数据，会应用 Delay 和 FragmentSize
+func (server *Server) writeBytes(conn net.Conn, data []byte) error {
+	if server.Delay > 0 {
+		time.Sleep(server.Delay)
+	}
+
+	size := len(data)
+	if server.FragmentSize > 0 {
+		size = server.FragmentSize
+	}
+
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+
+		if _, err := conn.Write(data[:n]); err != nil {
+			return err
+		}
+
+		data = data[n:]
+	}
+
+	return nil
+}
+
+// selfSignedCert() 生成回环地址的自签名证书
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "ngrokd testserver"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:     []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// LocalPort(addr string) 从 ip:port 形式的地址(如 httptest.Server.Listener.Addr())中取出端口，方便设置隧道的本地端口
+func LocalPort(addr string) (uint, error) {
+	_, port, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.ParseUint(port, 10, 16)
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid port in %s", addr)
+	}
+
+	if n == 0 {
+		return 0, errors.New("port is 0")
+	}
+
+	return uint(n), nil
+}
@@ -0,0 +1,71 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// Dialer 连接ngrok服务器的方式，控制连接和代理连接都通过它建立
+// 返回的连接上直接收发ngrok协议的数据，需要加密时由Dialer负责(例如 TLSDialer)
+// 可以自己实现，例如测试用的内存管道、WebSocket、SSH端口转发或者多级代理
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// DialerFunc 把函数转换为 Dialer
+type DialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f DialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// TCPDialer 普通的TCP连接，Proxy 不为nil时经过 HTTP CONNECT/SOCKS5 代理
+type TCPDialer struct {
+	Proxy ProxyFunc
+}
+
+func (dialer *TCPDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return Dial(ctx, dialer.Proxy, addr)
+}
+
+// TLSDialer 在 Base 建立的连接上进行TLS握手，ngrokd默认使用的方式
+type TLSDialer struct {
+	// 底层的连接，为nil时使用直接连接的 TCPDialer
+	Base Dialer
+
+	// TLS配置，为nil时不验证服务器证书；ServerName 为空时使用addr中的host
+	Config *tls.Config
+}
+
+func (dialer *TLSDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	base := dialer.Base
+	if base == nil {
+		base = &TCPDialer{}
+	}
+
+	rawConn, err := base.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := dialer.Config
+	if config == nil {
+		// 无视ssl证书，仅用于测试
+		config = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	if host, _, err := net.SplitHostPort(addr); err == nil && config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(rawConn, config)
+
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
@@ -0,0 +1,137 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// getOver(t *testing.T, conn net.Conn) 在conn上发送一个HTTP请求，返回状态码
+func getOver(t *testing.T, conn net.Conn) int {
+	t.Helper()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("GET / HTTP/1.0\r\nHost: test\r\n\r\n")); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestTLSDialer(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	addr := server.Listener.Addr().String()
+	roots := server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// ServerName 为空时使用addr中的host验证证书
+	dialer := &TLSDialer{Config: &tls.Config{RootCAs: roots}}
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	defer conn.Close()
+
+	if status := getOver(t, conn); status != http.StatusNoContent {
+		t.Fatalf("status = %d", status)
+	}
+
+	// 不信任的证书
+	if conn, err := (&TLSDialer{Config: &tls.Config{}}).DialContext(ctx, "tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("DialContext with untrusted certificate succeeded")
+	}
+
+	// 没有配置时不验证证书
+	conn, err = (&TLSDialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		t.Fatalf("DialContext without config: %v", err)
+	}
+	conn.Close()
+}
+
+func TestTLSDialerBase(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	var dials atomic.Int32
+	var dialedAddr atomic.Value
+
+	// 忽略地址，连接到固定的服务器，TLS握手在 Base 返回的连接上进行
+	base := DialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		dialedAddr.Store(addr)
+
+		return (&TCPDialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := (&TLSDialer{Base: base}).DialContext(ctx, "tcp", "ngrok.example.com:4443")
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	defer conn.Close()
+
+	if status := getOver(t, conn); status != http.StatusNoContent {
+		t.Fatalf("status = %d", status)
+	}
+
+	if dials.Load() != 1 || dialedAddr.Load() != "ngrok.example.com:4443" {
+		t.Fatalf("base dials = %d, addr = %v", dials.Load(), dialedAddr.Load())
+	}
+
+	if state := conn.(*tls.Conn).ConnectionState(); state.ServerName != "ngrok.example.com" {
+		t.Fatalf("ServerName = %q", state.ServerName)
+	}
+}
+
+func TestTLSDialerHandshakeCanceled(t *testing.T) {
+	// 不回应握手的服务器
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if conn, err := (&TLSDialer{}).DialContext(ctx, "tcp", listener.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("DialContext succeeded without handshake")
+	}
+}
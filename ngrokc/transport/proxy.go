@@ -0,0 +1,431 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 代理的协议
+const (
+	PROXY_HTTP    = "http"
+	PROXY_HTTPS   = "https"
+	PROXY_SOCKS5  = "socks5"
+	PROXY_SOCKS5H = "socks5h"
+)
+
+// 设置为连接的deadline，使阻塞中的读写马上返回
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ProxyFunc 根据要连接的地址(host:port)返回使用的代理，返回nil表示直接连接
+type ProxyFunc func(addr string) (*url.URL, error)
+
+// ParseProxyURL(rawURL string) 解析代理地址，没有协议时默认为 http
+// 支持 http://[user:password@]host[:port]，https://，socks5:// 和 socks5h://(由代理解析域名)
+func ParseProxyURL(rawURL string) (*url.URL, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = PROXY_HTTP + "://" + rawURL
+	}
+
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch proxyURL.Scheme {
+	case PROXY_HTTP, PROXY_HTTPS, PROXY_SOCKS5, PROXY_SOCKS5H:
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+
+	if proxyURL.Hostname() == "" {
+		return nil, fmt.Errorf("proxy %q has no host", rawURL)
+	}
+
+	return proxyURL, nil
+}
+
+// FixedProxy(proxyURL *url.URL) 所有地址都使用同一个代理
+func FixedProxy(proxyURL *url.URL) ProxyFunc {
+	return func(addr string) (*url.URL, error) {
+		return proxyURL, nil
+	}
+}
+
+// ProxyFromEnvironment(addr string) 根据环境变量选择代理
+// 依次使用 HTTPS_PROXY、ALL_PROXY(以及小写的版本)，addr 匹配 NO_PROXY 或者是本机地址时直接连接
+func ProxyFromEnvironment(addr string) (*url.URL, error) {
+	rawURL := getEnv("HTTPS_PROXY", "https_proxy")
+	if rawURL == "" {
+		rawURL = getEnv("ALL_PROXY", "all_proxy")
+	}
+
+	if rawURL == "" || !useProxy(addr, getEnv("NO_PROXY", "no_proxy")) {
+		return nil, nil
+	}
+
+	return ParseProxyURL(rawURL)
+}
+
+// getEnv(names ...string) 返回第一个不为空的环境变量
+func getEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// useProxy(addr, noProxy string) 判断addr是否需要使用代理
+// noProxy 是逗号分隔的列表，每一项可以是 *、域名(同时匹配子域名)、.域名(只匹配子域名)、IP、CIDR，可以带 :端口
+func useProxy(addr, noProxy string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+
+	ip := net.ParseIP(host)
+
+	if host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return false
+	}
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+
+		if entry == "" {
+			continue
+		}
+
+		if entry == "*" {
+			return false
+		}
+
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return false
+			}
+			continue
+		}
+
+		// 带端口时，端口也需要匹配
+		if entryHost, entryPort, err := net.SplitHostPort(entry); err == nil {
+			if entryPort != port {
+				continue
+			}
+			entry = entryHost
+		}
+
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return false
+			}
+			continue
+		}
+
+		if strings.HasPrefix(entry, ".") {
+			if strings.HasSuffix(host, entry) {
+				return false
+			}
+			continue
+		}
+
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Dial(ctx context.Context, proxy ProxyFunc, addr string) 连接addr，proxy 为nil或者返回nil时直接连接
+// 通过代理连接时，返回的连接已经完成了代理的握手，可以直接在上面建立TLS
+func Dial(ctx context.Context, proxy ProxyFunc, addr string) (net.Conn, error) {
+	var proxyURL *url.URL
+
+	if proxy != nil {
+		var err error
+		if proxyURL, err = proxy(addr); err != nil {
+			return nil, err
+		}
+	}
+
+	dialer := &net.Dialer{}
+
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	rawConn, err := dialer.DialContext(ctx, "tcp", proxyAddr(proxyURL))
+	if err != nil {
+		return nil, fmt.Errorf("connect proxy %s: %w", proxyURL.Host, err)
+	}
+
+	// 握手过程中ctx被取消时，使阻塞的读写返回
+	stop := context.AfterFunc(ctx, func() { rawConn.SetDeadline(aLongTimeAgo) })
+	defer stop()
+
+	var conn net.Conn
+
+	switch proxyURL.Scheme {
+	case PROXY_HTTPS:
+		tlsConn := tls.Client(rawConn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err = tlsConn.HandshakeContext(ctx); err == nil {
+			conn, err = httpConnect(tlsConn, proxyURL, addr)
+		}
+	case PROXY_SOCKS5, PROXY_SOCKS5H:
+		conn, err = socks5Connect(ctx, rawConn, proxyURL, addr)
+	default:
+		conn, err = httpConnect(rawConn, proxyURL, addr)
+	}
+
+	if err == nil && !stop() {
+		// ctx 已经被取消，deadline已经被设置
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxyURL.Host, err)
+	}
+
+	return conn, nil
+}
+
+// proxyAddr(proxyURL *url.URL) 代理的地址，没有端口时使用默认端口
+func proxyAddr(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+
+	switch proxyURL.Scheme {
+	case PROXY_HTTPS:
+		return net.JoinHostPort(proxyURL.Hostname(), "443")
+	case PROXY_SOCKS5, PROXY_SOCKS5H:
+		return net.JoinHostPort(proxyURL.Hostname(), "1080")
+	default:
+		return net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+}
+
+// httpConnect(conn net.Conn, proxyURL *url.URL, addr string) 发送 HTTP CONNECT 请求，有用户名时使用 Basic 验证
+func httpConnect(conn net.Conn, proxyURL *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := proxyURL.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// 成功时后面的数据都属于隧道，不能读取 Body
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New("CONNECT " + addr + ": " + resp.Status)
+	}
+
+	// 代理可能已经发送了服务器的数据
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn 先读取缓存中的数据
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+// socks5Connect(ctx context.Context, conn net.Conn, proxyURL *url.URL, addr string) SOCKS5 握手(RFC 1928/1929)
+// socks5 在本地解析域名，socks5h 由代理解析域名
+func socks5Connect(ctx context.Context, conn net.Conn, proxyURL *url.URL, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, errors.New("invalid port " + portStr)
+	}
+
+	// 验证方式: 0 不需要验证，2 用户名密码
+	methods := []byte{0}
+	if proxyURL.User != nil {
+		methods = []byte{0, 2}
+	}
+
+	if _, err := conn.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+
+	if reply[0] != 5 {
+		return nil, errors.New("not a socks5 proxy")
+	}
+
+	switch reply[1] {
+	case 0:
+	case 2:
+		if proxyURL.User == nil {
+			return nil, errors.New("socks5 proxy requires authentication")
+		}
+
+		username := proxyURL.User.Username()
+		password, _ := proxyURL.User.Password()
+
+		if len(username) > 255 || len(password) > 255 {
+			return nil, errors.New("socks5 username or password too long")
+		}
+
+		auth := []byte{1, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+
+		if _, err := conn.Write(auth); err != nil {
+			return nil, err
+		}
+
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, err
+		}
+
+		if reply[1] != 0 {
+			return nil, errors.New("socks5 authentication failed")
+		}
+	default:
+		return nil, errors.New("socks5 proxy has no acceptable authentication method")
+	}
+
+	req := []byte{5, 1, 0}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil && proxyURL.Scheme == PROXY_SOCKS5 {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		ip = ips[0]
+	}
+
+	switch {
+	case ip == nil:
+		if len(host) > 255 {
+			return nil, errors.New("socks5 host name too long")
+		}
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	case ip.To4() != nil:
+		req = append(req, 1)
+		req = append(req, ip.To4()...)
+	default:
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	}
+
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	// VER REP RSV ATYP
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+
+	if header[1] != 0 {
+		return nil, fmt.Errorf("socks5 connect %s failed: %s", addr, socks5Reply(header[1]))
+	}
+
+	// 跳过 BND.ADDR 和 BND.PORT
+	var skip int
+	switch header[3] {
+	case 1:
+		skip = net.IPv4len + 2
+	case 4:
+		skip = net.IPv6len + 2
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		skip = int(length[0]) + 2
+	default:
+		return nil, errors.New("socks5 reply has unknown address type")
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, skip)); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// socks5Reply(code byte) SOCKS5 错误码的描述
+func socks5Reply(code byte) string {
+	switch code {
+	case 1:
+		return "general failure"
+	case 2:
+		return "connection not allowed by ruleset"
+	case 3:
+		return "network unreachable"
+	case 4:
+		return "host unreachable"
+	case 5:
+		return "connection refused"
+	case 6:
+		return "TTL expired"
+	case 7:
+		return "command not supported"
+	case 8:
+		return "address type not supported"
+	default:
+		return "unknown error " + strconv.Itoa(int(code))
+	}
+}
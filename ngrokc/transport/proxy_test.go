@@ -0,0 +1,383 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUseProxy(t *testing.T) {
+	tests := []struct {
+		addr    string
+		noProxy string
+		want    bool
+	}{
+		{"ngrok.example.com:4443", "", true},
+		{"localhost:4443", "", false},
+		{"127.0.0.1:4443", "", false},
+		{"ngrok.example.com:4443", "*", false},
+		{"ngrok.example.com:4443", "example.com", false},
+		{"example.com:4443", "example.com", false},
+		{"notexample.com:4443", "example.com", true},
+		{"example.com:4443", ".example.com", true},
+		{"ngrok.example.com:4443", ".example.com", false},
+		{"ngrok.example.com:4443", "other.com, EXAMPLE.com", false},
+		{"ngrok.example.com:4443", "example.com:443", true},
+		{"ngrok.example.com:4443", "example.com:4443", false},
+		{"10.1.2.3:4443", "10.0.0.0/8", false},
+		{"11.1.2.3:4443", "10.0.0.0/8", true},
+		{"10.1.2.3:4443", "10.1.2.3", false},
+		{"[2001:db8::1]:4443", "2001:db8::/32", false},
+	}
+
+	for _, test := range tests {
+		if got := useProxy(test.addr, test.noProxy); got != test.want {
+			t.Errorf("useProxy(%q, %q) = %v, want %v", test.addr, test.noProxy, got, test.want)
+		}
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy", "NO_PROXY", "no_proxy"} {
+		t.Setenv(name, "")
+	}
+
+	if proxyURL, err := ProxyFromEnvironment("ngrok.example.com:4443"); proxyURL != nil || err != nil {
+		t.Fatalf("no env = %v, %v", proxyURL, err)
+	}
+
+	t.Setenv("ALL_PROXY", "socks5://socks.example.com:1080")
+
+	if proxyURL, _ := ProxyFromEnvironment("ngrok.example.com:4443"); proxyURL == nil || proxyURL.Host != "socks.example.com:1080" {
+		t.Fatalf("ALL_PROXY = %v", proxyURL)
+	}
+
+	t.Setenv("https_proxy", "proxy.example.com:3128")
+
+	if proxyURL, _ := ProxyFromEnvironment("ngrok.example.com:4443"); proxyURL == nil || proxyURL.String() != "http://proxy.example.com:3128" {
+		t.Fatalf("https_proxy = %v, want it to take precedence over ALL_PROXY", proxyURL)
+	}
+
+	t.Setenv("NO_PROXY", "example.com")
+
+	if proxyURL, _ := ProxyFromEnvironment("ngrok.example.com:4443"); proxyURL != nil {
+		t.Fatalf("NO_PROXY matched, got %v", proxyURL)
+	}
+
+	t.Setenv("NO_PROXY", "")
+	t.Setenv("https_proxy", "ftp://proxy.example.com")
+
+	if _, err := ProxyFromEnvironment("ngrok.example.com:4443"); err == nil {
+		t.Fatal("unsupported scheme accepted")
+	}
+}
+
+// echoServer() 回显数据的TCP服务
+func echoServer(t *testing.T) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	t.Cleanup(func() { listener.Close() })
+
+	return listener
+}
+
+// connectProxy() HTTP CONNECT 代理，auth 不为空时要求 Proxy-Authorization，记录请求的地址
+func connectProxy(t *testing.T, username, password string) (*url.URL, *[]string) {
+	t.Helper()
+
+	var mutex sync.Mutex
+	var targets []string
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if user, pass, ok := parseProxyAuth(r); username != "" && (!ok || user != username || pass != password) {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		mutex.Lock()
+		targets = append(targets, r.Host)
+		mutex.Unlock()
+
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+		go func() {
+			io.Copy(target, buf)
+			target.Close()
+		}()
+		io.Copy(conn, target)
+		conn.Close()
+	})}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	proxyURL := &url.URL{Scheme: PROXY_HTTP, Host: listener.Addr().String()}
+	if username != "" {
+		proxyURL.User = url.UserPassword(username, password)
+	}
+
+	return proxyURL, &targets
+}
+
+func parseProxyAuth(r *http.Request) (string, string, bool) {
+	r.Header.Set("Authorization", r.Header.Get("Proxy-Authorization"))
+	return r.BasicAuth()
+}
+
+// socks5Proxy() 支持用户名密码验证的SOCKS5代理，记录请求的地址类型和地址
+func socks5Proxy(t *testing.T, username, password string) (string, chan string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	requests := make(chan string, 10)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, username, password, requests)
+		}
+	}()
+
+	return listener.Addr().String(), requests
+}
+
+func serveSOCKS5(conn net.Conn, username, password string, requests chan string) {
+	defer conn.Close()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+
+	methods := make([]byte, header[1])
+	io.ReadFull(conn, methods)
+
+	if username == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+
+		io.ReadFull(conn, header)
+		user := make([]byte, header[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, header[:1])
+		pass := make([]byte, header[0])
+		io.ReadFull(conn, pass)
+
+		if string(user) != username || string(pass) != password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		io.ReadFull(conn, header[:1])
+		name := make([]byte, header[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	requests <- fmt.Sprintf("%d %s", req[3], addr)
+
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+}
+
+func TestDialDirect(t *testing.T) {
+	echo := echoServer(t)
+
+	conn, err := Dial(context.Background(), nil, echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	assertEcho(t, conn)
+}
+
+func TestDialHTTPConnect(t *testing.T) {
+	echo := echoServer(t)
+	proxyURL, targets := connectProxy(t, "user", "p@ss")
+
+	conn, err := Dial(context.Background(), FixedProxy(proxyURL), echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	assertEcho(t, conn)
+
+	if len(*targets) != 1 || (*targets)[0] != echo.Addr().String() {
+		t.Fatalf("proxy targets = %v", *targets)
+	}
+
+	proxyURL.User = url.UserPassword("user", "wrong")
+
+	if _, err := Dial(context.Background(), FixedProxy(proxyURL), echo.Addr().String()); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("Dial with wrong password = %v, want 407", err)
+	}
+}
+
+func TestDialSOCKS5(t *testing.T) {
+	echo := echoServer(t)
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	addr, requests := socks5Proxy(t, "user", "secret")
+
+	// socks5h 由代理解析域名
+	conn, err := Dial(context.Background(), FixedProxy(&url.URL{Scheme: PROXY_SOCKS5H, Host: addr, User: url.UserPassword("user", "secret")}), "localhost:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+
+	if req := <-requests; req != "3 localhost:"+port {
+		t.Fatalf("socks5h request = %q, want domain name", req)
+	}
+
+	// socks5 在本地解析域名
+	conn, err = Dial(context.Background(), FixedProxy(&url.URL{Scheme: PROXY_SOCKS5, Host: addr, User: url.UserPassword("user", "secret")}), echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	conn.Close()
+
+	if req := <-requests; req != "1 "+echo.Addr().String() {
+		t.Fatalf("socks5 request = %q, want IPv4 address", req)
+	}
+
+	if _, err := Dial(context.Background(), FixedProxy(&url.URL{Scheme: PROXY_SOCKS5, Host: addr, User: url.UserPassword("user", "wrong")}), echo.Addr().String()); err == nil {
+		t.Fatal("Dial with wrong password succeeded")
+	}
+}
+
+func TestDialCanceled(t *testing.T) {
+	// 接受连接但是不响应的代理
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	if _, err := Dial(ctx, FixedProxy(&url.URL{Scheme: PROXY_HTTP, Host: listener.Addr().String()}), "ngrok.example.com:4443"); err == nil {
+		t.Fatal("Dial succeeded")
+	}
+
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("Dial did not return after ctx was canceled")
+	}
+}
@@ -0,0 +1,503 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket 的协议
+const (
+	WEBSOCKET_WS  = "ws"
+	WEBSOCKET_WSS = "wss"
+)
+
+// RFC 6455 的帧类型
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// 计算 Sec-WebSocket-Accept 使用的GUID
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// 控制帧的最大长度
+const wsMaxControlPayload = 125
+
+// 正常关闭的状态码
+const wsCloseNormal = 1000
+
+// 关闭时发送close帧的超时
+const wsCloseTimeout = time.Second
+
+// ParseWebSocketURL(rawURL string) 解析 ws://host[:port]/path 或者 wss://host[:port]/path
+func ParseWebSocketURL(rawURL string) (*url.URL, error) {
+	wsURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if wsURL.Scheme != WEBSOCKET_WS && wsURL.Scheme != WEBSOCKET_WSS {
+		return nil, fmt.Errorf("unsupported websocket scheme %q", wsURL.Scheme)
+	}
+
+	if wsURL.Hostname() == "" {
+		return nil, fmt.Errorf("websocket url %q has no host", rawURL)
+	}
+
+	return wsURL, nil
+}
+
+// WebSocketDialer 通过 WebSocket 连接服务器端的网关(例如 WebSocketGateway)，
+// ngrok协议的数据作为 binary 消息传输，用于只允许HTTPS的网络
+// 网关把数据原样转发给ngrokd，所以通常在它上面再使用 TLSDialer 和ngrokd握手
+type WebSocketDialer struct {
+	// 网关的地址 ws://host/path 或者 wss://host/path，DialContext 的addr被忽略
+	URL string
+
+	// 连接网关使用的Dialer，为nil时使用直接连接的 TCPDialer
+	Base Dialer
+
+	// wss 使用的TLS配置，为nil时使用系统的根证书验证网关的证书
+	TLSConfig *tls.Config
+
+	// 握手时额外发送的HTTP头，例如网关的验证信息
+	Header http.Header
+}
+
+func (dialer *WebSocketDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	wsURL, err := ParseWebSocketURL(dialer.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	base := dialer.Base
+	if base == nil {
+		base = &TCPDialer{}
+	}
+
+	rawConn, err := base.DialContext(ctx, network, webSocketAddr(wsURL))
+	if err != nil {
+		return nil, err
+	}
+
+	// 握手过程中ctx被取消时，使阻塞的读写返回
+	stop := context.AfterFunc(ctx, func() { rawConn.SetDeadline(aLongTimeAgo) })
+	defer stop()
+
+	conn := rawConn
+
+	if wsURL.Scheme == WEBSOCKET_WSS {
+		config := &tls.Config{}
+		if dialer.TLSConfig != nil {
+			config = dialer.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = wsURL.Hostname()
+		}
+		// 只能在 HTTP/1.1 上升级为 WebSocket
+		config.NextProtos = []string{"http/1.1"}
+
+		tlsConn := tls.Client(rawConn, config)
+		if err = tlsConn.HandshakeContext(ctx); err == nil {
+			conn = tlsConn
+		}
+	}
+
+	var wsConn net.Conn
+	if err == nil {
+		wsConn, err = webSocketHandshake(conn, wsURL, dialer.Header)
+	}
+
+	if err == nil && !stop() {
+		// ctx 已经被取消，deadline已经被设置
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("websocket %s: %w", wsURL.Host, err)
+	}
+
+	return wsConn, nil
+}
+
+// webSocketAddr(wsURL *url.URL) 网关的地址，没有端口时使用默认端口
+func webSocketAddr(wsURL *url.URL) string {
+	if wsURL.Port() != "" {
+		return wsURL.Host
+	}
+
+	if wsURL.Scheme == WEBSOCKET_WSS {
+		return net.JoinHostPort(wsURL.Hostname(), "443")
+	}
+
+	return net.JoinHostPort(wsURL.Hostname(), "80")
+}
+
+// webSocketAccept(key string) 根据 Sec-WebSocket-Key 计算 Sec-WebSocket-Accept
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// webSocketHandshake(conn net.Conn, wsURL *url.URL, header http.Header) 客户端的升级握手
+func webSocketHandshake(conn net.Conn, wsURL *url.URL, header http.Header) (net.Conn, error) {
+	var nonce [16]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: wsURL.Path, RawQuery: wsURL.RawQuery},
+		Host:   wsURL.Host,
+		Header: header.Clone(),
+	}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return nil, errors.New("upgrade " + wsURL.Path + ": " + resp.Status)
+	}
+
+	if !headerContains(resp.Header, "Upgrade", "websocket") || resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, errors.New("invalid websocket upgrade response")
+	}
+
+	return &webSocketConn{Conn: conn, reader: reader, client: true}, nil
+}
+
+// headerContains(header http.Header, name, token string) 逗号分隔的HTTP头中是否有token(不区分大小写)
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// AcceptWebSocket(w http.ResponseWriter, r *http.Request) 服务器端的升级握手，用于实现网关
+// 请求不是WebSocket升级时回复400并返回错误
+func AcceptWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+
+	if r.Method != http.MethodGet || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		!headerContains(r.Header, "Upgrade", "websocket") || !headerContains(r.Header, "Connection", "upgrade") {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, errors.New("not a websocket upgrade request")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("response writer does not support hijacking")
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	buf.WriteString("Upgrade: websocket\r\n")
+	buf.WriteString("Connection: Upgrade\r\n")
+	buf.WriteString("Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n")
+
+	if err := buf.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &webSocketConn{Conn: conn, reader: buf.Reader}, nil
+}
+
+// WebSocketGateway(target string) 服务器端的网关，把每个WebSocket连接的数据原样转发到target(ngrokd的地址)
+func WebSocketGateway(target string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := AcceptWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		upstream, err := net.DialTimeout("tcp", target, 10*time.Second)
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+
+		done := make(chan bool, 2)
+
+		go func() {
+			io.Copy(upstream, conn)
+			done <- true
+		}()
+
+		go func() {
+			io.Copy(conn, upstream)
+			done <- true
+		}()
+
+		// 任意一边结束时关闭两边的连接
+		<-done
+	})
+}
+
+// webSocketConn 把 WebSocket 的消息作为字节流读写的 net.Conn
+// 每次 Write 发送一个 binary 帧，Read 忽略消息的边界
+type webSocketConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	// 客户端发送的帧需要掩码，服务器端发送的帧不能有掩码
+	client bool
+
+	// 当前数据帧剩余的长度和掩码
+	remaining uint64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+
+	// 收到close帧或者读取出错后一直返回这个错误
+	readErr error
+
+	writeMutex sync.Mutex
+	closeSent  bool
+
+	closeOnce sync.Once
+}
+
+func (conn *webSocketConn) Read(b []byte) (int, error) {
+	for conn.remaining == 0 {
+		if conn.readErr != nil {
+			return 0, conn.readErr
+		}
+
+		if err := conn.nextFrame(); err != nil {
+			conn.readErr = err
+			return 0, err
+		}
+	}
+
+	if uint64(len(b)) > conn.remaining {
+		b = b[:conn.remaining]
+	}
+
+	n, err := conn.reader.Read(b)
+	conn.unmask(b[:n])
+	conn.remaining -= uint64(n)
+
+	if err == io.EOF && conn.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+// nextFrame() 读取下一个帧的头，处理控制帧，数据帧的内容由 Read() 读取
+func (conn *webSocketConn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(conn.reader, header[:]); err != nil {
+		return err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	if header[0]&0x70 != 0 {
+		return errors.New("websocket: reserved bits set")
+	}
+
+	// 客户端收到的帧不能有掩码，服务器端收到的帧必须有掩码
+	if masked == conn.client {
+		return errors.New("websocket: unexpected frame masking")
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(conn.reader, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(conn.reader, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	conn.masked = masked
+	conn.maskPos = 0
+	if masked {
+		if _, err := io.ReadFull(conn.reader, conn.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+		conn.remaining = length
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+	default:
+		return fmt.Errorf("websocket: unknown opcode %d", opcode)
+	}
+
+	if !fin || length > wsMaxControlPayload {
+		return errors.New("websocket: invalid control frame")
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn.reader, payload); err != nil {
+		return err
+	}
+	conn.unmask(payload)
+
+	switch opcode {
+	case wsOpPing:
+		if err := conn.writeFrame(wsOpPong, payload); err != nil && err != net.ErrClosed {
+			return err
+		}
+	case wsOpClose:
+		// 回复收到的状态码
+		if len(payload) > 2 {
+			payload = payload[:2]
+		}
+		conn.writeFrame(wsOpClose, payload)
+		return io.EOF
+	}
+
+	return nil
+}
+
+// unmask(b []byte) 去掉当前帧的掩码
+func (conn *webSocketConn) unmask(b []byte) {
+	if !conn.masked {
+		return
+	}
+
+	for i := range b {
+		b[i] ^= conn.mask[conn.maskPos&3]
+		conn.maskPos++
+	}
+}
+
+func (conn *webSocketConn) Write(b []byte) (int, error) {
+	if err := conn.writeFrame(wsOpBinary, b); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// writeFrame(opcode byte, payload []byte) 发送一个完整的帧，发送close帧后不能再发送
+func (conn *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	if conn.closeSent {
+		return net.ErrClosed
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	var maskBit byte
+	if conn.client {
+		maskBit = 0x80
+	}
+
+	switch length := len(payload); {
+	case length <= wsMaxControlPayload:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	if conn.client {
+		var mask [4]byte
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return err
+		}
+
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i&3]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	if opcode == wsOpClose {
+		conn.closeSent = true
+	}
+
+	_, err := conn.Conn.Write(frame)
+	return err
+}
+
+// Close() 发送close帧后关闭底层的连接
+func (conn *webSocketConn) Close() error {
+	var err error
+
+	conn.closeOnce.Do(func() {
+		conn.Conn.SetWriteDeadline(time.Now().Add(wsCloseTimeout))
+		conn.writeFrame(wsOpClose, binary.BigEndian.AppendUint16(nil, wsCloseNormal))
+
+		err = conn.Conn.Close()
+	})
+
+	return err
+}
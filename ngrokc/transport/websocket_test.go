@@ -0,0 +1,164 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWebSocketURL(t *testing.T) {
+	for _, rawURL := range []string{"ws://gateway:8080/ngrok", "wss://gateway.example.com/ngrok?token=x"} {
+		if _, err := ParseWebSocketURL(rawURL); err != nil {
+			t.Errorf("ParseWebSocketURL(%q): %v", rawURL, err)
+		}
+	}
+
+	for _, rawURL := range []string{"https://gateway/ngrok", "gateway:443", "wss:///ngrok"} {
+		if _, err := ParseWebSocketURL(rawURL); err == nil {
+			t.Errorf("ParseWebSocketURL(%q) succeeded", rawURL)
+		}
+	}
+}
+
+// echoWebSocket() 回显数据的WebSocket服务器，回显之前先发送一个ping
+func echoWebSocket(t *testing.T, closed chan error) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := AcceptWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if err := conn.(*webSocketConn).writeFrame(wsOpPing, []byte("ping")); err != nil {
+			t.Errorf("write ping: %v", err)
+		}
+
+		_, err = io.Copy(conn, conn)
+		if closed != nil {
+			closed <- err
+		}
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestWebSocketDialer(t *testing.T) {
+	closed := make(chan error, 1)
+	server := echoWebSocket(t, closed)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dialer := &WebSocketDialer{URL: "ws" + strings.TrimPrefix(server.URL, "http") + "/ngrok"}
+
+	conn, err := dialer.DialContext(ctx, "tcp", "ignored:4443")
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+
+	assertEcho(t, conn)
+
+	// 16位和64位长度的帧
+	for _, size := range []int{1000, 70000} {
+		data := bytes.Repeat([]byte{byte(size)}, size)
+
+		go conn.Write(data)
+
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, data) {
+			t.Fatalf("echo %d bytes: %v", size, err)
+		}
+	}
+
+	conn.Close()
+
+	// 服务器端收到close帧后正常结束
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("server copy = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not see close")
+	}
+}
+
+func TestWebSocketGateway(t *testing.T) {
+	echo := echoServer(t)
+
+	gateway := httptest.NewTLSServer(WebSocketGateway(echo.Addr().String()))
+	defer gateway.Close()
+
+	roots := gateway.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	url := "wss" + strings.TrimPrefix(gateway.URL, "https")
+
+	// 不信任的证书
+	if conn, err := (&WebSocketDialer{URL: url}).DialContext(ctx, "tcp", ""); err == nil {
+		conn.Close()
+		t.Fatal("DialContext with untrusted certificate succeeded")
+	}
+
+	conn, err := (&WebSocketDialer{URL: url, TLSConfig: &tls.Config{RootCAs: roots}}).DialContext(ctx, "tcp", "")
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	defer conn.Close()
+
+	assertEcho(t, conn)
+}
+
+func TestWebSocketUpgradeRejected(t *testing.T) {
+	server := echoWebSocket(t, nil)
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("plain GET status = %d", resp.StatusCode)
+	}
+
+	// 不是WebSocket的服务器
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if conn, err := (&WebSocketDialer{URL: "ws" + strings.TrimPrefix(plain.URL, "http")}).DialContext(ctx, "tcp", ""); err == nil {
+		conn.Close()
+		t.Fatal("DialContext to plain HTTP server succeeded")
+	}
+}
+
+func TestWebSocketRejectsUnmaskedClientFrames(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+
+	server := &webSocketConn{Conn: serverSide, reader: bufio.NewReader(serverSide)}
+	defer server.Close()
+
+	// 服务器端的连接发送的是没有掩码的帧，服务器不应该接受
+	fake := &webSocketConn{Conn: clientSide, reader: bufio.NewReader(clientSide)}
+	go fake.Write([]byte("hello"))
+
+	if _, err := server.Read(make([]byte, 5)); err == nil {
+		t.Fatal("server accepted unmasked frame")
+	}
+}
@@ -0,0 +1,446 @@
+package usage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 没有修改时不保存，有修改时每隔 SaveInterval 保存一次
+const SaveInterval = time.Minute
+
+// 按天和按月统计时使用的日期格式(本地时间)
+const (
+	DAY_FORMAT   = "2006-01-02"
+	MONTH_FORMAT = "2006-01"
+)
+
+// 每条隧道最多保存的访问者数量，超过时删除最久没有访问的十分之一，隧道的总数不受影响
+const MAX_VISITORS = 1000
+
+// ErrQuotaExceeded 隧道这一天或者这个月的流量已经超过配额
+var ErrQuotaExceeded = errors.New("traffic quota exceeded")
+
+// Counters 流量和连接数
+type Counters struct {
+	Connections int64 `json:"connections"`
+	// 从访问者收到的字节数
+	BytesIn int64 `json:"bytes_in"`
+	// 发送给访问者的字节数
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// add(bytesIn, bytesOut int64) 记录传输的字节数
+func (counters *Counters) add(bytesIn, bytesOut int64) {
+	counters.BytesIn += bytesIn
+	counters.BytesOut += bytesOut
+}
+
+// Visitor 一个访问者(IP)的统计
+type Visitor struct {
+	Counters
+
+	// 最近一次连接或者传输数据的时间
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// TunnelUsage 一条隧道的统计
+type TunnelUsage struct {
+	// 开始统计以来的总数
+	Counters
+
+	// 每个访问者(IP)的统计，最多 MAX_VISITORS 个
+	Visitors map[string]*Visitor `json:"visitors"`
+
+	// 当天和当月的字节数(收到的和发送的)，用于流量配额
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+// rotate(now time.Time) 日期或者月份改变时重新开始当天/当月的统计
+func (tunnel *TunnelUsage) rotate(now time.Time) {
+	if day := now.Format(DAY_FORMAT); tunnel.Day != day {
+		tunnel.Day = day
+		tunnel.DayBytes = 0
+	}
+
+	if month := now.Format(MONTH_FORMAT); tunnel.Month != month {
+		tunnel.Month = month
+		tunnel.MonthBytes = 0
+	}
+}
+
+// Quota 一条隧道的流量配额，收到的和发送的字节数一起计算，为0时不限制
+type Quota struct {
+	Daily   uint64
+	Monthly uint64
+}
+
+// Ledger 按会话、隧道和访问者统计流量和连接数，可以保存到本地文件，在重启之后继续统计
+// 代理连接传输数据时就记录流量；配置了流量配额的隧道超过配额后拒绝新的代理连接，并中止正在进行的代理连接
+// 可以在多个goroutine中同时使用，nil 的 Ledger 不统计
+type Ledger struct {
+	mutex sync.Mutex
+
+	// 保存统计的文件，为空时不保存
+	path string
+
+	// 会话名字 -> 隧道名字 -> 统计
+	sessions map[string]map[string]*TunnelUsage
+	// 会话名字 -> 隧道名字 -> 配额
+	quotas map[string]map[string]Quota
+
+	// 上次保存之后是否有修改
+	dirty bool
+
+	// 定期保存的goroutine
+	stop chan bool
+	done chan bool
+
+	// 获取当前时间，测试时可以替换
+	now func() time.Time
+
+	// 每条隧道最多保存的访问者数量，测试时可以替换
+	maxVisitors int
+}
+
+// ledgerFile 保存到文件的格式
+type ledgerFile struct {
+	Sessions map[string]map[string]*TunnelUsage `json:"sessions"`
+}
+
+// Open(path string) 创建统计，path 不为空时读取之前保存的统计，并定期保存到这个文件
+// 文件不存在时从0开始统计；需要调用 Close() 保存并停止定期保存
+func Open(path string) (*Ledger, error) {
+	ledger := &Ledger{
+		path:        path,
+		sessions:    make(map[string]map[string]*TunnelUsage),
+		quotas:      make(map[string]map[string]Quota),
+		stop:        make(chan bool),
+		done:        make(chan bool),
+		now:         time.Now,
+		maxVisitors: MAX_VISITORS,
+	}
+
+	if path == "" {
+		close(ledger.done)
+		return ledger, nil
+	}
+
+	content, err := os.ReadFile(path)
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("usage file %s: %w", path, err)
+	default:
+		var file ledgerFile
+		if err := json.Unmarshal(content, &file); err != nil {
+			return nil, fmt.Errorf("usage file %s: %w", path, err)
+		}
+
+		if file.Sessions != nil {
+			ledger.sessions = file.Sessions
+		}
+
+		// 之前保存的访问者可能超过限制
+		for _, tunnels := range ledger.sessions {
+			for _, tunnel := range tunnels {
+				ledger.prune(tunnel)
+			}
+		}
+	}
+
+	go ledger.saveLoop()
+
+	return ledger, nil
+}
+
+// saveLoop() 有修改时定期保存
+func (ledger *Ledger) saveLoop() {
+	defer close(ledger.done)
+
+	ticker := time.NewTicker(SaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ledger.stop:
+			return
+		case <-ticker.C:
+			if err := ledger.Save(); err != nil {
+				fmt.Println("usage saveLoop():" + err.Error())
+			}
+		}
+	}
+}
+
+// tunnel(session, name string) 获取隧道的统计，没有时创建，需要持有锁
+func (ledger *Ledger) tunnel(session, name string) *TunnelUsage {
+	tunnels, ok := ledger.sessions[session]
+	if !ok {
+		tunnels = make(map[string]*TunnelUsage)
+		ledger.sessions[session] = tunnels
+	}
+
+	tunnel, ok := tunnels[name]
+	if !ok {
+		tunnel = &TunnelUsage{}
+		tunnels[name] = tunnel
+	}
+
+	if tunnel.Visitors == nil {
+		tunnel.Visitors = make(map[string]*Visitor)
+	}
+
+	return tunnel
+}
+
+// visitor(usage *TunnelUsage, clientAddr string) 获取访问者IP的统计并更新访问时间，没有时创建，需要持有锁
+func (ledger *Ledger) visitor(usage *TunnelUsage, clientAddr string) *Visitor {
+	ip := VisitorIP(clientAddr)
+
+	visitor, ok := usage.Visitors[ip]
+	if !ok {
+		if len(usage.Visitors) >= ledger.maxVisitors {
+			ledger.prune(usage)
+		}
+
+		visitor = &Visitor{}
+		usage.Visitors[ip] = visitor
+	}
+
+	visitor.LastSeen = ledger.now()
+
+	return visitor
+}
+
+// prune(usage *TunnelUsage) 访问者达到限制时删除最久没有访问的访问者，留下限制的十分之九，需要持有锁
+func (ledger *Ledger) prune(usage *TunnelUsage) {
+	if len(usage.Visitors) < ledger.maxVisitors {
+		return
+	}
+
+	ips := make([]string, 0, len(usage.Visitors))
+	for ip := range usage.Visitors {
+		ips = append(ips, ip)
+	}
+
+	sort.Slice(ips, func(i, j int) bool {
+		return usage.Visitors[ips[i]].LastSeen.Before(usage.Visitors[ips[j]].LastSeen)
+	})
+
+	for _, ip := range ips[:len(ips)-ledger.maxVisitors*9/10] {
+		delete(usage.Visitors, ip)
+	}
+}
+
+// Connect(session, tunnel, clientAddr string) 记录一条开始的代理连接
+// clientAddr 为访问者的地址 ip:端口，按IP统计
+func (ledger *Ledger) Connect(session, tunnel, clientAddr string) {
+	if ledger == nil {
+		return
+	}
+
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+
+	usage := ledger.tunnel(session, tunnel)
+	usage.Connections++
+	ledger.visitor(usage, clientAddr).Connections++
+
+	ledger.dirty = true
+}
+
+// Transfer(session, tunnel, clientAddr string, bytesIn, bytesOut int64) 记录代理连接正在传输的字节数
+// 隧道这一天或者这个月的流量已经超过配额时不记录，返回 ErrQuotaExceeded，调用者不应该再传输这些数据；
+// 所以超过配额的字节数最多为一次传输的字节数
+func (ledger *Ledger) Transfer(session, tunnel, clientAddr string, bytesIn, bytesOut int64) error {
+	if ledger == nil {
+		return nil
+	}
+
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+
+	if err := ledger.check(session, tunnel); err != nil {
+		return err
+	}
+
+	usage := ledger.tunnel(session, tunnel)
+	usage.rotate(ledger.now())
+
+	ledger.add(usage, clientAddr, bytesIn, bytesOut)
+
+	return nil
+}
+
+// add(usage *TunnelUsage, clientAddr string, bytesIn, bytesOut int64) 记录隧道和访问者的字节数，需要持有锁
+func (ledger *Ledger) add(usage *TunnelUsage, clientAddr string, bytesIn, bytesOut int64) {
+	usage.add(bytesIn, bytesOut)
+	usage.DayBytes += bytesIn + bytesOut
+	usage.MonthBytes += bytesIn + bytesOut
+
+	ledger.visitor(usage, clientAddr).add(bytesIn, bytesOut)
+
+	ledger.dirty = true
+}
+
+// SetQuota(session, tunnel string, quota Quota) 设置隧道的流量配额，都为0时取消配额
+func (ledger *Ledger) SetQuota(session, tunnel string, quota Quota) {
+	if ledger == nil {
+		return
+	}
+
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+
+	if quota == (Quota{}) {
+		delete(ledger.quotas[session], tunnel)
+		return
+	}
+
+	if ledger.quotas[session] == nil {
+		ledger.quotas[session] = make(map[string]Quota)
+	}
+
+	ledger.quotas[session][tunnel] = quota
+}
+
+// Check(session, tunnel string) 隧道这一天或者这个月的流量超过配额时返回 ErrQuotaExceeded
+func (ledger *Ledger) Check(session, tunnel string) error {
+	if ledger == nil {
+		return nil
+	}
+
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+
+	return ledger.check(session, tunnel)
+}
+
+// check(session, tunnel string) 检查隧道的配额，需要持有锁
+func (ledger *Ledger) check(session, tunnel string) error {
+	quota, ok := ledger.quotas[session][tunnel]
+	if !ok {
+		return nil
+	}
+
+	usage := ledger.tunnel(session, tunnel)
+	usage.rotate(ledger.now())
+
+	if quota.Daily > 0 && usage.DayBytes >= int64(quota.Daily) {
+		return fmt.Errorf("%w: %d of %d bytes used on %s", ErrQuotaExceeded, usage.DayBytes, quota.Daily, usage.Day)
+	}
+
+	if quota.Monthly > 0 && usage.MonthBytes >= int64(quota.Monthly) {
+		return fmt.Errorf("%w: %d of %d bytes used in %s", ErrQuotaExceeded, usage.MonthBytes, quota.Monthly, usage.Month)
+	}
+
+	return nil
+}
+
+// Tunnels(session string) 获取一个会话所有隧道的统计，返回的是副本
+func (ledger *Ledger) Tunnels(session string) map[string]TunnelUsage {
+	result := make(map[string]TunnelUsage)
+
+	if ledger == nil {
+		return result
+	}
+
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+
+	for name, usage := range ledger.sessions[session] {
+		usage.rotate(ledger.now())
+
+		copied := *usage
+		copied.Visitors = make(map[string]*Visitor, len(usage.Visitors))
+		for ip, visitor := range usage.Visitors {
+			v := *visitor
+			copied.Visitors[ip] = &v
+		}
+
+		result[name] = copied
+	}
+
+	return result
+}
+
+// Save() 有修改时保存到文件，先写临时文件再改名，不会留下写了一半的文件
+func (ledger *Ledger) Save() error {
+	if ledger == nil || ledger.path == "" {
+		return nil
+	}
+
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+
+	if !ledger.dirty {
+		return nil
+	}
+
+	content, err := json.MarshalIndent(ledgerFile{Sessions: ledger.sessions}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(ledger.path), filepath.Base(ledger.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = temp.Write(content)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(temp.Name(), ledger.path)
+	}
+
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	ledger.dirty = false
+
+	return nil
+}
+
+// Close() 停止定期保存并保存最后的统计，可以重复调用
+func (ledger *Ledger) Close() error {
+	if ledger == nil {
+		return nil
+	}
+
+	ledger.mutex.Lock()
+	select {
+	case <-ledger.stop:
+	default:
+		close(ledger.stop)
+	}
+	ledger.mutex.Unlock()
+
+	<-ledger.done
+
+	return ledger.Save()
+}
+
+// VisitorIP(clientAddr string) 去掉访问者地址中的端口
+func VisitorIP(clientAddr string) string {
+	if host, _, err := net.SplitHostPort(clientAddr); err == nil {
+		return host
+	}
+
+	return clientAddr
+}
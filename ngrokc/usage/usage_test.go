@@ -0,0 +1,258 @@
+package usage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// use(ledger *Ledger, tunnel, clientAddr string, bytesIn, bytesOut int64) 和代理连接一样先记录连接，再记录传输的数据
+func use(t *testing.T, ledger *Ledger, tunnel, clientAddr string, bytesIn, bytesOut int64) {
+	t.Helper()
+
+	ledger.Connect("default", tunnel, clientAddr)
+
+	if err := ledger.Transfer("default", tunnel, clientAddr, bytesIn, 0); err != nil {
+		t.Fatalf("Transfer %s in = %v", tunnel, err)
+	}
+
+	if err := ledger.Transfer("default", tunnel, clientAddr, 0, bytesOut); err != nil {
+		t.Fatalf("Transfer %s out = %v", tunnel, err)
+	}
+}
+
+func TestLedgerPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+
+	ledger, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	use(t, ledger, "web", "10.0.0.1:50000", 100, 1000)
+	use(t, ledger, "web", "10.0.0.1:50001", 10, 20)
+	use(t, ledger, "web", "[2001:db8::1]:443", 1, 2)
+
+	if err := ledger.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启之后继续统计
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	use(t, reopened, "web", "10.0.0.1:50002", 1, 1)
+
+	web := reopened.Tunnels("default")["web"]
+	if web.Connections != 4 || web.BytesIn != 112 || web.BytesOut != 1023 || web.DayBytes != 1135 || web.MonthBytes != 1135 {
+		t.Fatalf("web = %+v", web)
+	}
+
+	if visitor := web.Visitors["10.0.0.1"]; visitor == nil || visitor.Connections != 3 || visitor.BytesOut != 1021 || visitor.LastSeen.IsZero() {
+		t.Fatalf("visitor 10.0.0.1 = %+v", visitor)
+	}
+
+	if visitor := web.Visitors["2001:db8::1"]; visitor == nil || visitor.Connections != 1 {
+		t.Fatalf("visitor 2001:db8::1 = %+v", visitor)
+	}
+}
+
+func TestLedgerQuota(t *testing.T) {
+	ledger, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ledger.Close()
+
+	now := time.Date(2026, 1, 30, 23, 0, 0, 0, time.Local)
+	ledger.now = func() time.Time { return now }
+
+	ledger.SetQuota("default", "web", Quota{Daily: 1000, Monthly: 1500})
+
+	if err := ledger.Check("default", "web"); err != nil {
+		t.Fatalf("Check before use = %v", err)
+	}
+
+	use(t, ledger, "web", "10.0.0.1:1", 600, 400)
+
+	// 超过配额之后拒绝传输，拒绝的字节数不计入
+	if err := ledger.Transfer("default", "web", "10.0.0.1:1", 1, 0); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Transfer over daily quota = %v", err)
+	}
+
+	if err := ledger.Check("default", "web"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Check over daily quota = %v", err)
+	}
+
+	if web := ledger.Tunnels("default")["web"]; web.DayBytes != 1000 || web.BytesIn != 600 || web.Visitors["10.0.0.1"].BytesIn != 600 {
+		t.Fatalf("web after refused transfer = %+v", web)
+	}
+
+	// 其他隧道不受影响
+	if err := ledger.Transfer("default", "api", "10.0.0.1:1", 5000, 0); err != nil {
+		t.Fatalf("Transfer other tunnel = %v", err)
+	}
+
+	// 第二天重新开始按天统计，但是这个月还剩500字节
+	now = now.Add(2 * time.Hour)
+	if err := ledger.Check("default", "web"); err != nil {
+		t.Fatalf("Check next day = %v", err)
+	}
+
+	use(t, ledger, "web", "10.0.0.1:1", 300, 200)
+
+	if err := ledger.Transfer("default", "web", "10.0.0.1:1", 0, 1); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Transfer over monthly quota = %v", err)
+	}
+
+	if web := ledger.Tunnels("default")["web"]; web.Day != "2026-01-31" || web.DayBytes != 500 || web.Month != "2026-01" || web.MonthBytes != 1500 {
+		t.Fatalf("web on the next day = %+v", web)
+	}
+
+	// 下个月重新开始
+	now = now.AddDate(0, 0, 2)
+	if err := ledger.Transfer("default", "web", "10.0.0.1:1", 10, 0); err != nil {
+		t.Fatalf("Transfer next month = %v", err)
+	}
+
+	if web := ledger.Tunnels("default")["web"]; web.Month != "2026-02" || web.MonthBytes != 10 || web.BytesIn != 910 {
+		t.Fatalf("web in the next month = %+v", web)
+	}
+
+	// 取消配额
+	ledger.SetQuota("default", "web", Quota{})
+	if err := ledger.Transfer("default", "web", "10.0.0.1:1", 1<<20, 0); err != nil {
+		t.Fatalf("Transfer without quota = %v", err)
+	}
+}
+
+func TestLedgerVisitorLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+
+	ledger, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.Local)
+	ledger.now = func() time.Time { return now }
+	ledger.maxVisitors = 10
+
+	// 10.0.0.0 一直在访问，其他访问者只访问一次
+	for i := 0; i < 25; i++ {
+		now = now.Add(time.Second)
+		use(t, ledger, "web", "10.0.0.0:1", 1, 0)
+		use(t, ledger, "web", fmt.Sprintf("10.0.1.%d:1", i), 1, 0)
+	}
+
+	web := ledger.Tunnels("default")["web"]
+	if len(web.Visitors) > 10 {
+		t.Fatalf("%d visitors, want at most 10", len(web.Visitors))
+	}
+
+	if web.Connections != 50 || web.BytesIn != 50 {
+		t.Fatalf("tunnel totals = %+v, want all 50 connections", web.Counters)
+	}
+
+	if visitor := web.Visitors["10.0.0.0"]; visitor == nil || visitor.Connections != 25 {
+		t.Fatalf("active visitor = %+v", visitor)
+	}
+
+	if web.Visitors["10.0.1.24"] == nil || web.Visitors["10.0.1.0"] != nil {
+		t.Fatalf("kept visitors %v, want the most recent ones", web.Visitors)
+	}
+
+	if err := ledger.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启之后限制变小，新的访问者到来时删除多余的访问者
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	reopened.maxVisitors = 5
+	reopened.Connect("default", "web", "10.0.2.1:1")
+
+	if visitors := reopened.Tunnels("default")["web"].Visitors; len(visitors) > 5 || visitors["10.0.2.1"] == nil {
+		t.Fatalf("visitors after reopening = %v", visitors)
+	}
+}
+
+func TestLedgerTransfer(t *testing.T) {
+	ledger, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ledger.Close()
+
+	ledger.SetQuota("default", "ws", Quota{Daily: 10 * 1024})
+
+	// 一条一直不关闭的连接，每次传输1KB，流量马上计入，超过配额后拒绝之后的传输
+	ledger.Connect("default", "ws", "10.0.0.1:50000")
+
+	var transferred int64
+	for i := 0; i < 100; i++ {
+		bytesIn, bytesOut := int64(1024), int64(0)
+		if i%2 == 1 {
+			bytesIn, bytesOut = 0, 1024
+		}
+
+		if err := ledger.Transfer("default", "ws", "10.0.0.1:50000", bytesIn, bytesOut); err != nil {
+			if !errors.Is(err, ErrQuotaExceeded) {
+				t.Fatalf("Transfer = %v", err)
+			}
+			break
+		}
+		transferred += bytesIn + bytesOut
+	}
+
+	if transferred != 10*1024 {
+		t.Fatalf("transferred %d bytes, want the 10KB quota", transferred)
+	}
+
+	ws := ledger.Tunnels("default")["ws"]
+	if ws.Connections != 1 || ws.BytesIn != 5*1024 || ws.BytesOut != 5*1024 || ws.DayBytes != 10*1024 {
+		t.Fatalf("ws = %+v", ws)
+	}
+
+	if visitor := ws.Visitors["10.0.0.1"]; visitor == nil || visitor.Connections != 1 || visitor.BytesIn != 5*1024 {
+		t.Fatalf("visitor = %+v", visitor)
+	}
+
+	if err := ledger.Check("default", "ws"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Check after long-lived connection = %v", err)
+	}
+
+	// 没有配额的隧道不检查
+	if err := ledger.Transfer("default", "api", "10.0.0.2:1", 1<<40, 0); err != nil {
+		t.Fatalf("Transfer without quota = %v", err)
+	}
+}
+
+func TestNilLedger(t *testing.T) {
+	var ledger *Ledger
+
+	ledger.Connect("default", "web", "10.0.0.1:1")
+
+	if err := ledger.Transfer("default", "web", "10.0.0.1:1", 1, 1); err != nil {
+		t.Fatalf("Transfer = %v", err)
+	}
+
+	ledger.SetQuota("default", "web", Quota{Daily: 1})
+
+	if err := ledger.Check("default", "web"); err != nil {
+		t.Fatalf("Check = %v", err)
+	}
+
+	if err := ledger.Close(); err != nil {
+		t.Fatalf("Close = %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package util
+
+import (
+	"io"
+
+	errcode "ngrok-client/ngrokc/err"
+)
+
+// 每条命令前面表示长度的字节数
+const FRAME_HEADER_SIZE = 8
+
+// 一条命令数据的最大长度，长度只保存在8位byte中的低2位
+const MAX_FRAME_SIZE = 0xFFFF
+
+// ReadFrame 从r中读取一条完整的命令，命令由8位byte的长度和后面的数据组成
+// 返回去掉长度后的数据，数据不完整时返回 io.ErrUnexpectedEOF
+// 长度超过 MAX_FRAME_SIZE 时返回 errcode.ErrBytesToPayload，不会把后面的数据当成命令
+// r 最好是带缓存的(bufio.Reader)，读取命令后剩下的数据会保留在缓存中
+func ReadFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, FRAME_HEADER_SIZE)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	for _, b := range header[2:] {
+		if b != 0 {
+			return nil, errcode.New(errcode.ErrBytesToPayload, "frame length too large")
+		}
+	}
+
+	content := make([]byte, ToLen(header))
+
+	if _, err := io.ReadFull(r, content); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return content, nil
+}
@@ -0,0 +1,62 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadFrame(t *testing.T) {
+	first := `{"Type":"AuthResp","Payload":{"ClientId":"abc"}}`
+	second := `{"Type":"NewTunnel","Payload":{}}`
+
+	// 两条命令和之后代理的数据一起到达
+	var stream bytes.Buffer
+	stream.Write(append(LenToBytes(uint16(len(first))), first...))
+	stream.Write(append(LenToBytes(uint16(len(second))), second...))
+	stream.Write(LenToBytes(0))
+	stream.WriteString("GET / HTTP/1.1\r\n")
+
+	for name, r := range map[string]io.Reader{
+		"coalesced":  bytes.NewReader(stream.Bytes()),
+		"fragmented": iotest.OneByteReader(bytes.NewReader(stream.Bytes())),
+		"half":       iotest.HalfReader(bytes.NewReader(stream.Bytes())),
+	} {
+		reader := bufio.NewReaderSize(r, 16)
+
+		for _, want := range []string{first, second, ""} {
+			content, err := ReadFrame(reader)
+			if err != nil || string(content) != want {
+				t.Fatalf("%s: ReadFrame = %q, %v, want %q", name, content, err, want)
+			}
+		}
+
+		// 命令之后的数据留在缓存中
+		rest, _ := io.ReadAll(reader)
+		if string(rest) != "GET / HTTP/1.1\r\n" {
+			t.Fatalf("%s: data after frames = %q", name, rest)
+		}
+	}
+}
+
+func TestReadFrameIncomplete(t *testing.T) {
+	full := append(LenToBytes(5), "hello"...)
+
+	if _, err := ReadFrame(bytes.NewReader(nil)); err != io.EOF {
+		t.Fatalf("ReadFrame of empty stream = %v, want io.EOF", err)
+	}
+
+	for _, size := range []int{3, FRAME_HEADER_SIZE, FRAME_HEADER_SIZE + 2} {
+		if _, err := ReadFrame(bytes.NewReader(full[:size])); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("ReadFrame of %d bytes = %v, want io.ErrUnexpectedEOF", size, err)
+		}
+	}
+
+	readErr := errors.New("connection reset")
+	if _, err := ReadFrame(io.MultiReader(bytes.NewReader(full[:FRAME_HEADER_SIZE]), iotest.ErrReader(readErr))); !errors.Is(err, readErr) {
+		t.Fatalf("ReadFrame with read error = %v, want %v", err, readErr)
+	}
+}
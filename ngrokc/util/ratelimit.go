@@ -0,0 +1,120 @@
+package util
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// TokenBucket 令牌桶，每秒补充 rate 个令牌，最多积累 burst 个，用于限制带宽
+// 可以在多个goroutine中同时使用，nil 的 TokenBucket 不限制
+type TokenBucket struct {
+	mutex sync.Mutex
+
+	rate  float64
+	burst float64
+
+	// 当前的令牌数，透支时为负数
+	tokens float64
+	// 上一次补充令牌的时间
+	last time.Time
+
+	// 获取当前时间
+	now func() time.Time
+}
+
+// NewTokenBucket(rate, burst uint64) 创建令牌桶，开始时是满的；burst 为0时等于 rate，rate 为0时返回nil(不限制)
+func NewTokenBucket(rate, burst uint64) *TokenBucket {
+	return NewTokenBucketClock(rate, burst, time.Now)
+}
+
+// NewTokenBucketClock(rate, burst uint64, now func() time.Time) 和 NewTokenBucket 相同，使用 now 获取当前时间，测试时可以替换
+func NewTokenBucketClock(rate, burst uint64, now func() time.Time) *TokenBucket {
+	if rate == 0 {
+		return nil
+	}
+
+	if burst == 0 {
+		burst = rate
+	}
+
+	return &TokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: now(), now: now}
+}
+
+// refill(now time.Time) 按经过的时间补充令牌，需要持有锁
+func (bucket *TokenBucket) refill(now time.Time) {
+	bucket.tokens = math.Min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	bucket.last = now
+}
+
+// Allow(n int) 令牌足够时取出n个令牌并返回true，不够时不透支，返回false
+func (bucket *TokenBucket) Allow(n int) bool {
+	if bucket == nil {
+		return true
+	}
+
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	bucket.refill(bucket.now())
+
+	if bucket.tokens < float64(n) {
+		return false
+	}
+
+	bucket.tokens -= float64(n)
+
+	return true
+}
+
+// Full() 令牌桶是否已经补满，补满的令牌桶和新建的没有区别
+func (bucket *TokenBucket) Full() bool {
+	if bucket == nil {
+		return true
+	}
+
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	bucket.refill(bucket.now())
+
+	return bucket.tokens >= bucket.burst
+}
+
+// Reserve(n int) 取出n个令牌，令牌不够时透支，返回使用这些令牌之前需要等待的时间
+func (bucket *TokenBucket) Reserve(n int) time.Duration {
+	if bucket == nil || n <= 0 {
+		return 0
+	}
+
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	bucket.refill(bucket.now())
+
+	bucket.tokens -= float64(n)
+
+	if bucket.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+// SleepContext(ctx context.Context, d time.Duration) 等待d，ctx 被取消时马上返回false
+func SleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
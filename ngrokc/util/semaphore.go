@@ -1,5 +1,7 @@
 package util
 
+import "context"
+
 type Semaphore struct {
 	semaphore chan int64
 }
@@ -12,10 +14,16 @@ func (sem *Semaphore) Acquire() {
 	sem.semaphore <- 1
 }
 
-func (sem *Semaphore) Release() {
-	<-sem.semaphore
+// AcquireContext 获取信号量，ctx 被取消时放弃获取并返回false
+func (sem *Semaphore) AcquireContext(ctx context.Context) bool {
+	select {
+	case sem.semaphore <- 1:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
-func (sem *Semaphore) Close() {
-	close(sem.semaphore)
+func (sem *Semaphore) Release() {
+	<-sem.semaphore
 }
@@ -3,17 +3,19 @@ package util
 import (
 
 	"bytes"
-	"reflect"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/binary"
 
-	"ngrok-client/ngrokc/err"
+	errcode "ngrok-client/ngrokc/err"
 )
 
 // 代理类型
 const (
 	PROTOCOL_HTTP = "http"
 	PROTOCOL_HTTPS = "https"
+	PROTOCOL_TCP = "tcp"
 )
 
 // 请求
@@ -47,6 +49,13 @@ func LenToBytes(length uint16) []byte {
 	return content
 }
 
+// RandomId 生成一个随机的16进制字符串，用作ReqId等标识
+func RandomId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 // Payload 的结构体
 type PayloadStruct struct {
 	Payload interface{}
@@ -57,8 +66,8 @@ type PayloadStruct struct {
 // 将会返回(resp, type, err)
 // resp 是对应响应的结构体(struct), 返回类型是 interface{}
 // type 是代表返回的是哪个类型的响应，返回类型是 string
-// err 表示函数处理有没有错误，没有错误则为0, 有错误则返回对应错误代码
-func ParsePayloadStruct(content []byte) (interface{}, string, int) {
+// err 表示函数处理有没有错误，没有错误则为nil, 有错误则返回 *errcode.Error
+func ParsePayloadStruct(content []byte) (interface{}, string, error) {
 
 	var resp PayloadStruct
 
@@ -68,41 +77,42 @@ func ParsePayloadStruct(content []byte) (interface{}, string, int) {
 	errObj := json.Unmarshal(content, &resp)
 
 	if errObj != nil {
-		return nil, resp.Type, err.ERR_UNKNOW_RESP
+		return nil, resp.Type, errcode.Wrap(errcode.ErrBytesToPayload, errObj)
 	}
 
-	payloadType := reflect.TypeOf(resp.Payload)
-	
-	if payloadType.Kind() == reflect.Map {
+	// Payload 可能是null或者不是对象，不能直接断言
+	payloadMap, isMap := resp.Payload.(map[string]interface{})
+
+	if isMap {
 		switch resp.Type {
 		case AUTH_RESP_TYPE:
 			// AuthResp
 			var payload AuthResp
-			payload.ParseFromMap(resp.Payload.(map[string]interface{}))
-			return payload, resp.Type, err.ERR_SUCCESS
+			payload.ParseFromMap(payloadMap)
+			return payload, resp.Type, nil
 		case NEW_TUNNEL_TYPE:
 			// NewTunnel
 			var payload NewTunnel
-			payload.ParseFromMap(resp.Payload.(map[string]interface{}))
-			return payload, resp.Type, err.ERR_SUCCESS
+			payload.ParseFromMap(payloadMap)
+			return payload, resp.Type, nil
 		case REQ_PROXY_TYPE:
 			// ReqProxy
 			var payload ReqProxy
-			return payload, resp.Type, err.ERR_SUCCESS
+			return payload, resp.Type, nil
 		case START_PROXY_TYPE:
 			// StartProxy
 			var payload StartProxy
-			payload.ParseFromMap(resp.Payload.(map[string]interface{}))
-			return payload, resp.Type, err.ERR_SUCCESS
+			payload.ParseFromMap(payloadMap)
+			return payload, resp.Type, nil
 		case PONG_TYPE:
 			// Pong
 			var payload Pong
-			return payload, resp.Type, err.ERR_SUCCESS
+			return payload, resp.Type, nil
 		default:
-			return nil, resp.Type, err.ERR_UNKNOW_RESP
+			return nil, resp.Type, errcode.New(errcode.ErrUnknowResp, "type "+resp.Type)
 		}
 	} else {
-		return nil, resp.Type, err.ERR_UNKNOW_RESP
+		return nil, resp.Type, errcode.New(errcode.ErrUnknowResp, "payload of "+resp.Type+" is not an object")
 	}
 }
 
@@ -119,6 +129,12 @@ func PayloadStructToBytes(payload interface{}, payloadType string) ([]byte, erro
 	
 	if err == nil {
 		var length = len(content)
+
+		// 长度只用了8位byte中的低2位
+		if length > MAX_FRAME_SIZE {
+			return nil, errcode.New(errcode.ErrPayloadToBytes, "payload too large")
+		}
+
 		var lenBytes = LenToBytes(uint16(length))
 		
 		var buf bytes.Buffer
@@ -0,0 +1,206 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	errcode "ngrok-client/ngrokc/err"
+)
+
+func frame(content string) []byte {
+	return append(LenToBytes(uint16(len(content))), content...)
+}
+
+func FuzzParsePayloadStruct(f *testing.F) {
+	f.Add([]byte(`{"Type":"AuthResp","Payload":{"Version":"2","MmVersion":"1.7","ClientId":"abc","Error":""}}`))
+	f.Add([]byte(`{"Type":"NewTunnel","Payload":{"ReqId":"1","Url":"http://a.b","Protocol":"http","Error":""}}`))
+	f.Add([]byte(`{"Type":"StartProxy","Payload":{"Url":"tcp://a.b:1","ClientAddr":"1.2.3.4:5"}}`))
+	f.Add([]byte(`{"Type":"ReqProxy","Payload":{}}`))
+	f.Add([]byte(`{"Type":"Pong","Payload":null}`))
+	f.Add([]byte(`{"Type":"AuthResp","Payload":{"ClientId":1}}`))
+	f.Add([]byte(`{"Type":"NewTunnel","Payload":[1,2]}`))
+	f.Add([]byte("\x00\x00{}\x00"))
+	f.Add([]byte(`null`))
+
+	f.Fuzz(func(t *testing.T, content []byte) {
+		resp, respType, err := ParsePayloadStruct(content)
+
+		if err != nil {
+			var e *errcode.Error
+			if !errors.As(err, &e) {
+				t.Fatalf("error %v is not *errcode.Error", err)
+			}
+			if resp != nil {
+				t.Fatalf("resp %#v returned with error %v", resp, err)
+			}
+			return
+		}
+
+		switch respType {
+		case AUTH_RESP_TYPE, NEW_TUNNEL_TYPE, REQ_PROXY_TYPE, START_PROXY_TYPE, PONG_TYPE:
+		default:
+			t.Fatalf("unknown type %q accepted", respType)
+		}
+	})
+}
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add(frame(`{"Type":"Pong","Payload":{}}`))
+	f.Add(append(frame(`{"Type":"StartProxy","Payload":{}}`), "GET / HTTP/1.1\r\n"...))
+	f.Add(append(frame("{}"), frame(`{"Type":"ReqProxy","Payload":{}}`)...))
+	f.Add([]byte{0xff, 0xff, 0, 0, 0, 0, 0, 0, '{'})
+	f.Add([]byte{1, 0, 0, 0, 0, 0, 0, 1, '{'})
+	f.Add([]byte{5, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := bufio.NewReaderSize(bytes.NewReader(data), 16)
+
+		for {
+			content, err := ReadFrame(reader)
+
+			if err != nil {
+				if err != io.EOF && err != io.ErrUnexpectedEOF && !errors.Is(err, errcode.ErrBytesToPayload) {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+
+			if len(content) > MAX_FRAME_SIZE {
+				t.Fatalf("frame of %d bytes", len(content))
+			}
+
+			ParsePayloadStruct(content)
+		}
+	})
+}
+
+func TestReadFrameRejectsLargeLength(t *testing.T) {
+	data := append([]byte{2, 0, 1, 0, 0, 0, 0, 0}, "{}"...)
+
+	if _, err := ReadFrame(bytes.NewReader(data)); !errors.Is(err, errcode.ErrBytesToPayload) {
+		t.Fatalf("ReadFrame = %v, want ErrBytesToPayload", err)
+	}
+}
+
+func TestPayloadStructToBytesRoundTrip(t *testing.T) {
+	buf, err := PayloadStructToBytes(StartProxy{Url: "http://a.b", ClientAddr: "1.2.3.4:5"}, START_PROXY_TYPE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ReadFrame(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, respType, err := ParsePayloadStruct(content)
+	if err != nil || respType != START_PROXY_TYPE || resp.(StartProxy).ClientAddr != "1.2.3.4:5" {
+		t.Fatalf("ParsePayloadStruct = %#v, %q, %v", resp, respType, err)
+	}
+
+	if _, err := PayloadStructToBytes(StartProxy{Url: string(make([]byte, MAX_FRAME_SIZE))}, START_PROXY_TYPE); !errors.Is(err, errcode.ErrPayloadToBytes) {
+		t.Fatalf("PayloadStructToBytes of large payload = %v, want ErrPayloadToBytes", err)
+	}
+}
+
+// fakeClock 测试使用的时钟，只在 advance 时前进
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time { return clock.now }
+
+func (clock *fakeClock) advance(d time.Duration) { clock.now = clock.now.Add(d) }
+
+func TestTokenBucket(t *testing.T) {
+	if NewTokenBucket(0, 100) != nil {
+		t.Fatal("NewTokenBucket(0) should not limit")
+	}
+
+	var unlimited *TokenBucket
+	if delay := unlimited.Reserve(1 << 20); delay != 0 {
+		t.Fatalf("nil Reserve = %s", delay)
+	}
+
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	bucket := NewTokenBucketClock(1000, 100, clock.Now)
+
+	if delay := bucket.Reserve(100); delay != 0 {
+		t.Fatalf("Reserve(burst) = %s, want 0", delay)
+	}
+
+	// 桶已经空了，透支100个令牌需要等待100ms
+	if delay := bucket.Reserve(100); delay != 100*time.Millisecond {
+		t.Fatalf("Reserve(100) = %s, want 100ms", delay)
+	}
+
+	// 之前的透支也要补上
+	if delay := bucket.Reserve(100); delay != 200*time.Millisecond {
+		t.Fatalf("Reserve(100) = %s, want 200ms", delay)
+	}
+
+	// 等待结束后透支已经补上，再过50ms补充50个令牌
+	clock.advance(250 * time.Millisecond)
+	if delay := bucket.Reserve(100); delay != 50*time.Millisecond {
+		t.Fatalf("Reserve(100) after 250ms = %s, want 50ms", delay)
+	}
+
+	// 空闲很久之后最多积累 burst 个令牌
+	clock.advance(time.Hour)
+	if delay := bucket.Reserve(150); delay != 50*time.Millisecond {
+		t.Fatalf("Reserve(150) after idle = %s, want 50ms", delay)
+	}
+
+	// 每秒1000个令牌，按令牌桶的等待时间连续传输10000个令牌共需要9.9秒(开始时的100个不需要等待)
+	clock.advance(time.Hour)
+	var total time.Duration
+	for i := 0; i < 100; i++ {
+		delay := bucket.Reserve(100)
+		clock.advance(delay)
+		total += delay
+	}
+	if total != 9900*time.Millisecond {
+		t.Fatalf("total wait for 10000 tokens = %s, want 9.9s", total)
+	}
+}
+
+func TestTokenBucketAllow(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	bucket := NewTokenBucketClock(10, 2, clock.Now)
+
+	if !bucket.Full() {
+		t.Fatal("new bucket is not full")
+	}
+
+	if !bucket.Allow(1) || !bucket.Allow(1) {
+		t.Fatal("Allow within burst = false")
+	}
+
+	// 不透支，等待补充之后才能再取出
+	if bucket.Allow(1) {
+		t.Fatal("Allow over burst = true")
+	}
+
+	if bucket.Full() {
+		t.Fatal("empty bucket is full")
+	}
+
+	clock.advance(99 * time.Millisecond)
+	if bucket.Allow(1) {
+		t.Fatal("Allow before refill = true")
+	}
+
+	clock.advance(time.Millisecond)
+	if !bucket.Allow(1) {
+		t.Fatal("Allow after refill = false")
+	}
+
+	clock.advance(200 * time.Millisecond)
+	if !bucket.Full() {
+		t.Fatal("refilled bucket is not full")
+	}
+}